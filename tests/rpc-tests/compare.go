@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// maxDifferences caps the differences reported for one response.
+const maxDifferences = 20
+
+// unorderedFields are the arrays whose order is not part of the answer; they
+// are sorted before two responses are compared.
+var unorderedFields = map[string]bool{
+	"validators":  true,
+	"accessList":  true,
+	"storageKeys": true,
+}
+
+// normaliseJSON decodes raw into plain values with the differences clients
+// are free to make removed: null object fields are dropped, so null and
+// missing compare equal, hex strings are lowercased, and unorderedFields are
+// sorted.
+func normaliseJSON(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return normaliseValue(v, ""), nil
+}
+
+func normaliseValue(v interface{}, field string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if value == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = normaliseValue(value, key)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = normaliseValue(v[i], "")
+		}
+		if unorderedFields[field] {
+			sort.Slice(v, func(i, j int) bool {
+				a, _ := json.Marshal(v[i])
+				b, _ := json.Marshal(v[j])
+				return bytes.Compare(a, b) < 0
+			})
+		}
+		return v
+	case string:
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			return strings.ToLower(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// diffJSON appends to diffs the paths at which a and b, normalised values,
+// differ, stopping at maxDifferences.
+func diffJSON(path string, a, b interface{}, diffs []string) []string {
+	if len(diffs) >= maxDifferences {
+		return diffs
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for key := range a {
+			keys = append(keys, key)
+		}
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffs = diffJSON(path+"."+key, a[key], b[key], diffs)
+		}
+		return diffs
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if len(a) != len(b) {
+			return append(diffs, fmt.Sprintf("%s: %d items != %d items", path, len(a), len(b)))
+		}
+		for i := range a {
+			diffs = diffJSON(fmt.Sprintf("%s[%d]", path, i), a[i], b[i], diffs)
+		}
+		return diffs
+	}
+
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	if !bytes.Equal(ja, jb) {
+		diffs = append(diffs, fmt.Sprintf("%s: %s != %s", path, diffValue(a, ja), diffValue(b, jb)))
+	}
+	return diffs
+}
+
+// diffValue shows a value in a difference; nil is a field that one of the
+// responses does not have, or has as null.
+func diffValue(v interface{}, data []byte) string {
+	if v == nil {
+		return "missing"
+	}
+	return trimString(string(data), 200)
+}
+
+// compareResponses returns the semantic differences between the response of
+// the tested endpoint and that of the compared one. Error messages are not
+// compared, since every client words them its own way.
+func compareResponses(response, compared Response) []string {
+	switch {
+	case response.Error != nil && compared.Error != nil:
+		return nil
+	case response.Error != nil:
+		return []string{fmt.Sprintf("error: %q != a result", response.Error.Message)}
+	case compared.Error != nil:
+		return []string{fmt.Sprintf("error: a result != %q", compared.Error.Message)}
+	}
+
+	a, err := normaliseJSON(response.Result)
+	if err != nil {
+		return []string{fmt.Sprintf("result: invalid JSON: %v", err)}
+	}
+	b, err := normaliseJSON(compared.Result)
+	if err != nil {
+		return []string{fmt.Sprintf("result: invalid JSON from the compared endpoint: %v", err)}
+	}
+	return diffJSON("result", a, b, nil)
+}
+
+// compareBatch diffs the responses of the tested endpoint with those of the
+// compared one and returns the differences by request ID. Volatile tests are
+// not compared. The other requests are sent to the compared endpoint as they
+// were sent to the tested one, except those of HeadRelative tests, which are
+// prepared again at a block both endpoints have (see pinResponseMap) and sent
+// to both.
+func compareBatch(ctx context.Context, rm ResponseMap, requests []Request, responses []Response, testCases map[int]TestCase, transport, compareTransport rpcTransport) map[int][]string {
+	tested := make(map[int]Response, len(responses))
+	for _, response := range responses {
+		tested[response.ID] = response
+	}
+	var compareRequests []Request
+	var pinned []int
+	for _, req := range requests {
+		switch testCase := testCases[req.ID]; {
+		case testCase.Volatile:
+		case testCase.HeadRelative:
+			pinned = append(pinned, req.ID)
+		default:
+			compareRequests = append(compareRequests, req)
+		}
+	}
+
+	diffs := make(map[int][]string)
+	if len(compareRequests) > 0 {
+		compared := callByID(ctx, compareRequests, compareTransport)
+		for _, req := range compareRequests {
+			response, ok := tested[req.ID]
+			if !ok {
+				continue
+			}
+			if comparedResponse, ok := compared[req.ID]; ok {
+				diffs[req.ID] = compareResponses(response, comparedResponse)
+			} else {
+				diffs[req.ID] = []string{"no response from the compared endpoint"}
+			}
+		}
+	}
+	if len(pinned) > 0 {
+		for id, d := range comparePinned(ctx, rm, pinned, testCases, transport, compareTransport) {
+			diffs[id] = d
+		}
+	}
+	return diffs
+}
+
+// comparePinned prepares the requests of the HeadRelative tests ids again at
+// a block both endpoints have, sends them to both and diffs the responses.
+func comparePinned(ctx context.Context, rm ResponseMap, ids []int, testCases map[int]TestCase, transport, compareTransport rpcTransport) map[int][]string {
+	diffs := make(map[int][]string, len(ids))
+	pinned, err := pinResponseMap(ctx, rm, transport, compareTransport)
+	if err != nil {
+		for _, id := range ids {
+			diffs[id] = []string{fmt.Sprintf("no block to compare at: %v", err)}
+		}
+		return diffs
+	}
+
+	var requests []Request
+	pinnedIDs := make(map[int]int, len(ids))
+	for _, id := range ids {
+		req, err := testCases[id].PrepareRequest(&pinned)
+		if err != nil {
+			diffs[id] = []string{fmt.Sprintf("request at block %s: %v", pinned.pinnedBlockNumber, err)}
+			continue
+		}
+		pinnedIDs[req.ID] = id
+		requests = append(requests, *req)
+	}
+	if len(requests) == 0 {
+		return diffs
+	}
+
+	tested := callByID(ctx, requests, transport)
+	compared := callByID(ctx, requests, compareTransport)
+	for _, req := range requests {
+		id := pinnedIDs[req.ID]
+		response, ok := tested[req.ID]
+		if !ok {
+			diffs[id] = []string{fmt.Sprintf("no response from the tested endpoint at block %s", pinned.pinnedBlockNumber)}
+			continue
+		}
+		comparedResponse, ok := compared[req.ID]
+		if !ok {
+			diffs[id] = []string{fmt.Sprintf("no response from the compared endpoint at block %s", pinned.pinnedBlockNumber)}
+			continue
+		}
+		diffs[id] = compareResponses(response, comparedResponse)
+	}
+	return diffs
+}
+
+// pinResponseMap returns a copy of rm whose most recent block is the lower of
+// the two endpoints' heads, so that both can answer for it, with
+// pinnedBlockNumber set to it.
+func pinResponseMap(ctx context.Context, rm ResponseMap, transport, compareTransport rpcTransport) (ResponseMap, error) {
+	head, err := blockNumber(ctx, transport)
+	if err != nil {
+		return rm, err
+	}
+	comparedHead, err := blockNumber(ctx, compareTransport)
+	if err != nil {
+		return rm, fmt.Errorf("compared endpoint: %w", err)
+	}
+	if comparedHead.Cmp(head) < 0 {
+		head = comparedHead
+	}
+
+	responses, err := transport.Call(ctx, []Request{*NewRequest("eth_getBlockByNumber", []interface{}{fmt.Sprintf("0x%x", head), false})})
+	if err != nil {
+		return rm, err
+	}
+	if len(responses) == 0 {
+		return rm, fmt.Errorf("no response to eth_getBlockByNumber")
+	}
+	if responses[0].Error != nil {
+		return rm, fmt.Errorf("request error; message: %s | code: %d", responses[0].Error.Message, responses[0].Error.Code)
+	}
+	block, err := parseResponse[*RPCHead](responses[0].Result)
+	if err != nil {
+		return rm, err
+	}
+	if *block == nil {
+		return rm, fmt.Errorf("block %s not found", head)
+	}
+
+	rm.mostRecentBlockNumber = head
+	rm.mostRecentBlockHash = (*block).Hash
+	rm.mostRecentBlockParentHash = (*block).ParentHash
+	rm.pinnedBlockNumber = head
+	return rm, nil
+}
+
+// blockNumber returns the head of the endpoint behind transport.
+func blockNumber(ctx context.Context, transport rpcTransport) (*big.Int, error) {
+	responses, err := transport.Call(ctx, []Request{*NewRequest("eth_blockNumber", []interface{}{})})
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("no response to eth_blockNumber")
+	}
+	if responses[0].Error != nil {
+		return nil, fmt.Errorf("request error; message: %s | code: %d", responses[0].Error.Message, responses[0].Error.Code)
+	}
+	parsed, err := parseResponse[string](responses[0].Result)
+	if err != nil {
+		return nil, err
+	}
+	return hexStringToBigInt(*parsed)
+}
+
+// callByID sends requests through transport and returns the responses by
+// request ID; an error is printed and leaves the requests unanswered.
+func callByID(ctx context.Context, requests []Request, transport rpcTransport) map[int]Response {
+	responses, err := transport.Call(ctx, requests)
+	if err != nil {
+		fmt.Printf("Error while calling an RPC to compare: %v\n", err)
+	}
+	byID := make(map[int]Response, len(responses))
+	for _, response := range responses {
+		byID[response.ID] = response
+	}
+	return byID
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+// chainTransport answers like a node whose head is block head: eth_blockNumber,
+// eth_getBlockByNumber up to the head, and eth_getBalance, whose balance is
+// the block number it is read at. It keeps the blocks it was asked about.
+type chainTransport struct {
+	head  int64
+	asked []string
+}
+
+func (c *chainTransport) Call(_ context.Context, requests []Request) ([]Response, error) {
+	responses := make([]Response, 0, len(requests))
+	for _, req := range requests {
+		params, _ := req.Params.([]interface{})
+		var result interface{}
+		switch req.Method {
+		case "eth_blockNumber":
+			result = fmt.Sprintf("0x%x", c.head)
+		case "eth_getBlockByNumber":
+			number, _ := hexStringToBigInt(params[0].(string))
+			if number.Int64() <= c.head {
+				result = map[string]string{
+					"number":     params[0].(string),
+					"hash":       fmt.Sprintf("0x%064x", number),
+					"parentHash": fmt.Sprintf("0x%064x", new(big.Int).Sub(number, big.NewInt(1))),
+				}
+			}
+		case "eth_getBalance":
+			tag := params[1].(string)
+			c.asked = append(c.asked, tag)
+			result = tag
+			if tag == "latest" {
+				result = fmt.Sprintf("0x%x", c.head)
+			}
+		}
+		raw, _ := json.Marshal(result)
+		responses = append(responses, Response{JsonRPC: "2.0", ID: req.ID, Result: raw})
+	}
+	return responses, nil
+}
+
+func (c *chainTransport) Subscribe(context.Context, []interface{}) (*subscription, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *chainTransport) Close() {}
+
+func TestCompareBatchPinsHeadRelativeTests(t *testing.T) {
+	balance := TestCase{
+		Key: "eth_getBalance",
+		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
+			return NewRequest("eth_getBalance", []interface{}{rm.account.addr, rm.blockTag()}), nil
+		},
+	}
+	tests := []struct {
+		name         string
+		headRelative bool
+		diffs        []string
+		asked        []string
+	}{
+		{
+			name:         "head-relative tests are compared at the lower head",
+			headRelative: true,
+			asked:        []string{"0x5a"},
+		},
+		{
+			name:  "other tests are compared as sent",
+			diffs: []string{`result: "0x64" != "0x5a"`},
+			asked: []string{"latest"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tested := &chainTransport{head: 100}
+			compared := &chainTransport{head: 90}
+			testCase := balance
+			testCase.HeadRelative = test.headRelative
+
+			rm := ResponseMap{mostRecentBlockNumber: big.NewInt(100)}
+			req, _ := testCase.PrepareRequest(&rm)
+			responses, _ := tested.Call(context.Background(), []Request{*req})
+			tested.asked = nil
+
+			diffs := compareBatch(context.Background(), rm, []Request{*req}, responses, map[int]TestCase{req.ID: testCase}, tested, compared)
+			if got := diffs[req.ID]; !reflect.DeepEqual(got, test.diffs) {
+				t.Errorf("diffs = %q, want %q", got, test.diffs)
+			}
+			if !reflect.DeepEqual(compared.asked, test.asked) {
+				t.Errorf("compared endpoint asked at %q, want %q", compared.asked, test.asked)
+			}
+			if test.headRelative && !reflect.DeepEqual(tested.asked, test.asked) {
+				t.Errorf("tested endpoint asked at %q, want %q", tested.asked, test.asked)
+			}
+		})
+	}
+}
+
+func TestContractBlockTag(t *testing.T) {
+	tests := []struct {
+		name   string
+		pinned *big.Int
+		pushed *big.Int
+		want   string
+	}{
+		{name: "not pinned", pushed: big.NewInt(80), want: "latest"},
+		{name: "pinned after the pushed tx", pinned: big.NewInt(90), pushed: big.NewInt(80), want: "0x50"},
+		{name: "pinned before the pushed tx", pinned: big.NewInt(70), pushed: big.NewInt(80), want: "0x46"},
+		{name: "pinned without a pushed tx", pinned: big.NewInt(70), want: "0x46"},
+	}
+	for _, test := range tests {
+		rm := ResponseMap{pinnedBlockNumber: test.pinned, pushedTxBlockNumber: test.pushed}
+		if got := rm.contractBlockTag(); got != test.want {
+			t.Errorf("%s: contractBlockTag() = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"encoding/json"
@@ -76,7 +77,28 @@ type ResponseMap struct {
 	pushedTxDeployedContractRuntimeCode    *[]byte
 	filterId                               string
 	blockFilterId                          string
+	pinnedBlockNumber                      *big.Int
 }
+
+// blockTag is the block HeadRelative tests read at: latest, or the block
+// -compare-url pinned their comparison to.
+func (rm *ResponseMap) blockTag() string {
+	if rm.pinnedBlockNumber == nil {
+		return "latest"
+	}
+	return fmt.Sprintf("0x%x", rm.pinnedBlockNumber)
+}
+
+// contractBlockTag is blockTag for the state of the deployed test contract,
+// which a pinned comparison reads at the block of the pushed tx once the
+// pinned block has it.
+func (rm *ResponseMap) contractBlockTag() string {
+	if rm.pinnedBlockNumber != nil && rm.pushedTxBlockNumber != nil && rm.pushedTxBlockNumber.Cmp(rm.pinnedBlockNumber) <= 0 {
+		return fmt.Sprintf("0x%x", rm.pushedTxBlockNumber)
+	}
+	return rm.blockTag()
+}
+
 type Account struct {
 	key   *ecdsa.PrivateKey
 	addr  common.Address
@@ -117,10 +139,81 @@ type RPCTransaction struct {
 	YParity             *hexutil.Uint64   `json:"yParity,omitempty"`
 }
 
+// TestCase is one RPC call and the checks on its response. Produces and
+// Consumes name the ResponseMap fields its handlers write and read, with a dot
+// for a nested field (account.nonce); fields set before the tests run are not
+// declared. DependsOn names tests that must run first without passing data.
+// The runner batches the tests from these declarations. Volatile tests answer
+// from the node's head or local state (gas market, mempool, filters), so
+// -compare-url does not send them to the second endpoint. HeadRelative tests
+// ask about the head (latest, or the most recent block), which two endpoints
+// rarely agree on, so -compare-url prepares them again at a block both have,
+// through blockTag and the pinned ResponseMap fields. Tags, from
+// testTags, are what -include and -exclude select on. A test with a
+// Subscription has no request or response handler.
 type TestCase struct {
 	Key            string
+	Tags           []string
+	Produces       []string
+	Consumes       []string
+	DependsOn      []string
+	Volatile       bool
+	HeadRelative   bool
 	PrepareRequest func(*ResponseMap) (*Request, error)
 	HandleResponse func(*ResponseMap, Response) error
+	Subscription   *SubscriptionTest
+}
+
+// SubscriptionTest is an eth_subscribe subscription, opened before the first
+// batch so that it sees what the other tests cause. After the last batch its
+// notifications are checked as they come in, until there are Min of them and
+// Check passes or Timeout is over.
+type SubscriptionTest struct {
+	Params  []interface{}
+	Min     int
+	Timeout time.Duration
+	Check   func(*ResponseMap, []json.RawMessage) error
+}
+
+// RPCHead is the part of a newHeads notification the tests check.
+type RPCHead struct {
+	Number     *hexutil.Big `json:"number"`
+	Hash       common.Hash  `json:"hash"`
+	ParentHash common.Hash  `json:"parentHash"`
+}
+
+// checkHeads checks that newHeads notifications leave no block out. Every head
+// must build on the previous one, or be a reorg, which bor makes routinely,
+// onto a head already seen. The parent of a head below the first one cannot
+// have been seen, so a reorg that deep is taken as it comes, but the branch
+// has to be followed from there.
+func checkHeads(notifications []json.RawMessage) error {
+	var (
+		first    *big.Int
+		previous *RPCHead
+		seen     = make(map[common.Hash]bool)
+	)
+	for _, notification := range notifications {
+		head, err := parseResponse[RPCHead](notification)
+		if err != nil {
+			return err
+		}
+		if head.Number == nil {
+			return fmt.Errorf("head %s has no number", head.Hash)
+		}
+		number := head.Number.ToInt()
+		if first == nil {
+			first = number
+		}
+		parent := new(big.Int).Sub(number, big.NewInt(1))
+		if previous != nil && head.ParentHash != previous.Hash && !seen[head.ParentHash] && parent.Cmp(first) >= 0 {
+			return fmt.Errorf("head %d %s builds on %s, which is neither head %d %s nor any head seen before, so block %d of its branch was skipped",
+				number, head.Hash, head.ParentHash, previous.Number.ToInt(), previous.Hash, parent)
+		}
+		seen[head.Hash] = true
+		previous = head
+	}
+	return nil
 }
 
 type BatchTestCase []TestCase
@@ -158,17 +251,82 @@ type accountResult struct {
 }
 
 var (
-	rpcURL      = flag.String("rpc-url", "", "RPC Url to be tested")
+	rpcURL      = flag.String("rpc-url", "", "RPC Url to be tested: http(s)://, ws(s):// or an IPC socket path")
 	mnemonic    = flag.String("mnemonic", "", "mnemonic to be used on transactions")
 	privKey     = flag.String("priv-key", "", "privKey to be used on transactions")
 	filterTests = flag.Bool("filter-test", false, "True if want to include filter tests (recommended just when there is no load balancer)")
 	logReqRes   = flag.Bool("log-req-res", false, "True if want to log requests and responses)")
+	compareURL  = flag.String("compare-url", "", "Second RPC Url that every request is also sent to, failing the tests whose responses differ")
+	include     = flag.String("include", "", "Comma-separated tags or key regexps of the tests to run, with the tests they depend on (default all)")
+	exclude     = flag.String("exclude", "", "Comma-separated tags or key regexps of the tests not to run; the tests depending on them are skipped")
+	profile     = flag.String("profile", "full", "Test profile: full, or read-only to never send a transaction (needs no funded account)")
+	listTests   = flag.Bool("list", false, "List the selected tests by batch and exit")
+	reports     reportFlag
 )
 
+// filterTestKeys are the tests only run with -filter-test: a filter lives on
+// the node that created it, so behind a load balancer its changes are asked of
+// a node that does not know it.
+var filterTestKeys = []string{
+	"Create Transaction Scenario: eth_getFilterChanges (from eth_newFilter)",
+	"Create Transaction Scenario: eth_getFilterChanges (from eth_newBlockFilter)",
+}
+
 func main() {
+	flag.Var(&reports, "report", "Write a report of every test as junit=path or json=path (repeatable)")
 	flag.Parse()
-	if *mnemonic == "" && *privKey == "" {
-		fmt.Println("Must provide either mnemonic or privKey")
+
+	runTestCases, err := withoutTestCases(testCases, filterTestKeys)
+	if err != nil {
+		fmt.Printf("Invalid filter test cases: %v\n", err)
+		os.Exit(1)
+	}
+	if *filterTests {
+		runTestCases = testCases
+	}
+	plan, err := scheduleTestCases(runTestCases)
+	if err != nil {
+		fmt.Printf("Invalid test cases: %v\n", err)
+		os.Exit(1)
+	}
+	includeSelector, err := parseTestSelector(*include)
+	if err != nil {
+		fmt.Printf("Invalid include flag: %v\n", err)
+		os.Exit(1)
+	}
+	excludeSelector, err := parseTestSelector(*exclude)
+	if err != nil {
+		fmt.Printf("Invalid exclude flag: %v\n", err)
+		os.Exit(1)
+	}
+	profileTags, ok := testProfiles[*profile]
+	if !ok {
+		fmt.Printf("Invalid profile flag: %q\n", *profile)
+		os.Exit(1)
+	}
+	for _, tag := range profileTags {
+		excludeSelector.tags[tag] = true
+	}
+	if !supportsSubscriptions(*rpcURL) {
+		excludeSelector.tags["subscriptions"] = true
+	}
+	selection := plan.selectTestCases(includeSelector, excludeSelector)
+
+	if *listTests {
+		printTestPlan(plan, selection)
+		return
+	}
+
+	// Only sending transactions needs a funded account; the other tests can
+	// use any address.
+	needsAccount := false
+	for _, testCase := range runTestCases {
+		if selection.run[testCase.Key] && testCase.hasTag("write") {
+			needsAccount = true
+		}
+	}
+	if needsAccount && *mnemonic == "" && *privKey == "" {
+		fmt.Println("Must provide either mnemonic or privKey, or use -profile read-only")
 		os.Exit(1)
 		return
 	}
@@ -179,15 +337,73 @@ func main() {
 	}
 
 	// Ethereum node RPC endpoint
-	mapTestCases := testCasesToMap(testCases)
+	ctx := context.Background()
+	transport, err := dialTransport(ctx, *rpcURL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer transport.Close()
+	var compareTransport rpcTransport
+	if *compareURL != "" {
+		if compareTransport, err = dialTransport(ctx, *compareURL); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer compareTransport.Close()
+	}
+
 	rm := ResponseMap{}
-	mapRequestIdToKey := make(map[int]string)
-	var failedTestCases []FailedTestCase
+	mapRequestIdToTestCase := make(map[int]TestCase)
+	var failedTestCases, skippedTestCases []FailedTestCase
+	var differingTestCases []testResult
+	// failedUpstream maps each test that did not pass, or was excluded, to the
+	// failed or excluded test it traces back to.
+	failedUpstream := make(map[string]string)
+	run := &testRun{RPCURL: *rpcURL, CompareURL: *compareURL}
+	record := func(result testResult) {
+		// A test that only differs from the compared endpoint fails, but what
+		// it produced is still good for the tests that consume it.
+		differsOnly := result.Status == statusPass && len(result.Diffs) > 0
+		if differsOnly {
+			result.Status = statusFail
+			result.Err = fmt.Errorf("response differs from %s", *compareURL)
+		}
+		run.Results = append(run.Results, result)
+		if len(result.Diffs) > 0 {
+			differingTestCases = append(differingTestCases, result)
+		}
+		if result.Status == statusPass {
+			return
+		}
+		failedTestCase := FailedTestCase{Key: result.Key, Err: result.Err}
+		if result.Req != nil {
+			failedTestCase.Req = *result.Req
+		}
+		if result.Res != nil {
+			failedTestCase.Res = *result.Res
+		}
+		if result.Status == statusSkip {
+			skippedTestCases = append(skippedTestCases, failedTestCase)
+			return
+		}
+		failedTestCases = append(failedTestCases, failedTestCase)
+		if !differsOnly {
+			failedUpstream[result.Key] = result.Key
+		}
+	}
 	if *mnemonic != "" {
 		rm.account = generateAccountsUsingMnemonic(*mnemonic, 1)[0]
-	} else {
+	} else if *privKey != "" {
 		acc, _ := generateAccountUsingPrivKey(*privKey)
 		rm.account = *acc
+	} else {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			fmt.Printf("Error generating an account: %v\n", err)
+			os.Exit(1)
+		}
+		rm.account = Account{key: key, addr: crypto.PubkeyToAddress(key.PublicKey), nonce: big.NewInt(0)}
 	}
 
 	rm.expectedGasToCreateTransaction = big.NewInt(354658)
@@ -195,126 +411,162 @@ func main() {
 	rm.expectedKeyToStoreInContract = "key"
 	rm.expectedSlot0Value = big.NewInt(42) // first variable set on contract
 
-	// Test cases are grouped into batches when there are no dependencies between them.
-	// If one test case depends on the response of another to construct its request,
-	// it should be placed in a subsequent batch to maintain the correct order.
-	testCaseBatches := []BatchTestCase{
-		{
-			mapTestCases["bor_getAuthor (no params)"],
-			mapTestCases["bor_getCurrentProposer"],
-			mapTestCases["bor_getCurrentValidators"],
-			mapTestCases["bor_getSnapshotProposer"],
-			mapTestCases["bor_getSnapshotProposerSequence"],
-			mapTestCases["eth_blockNumber"],
-			mapTestCases["eth_chainId"],
-			mapTestCases["eth_feeHistory"],
-			mapTestCases["eth_gasPrice"],
-			mapTestCases["eth_getBalance"],
-		}, {
-			mapTestCases["eth_getTransactionCount"],
-			mapTestCases["eth_maxPriorityFeePerGas"],
-			mapTestCases["eth_syncing"],
-		},
-		{
-			mapTestCases["bor_getAuthor (by number)"],
-			mapTestCases["bor_getRootHash"],
-			mapTestCases["bor_getSigners"],
-			mapTestCases["bor_getSnapshot"],
-			mapTestCases["eth_getBlockByNumber"],
-			mapTestCases["eth_getHeaderByNumber"],
-			mapTestCases["Create Transaction Scenario: eth_estimateGas"],
-			mapTestCases["Create Transaction Scenario: eth_fillTransaction"],
-			mapTestCases["StateSyncTx Scenario: eth_getLogs"],
-		},
-		{
-			mapTestCases["bor_getAuthor (by hash)"],
-			mapTestCases["bor_getSignersAtHash"],
-			mapTestCases["bor_getSnapshotAtHash"],
-			mapTestCases["eth_getBlockByHash"],
-			mapTestCases["eth_getHeaderByHash"],
-			mapTestCases["Create Transaction Scenario: eth_sendRawTransaction"],
-			mapTestCases["Create Transaction Scenario: eth_createAccessList"],
-			mapTestCases["StateSyncTx Scenario: eth_getTransactionReceipt"],
-		},
-		{
-			mapTestCases["Create Transaction Scenario: eth_getRawTransactionByHash"],
-			mapTestCases["Create Transaction Scenario: eth_getTransactionReceipt"],
-			mapTestCases["StateSyncTx Scenario: eth_getBlockReceipts"],
-			mapTestCases["StateSyncTx Scenario: eth_getTransactionByHash"],
-			mapTestCases["StateSyncTx Scenario: eth_getTransactionReceiptsByBlock"],
-			mapTestCases["StateSyncTx Scenario: eth_getTransactionByBlockHashAndIndex"],
-			mapTestCases["StateSyncTx Scenario: eth_getTransactionByBlockNumberAndIndex"],
-		},
-		{
-			mapTestCases["Create Transaction Scenario: eth_getCode"],
-			mapTestCases["Create Transaction Scenario: eth_call"],
-			mapTestCases["Create Transaction Scenario: eth_newFilter"],
-			mapTestCases["Create Transaction Scenario: eth_newBlockFilter"],
-			mapTestCases["Create Transaction Scenario: eth_getRawTransactionByBlockHashAndIndex"],
-			mapTestCases["Create Transaction Scenario: eth_getRawTransactionByBlockNumberAndIndex"],
-			mapTestCases["Create Transaction Scenario: eth_getStorageAt"],
-			mapTestCases["Create Transaction Scenario: eth_getProof"],
-			mapTestCases["StateSyncTx Scenario: eth_getBlockTransactionCountByHash"],
-			mapTestCases["StateSyncTx Scenario: eth_getBlockTransactionCountByNumber"],
-		},
+	if len(reports) > 0 {
+		version, err := clientVersion(ctx, transport)
+		if err != nil {
+			fmt.Printf("Error while getting the client version: %v\n", err)
+		}
+		run.ClientVersion = version
 	}
 
-	if *filterTests {
-		testCaseBatches = append(testCaseBatches, BatchTestCase{
-			mapTestCases["Create Transaction Scenario: eth_getFilterChanges (from eth_newFilter)"],
-			mapTestCases["Create Transaction Scenario: eth_getFilterChanges (from eth_newBlockFilter)"],
-		})
+	timeStart := time.Now()
+	countTestCases := len(selection.run)
+
+	subscriptions := make(map[string]*subscription)
+	subscriptionErrors := make(map[string]error)
+	for _, testCase := range runTestCases {
+		if testCase.Subscription == nil || !selection.run[testCase.Key] {
+			continue
+		}
+		sub, err := transport.Subscribe(ctx, testCase.Subscription.Params)
+		if err != nil {
+			subscriptionErrors[testCase.Key] = fmt.Errorf("error subscribing: %w", err)
+			continue
+		}
+		subscriptions[testCase.Key] = sub
 	}
+	// Subscriptions are checked after the last batch, so they see what every
+	// other test did.
+	var pendingSubscriptions []TestCase
 
-	timeStart := time.Now()
-	countTestCases := 0
-	for _, testCaseBatch := range testCaseBatches {
+	for _, testCaseBatch := range plan.batches {
 		// Preparing Request
 		requests := make([]Request, 0)
 		mapRequests := make(map[int]Request)
-		countTestCases += len(testCaseBatch)
 		for _, testCase := range testCaseBatch {
+			if !selection.run[testCase.Key] {
+				if selection.excluded[testCase.Key] {
+					failedUpstream[testCase.Key] = testCase.Key
+				}
+				continue
+			}
+			if upstream, ok := plan.failedUpstream(testCase.Key, failedUpstream); ok {
+				reason := "failed"
+				if selection.excluded[upstream] {
+					reason = "excluded"
+				}
+				record(testResult{Key: testCase.Key, Status: statusSkip, Err: fmt.Errorf("skipped: upstream %q %s", upstream, reason)})
+				failedUpstream[testCase.Key] = upstream
+				continue
+			}
+			if testCase.Subscription != nil {
+				pendingSubscriptions = append(pendingSubscriptions, testCase)
+				continue
+			}
 			req, err := testCase.PrepareRequest(&rm)
 			if err != nil {
-				failedTestCases = append(failedTestCases, FailedTestCase{Key: testCase.Key, Err: err})
+				record(testResult{Key: testCase.Key, Status: statusFail, Err: err})
+				continue
+			}
+			if req != nil && *profile == "read-only" && readOnlyForbiddenMethods[req.Method] {
+				record(testResult{Key: testCase.Key, Status: statusFail, Err: fmt.Errorf("%s is not sent with the read-only profile", req.Method), Req: req})
 				continue
 			}
 			if req == nil {
+				record(testResult{Key: testCase.Key, Status: statusPass})
 				continue
 			}
 
-			mapRequestIdToKey[req.ID] = testCase.Key
+			mapRequestIdToTestCase[req.ID] = testCase
 			mapRequests[req.ID] = *req
 
 			requests = append(requests, *req)
 		}
+		if len(requests) == 0 {
+			continue
+		}
 
-		responses, err := CallEthereumRPC(requests, *rpcURL)
+		batchStart := time.Now()
+		responses, err := transport.Call(ctx, requests)
+		latency := time.Since(batchStart)
 		if err != nil {
 			fmt.Printf("Error while calling Ethereum RPC: %v\n", err)
 		}
+		var diffs map[int][]string
+		if *compareURL != "" {
+			diffs = compareBatch(ctx, rm, requests, responses, mapRequestIdToTestCase, transport, compareTransport)
+		}
 
 		// Handling Response
+		answered := make(map[int]bool)
 		for _, response := range responses {
-			key := mapRequestIdToKey[response.ID]
+			testCase, ok := mapRequestIdToTestCase[response.ID]
+			if !ok || answered[response.ID] {
+				continue
+			}
+			answered[response.ID] = true
+			req := mapRequests[response.ID]
+			result := testResult{Key: testCase.Key, Status: statusPass, Latency: latency, Req: &req, Res: &response}
+			result.Diffs = diffs[response.ID]
 			if response.Error != nil {
-				failedTestCases = append(failedTestCases, FailedTestCase{Key: key, Err: fmt.Errorf("request error; message: %s | code: %d", response.Error.Message, response.Error.Code), Req: mapRequests[response.ID], Res: response})
+				result.Status = statusFail
+				result.Err = fmt.Errorf("request error; message: %s | code: %d", response.Error.Message, response.Error.Code)
+				record(result)
 				continue
 			}
-			err := mapTestCases[key].HandleResponse(&rm, response)
+			if err := testCase.HandleResponse(&rm, response); err != nil {
+				result.Status = statusFail
+				result.Err = err
+			}
+			record(result)
+		}
+		for _, req := range requests {
+			if answered[req.ID] {
+				continue
+			}
+			noResponse := errors.New("no response to the request")
 			if err != nil {
-				failedTestCases = append(failedTestCases, FailedTestCase{Key: key, Err: err, Req: mapRequests[response.ID], Res: response})
+				noResponse = fmt.Errorf("no response to the request: %w", err)
 			}
+			record(testResult{Key: mapRequestIdToTestCase[req.ID].Key, Status: statusFail, Err: noResponse, Latency: latency, Req: &req})
+		}
+	}
 
+	for _, testCase := range pendingSubscriptions {
+		if err, ok := subscriptionErrors[testCase.Key]; ok {
+			record(testResult{Key: testCase.Key, Status: statusFail, Err: err})
+			continue
 		}
+		waitStart := time.Now()
+		_, err := subscriptions[testCase.Key].wait(testCase.Subscription.Min, testCase.Subscription.Timeout, func(notifications []json.RawMessage) error {
+			return testCase.Subscription.Check(&rm, notifications)
+		})
+		result := testResult{Key: testCase.Key, Status: statusPass, Latency: time.Since(waitStart)}
+		if err != nil {
+			result.Status = statusFail
+			result.Err = err
+		}
+		record(result)
 	}
 
-	passedTests := countTestCases - len(failedTestCases)
+	passedTests := countTestCases - len(failedTestCases) - len(skippedTestCases)
 	duration := time.Since(timeStart)
+	run.StartedAt = timeStart
+	run.Duration = duration
+	if err := writeReports(reports, run); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	fmt.Println("════════════════════════════════════════")
 	fmt.Println("🚀  All Tests Executed!")
 	fmt.Printf("✅  Success: %d/%d tests passed\n", passedTests, countTestCases)
+	if len(skippedTestCases) > 0 {
+		fmt.Printf("⏭️  Skipped: %d tests\n", len(skippedTestCases))
+	}
+	if *compareURL != "" {
+		fmt.Printf("🔀  Differ: %d tests from %s\n", len(differingTestCases), *compareURL)
+	}
 	fmt.Printf("⌛  Duration: %s\n", duration)
 	fmt.Println("════════════════════════════════════════")
 
@@ -331,6 +583,26 @@ func main() {
 				fmt.Printf("      📥 Response: %s\n", string(response))
 			}
 		}
+	}
+	if len(skippedTestCases) > 0 {
+		fmt.Printf("\n\n")
+		fmt.Println("⏭️  Skipped Test Cases:")
+		for _, skippedTestCase := range skippedTestCases {
+			fmt.Printf("\n  🔎 Test Case Key: %s\n", skippedTestCase.Key)
+			fmt.Printf("      ⏭️  %s\n", skippedTestCase.Err)
+		}
+	}
+	if len(differingTestCases) > 0 {
+		fmt.Printf("\n\n")
+		fmt.Printf("🔀 Test Cases Differing From %s:\n", *compareURL)
+		for _, differingTestCase := range differingTestCases {
+			fmt.Printf("\n  🔎 Test Case Key: %s\n", differingTestCase.Key)
+			for _, diff := range differingTestCase.Diffs {
+				fmt.Printf("      🔀 %s\n", diff)
+			}
+		}
+	}
+	if len(failedTestCases) > 0 {
 		os.Exit(1)
 	}
 }
@@ -342,13 +614,6 @@ func trimString(s string, maxLength int) string {
 	}
 	return s
 }
-func testCasesToMap(testCases []TestCase) map[string]TestCase {
-	mapTestCases := make(map[string]TestCase)
-	for _, testCase := range testCases {
-		mapTestCases[testCase.Key] = testCase
-	}
-	return mapTestCases
-}
 
 // CallEthereumRPC performs an RPC call to an Ethereum node.
 func CallEthereumRPC(reqPayload []Request, rpcURL string) ([]Response, error) {
@@ -976,7 +1241,9 @@ func prepareEstimateGasRequest(from Account, input []byte) map[string]interface{
 
 var testCases = []TestCase{
 	{
-		Key: "eth_chainId",
+		Key:      "eth_chainId",
+		Tags:     []string{"eth"},
+		Produces: []string{"chainId"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_chainId", []interface{}{}), nil
 		},
@@ -995,7 +1262,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_blockNumber",
+		Key:      "eth_blockNumber",
+		Tags:     []string{"eth"},
+		Produces: []string{"mostRecentBlockNumber"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_blockNumber", []interface{}{}), nil
 		},
@@ -1013,9 +1283,12 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_getTransactionCount",
+		Key:          "eth_getTransactionCount",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
+		Produces:     []string{"account.nonce"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
-			return NewRequest("eth_getTransactionCount", []interface{}{rm.account.addr, "latest"}), nil
+			return NewRequest("eth_getTransactionCount", []interface{}{rm.account.addr, rm.blockTag()}), nil
 		},
 		HandleResponse: func(rm *ResponseMap, resp Response) error {
 			parsed, err := parseResponse[string](resp.Result)
@@ -1033,7 +1306,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getCurrentProposer",
+		Key:      "bor_getCurrentProposer",
+		Tags:     []string{"bor"},
+		Produces: []string{"currentProposerAddress"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getCurrentProposer", []interface{}{}), nil
 		},
@@ -1050,7 +1326,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getCurrentValidators",
+		Key:      "bor_getCurrentValidators",
+		Tags:     []string{"bor"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getCurrentValidators", []interface{}{}), nil
 		},
@@ -1077,7 +1355,11 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_getBlockByNumber",
+		Key:          "eth_getBlockByNumber",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockNumber"},
+		Produces:     []string{"mostRecentBlockHash", "mostRecentBlockParentHash"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getBlockByNumber", []interface{}{fmt.Sprintf("0x%x", rm.mostRecentBlockNumber), true}), nil
 		},
@@ -1098,7 +1380,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_getBlockByHash",
+		Key:          "eth_getBlockByHash",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockParentHash"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			// requests most recent parent block
 			return NewRequest("eth_getBlockByHash", []interface{}{fmt.Sprintf("0x%x", rm.mostRecentBlockParentHash), true}), nil
@@ -1116,7 +1401,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_getHeaderByNumber",
+		Key:          "eth_getHeaderByNumber",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getHeaderByNumber", []interface{}{fmt.Sprintf("0x%x", rm.mostRecentBlockNumber)}), nil
 		},
@@ -1133,7 +1421,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_getHeaderByHash",
+		Key:          "eth_getHeaderByHash",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockHash"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getHeaderByHash", []interface{}{fmt.Sprintf("0x%x", rm.mostRecentBlockHash)}), nil
 		},
@@ -1150,9 +1441,11 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_getBalance",
+		Key:          "eth_getBalance",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
-			return NewRequest("eth_getBalance", []interface{}{rm.account.addr, "latest"}), nil
+			return NewRequest("eth_getBalance", []interface{}{rm.account.addr, rm.blockTag()}), nil
 		},
 		HandleResponse: func(rm *ResponseMap, resp Response) error {
 			parsed, err := parseResponse[string](resp.Result)
@@ -1171,7 +1464,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_gasPrice",
+		Key:      "eth_gasPrice",
+		Tags:     []string{"eth"},
+		Produces: []string{"gasPrice"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_gasPrice", []interface{}{}), nil
 		},
@@ -1193,7 +1489,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_maxPriorityFeePerGas",
+		Key:      "eth_maxPriorityFeePerGas",
+		Tags:     []string{"eth"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_maxPriorityFeePerGas", []interface{}{}), nil
 		},
@@ -1214,7 +1512,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_feeHistory",
+		Key:      "eth_feeHistory",
+		Tags:     []string{"eth"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_feeHistory", []interface{}{4, "latest", []int{25, 75}}), nil
 		},
@@ -1265,7 +1565,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "eth_syncing",
+		Key:      "eth_syncing",
+		Tags:     []string{"eth"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_syncing", []interface{}{}), nil
 		},
@@ -1281,7 +1583,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getAuthor (by number)",
+		Key:          "bor_getAuthor (by number)",
+		Tags:         []string{"bor"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getAuthor", []interface{}{fmt.Sprintf("0x%x", rm.mostRecentBlockNumber)}), nil
 		},
@@ -1297,7 +1602,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getAuthor (no params)",
+		Key:      "bor_getAuthor (no params)",
+		Tags:     []string{"bor"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getAuthor", []interface{}{}), nil
 		},
@@ -1313,7 +1620,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getAuthor (by hash)",
+		Key:          "bor_getAuthor (by hash)",
+		Tags:         []string{"bor"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockParentHash"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getAuthor", []interface{}{rm.mostRecentBlockParentHash}), nil
 		},
@@ -1329,7 +1639,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getRootHash",
+		Key:          "bor_getRootHash",
+		Tags:         []string{"bor"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getRootHash", []interface{}{new(big.Int).Sub(rm.mostRecentBlockNumber, big.NewInt(20)), rm.mostRecentBlockNumber}), nil
 		},
@@ -1346,10 +1659,12 @@ var testCases = []TestCase{
 	},
 
 	{
-		Key: "Create Transaction Scenario: eth_estimateGas",
+		Key:          "Create Transaction Scenario: eth_estimateGas",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			txParams := prepareEstimateGasRequest(rm.account, generateInputForDeployTestContract(rm.expectedKeyToStoreInContract, rm.expectedValueToStoreInContract))
-			return NewRequest("eth_estimateGas", []interface{}{txParams}), nil
+			return NewRequest("eth_estimateGas", []interface{}{txParams, rm.blockTag()}), nil
 		},
 		HandleResponse: func(rm *ResponseMap, resp Response) error {
 			parsed, err := parseResponse[string](resp.Result)
@@ -1374,7 +1689,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getSigners",
+		Key:          "bor_getSigners",
+		Tags:         []string{"bor"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getSigners", []interface{}{fmt.Sprintf("0x%x", rm.mostRecentBlockNumber)}), nil
 		},
@@ -1390,7 +1708,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getSignersAtHash",
+		Key:          "bor_getSignersAtHash",
+		Tags:         []string{"bor"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockParentHash"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getSignersAtHash", []interface{}{rm.mostRecentBlockParentHash}), nil
 		},
@@ -1406,7 +1727,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getSnapshot",
+		Key:          "bor_getSnapshot",
+		Tags:         []string{"bor"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getSnapshot", []interface{}{fmt.Sprintf("0x%x", rm.mostRecentBlockNumber)}), nil
 		},
@@ -1423,7 +1747,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getSnapshotAtHash",
+		Key:          "bor_getSnapshotAtHash",
+		Tags:         []string{"bor"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockParentHash"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getSnapshotAtHash", []interface{}{rm.mostRecentBlockParentHash}), nil
 		},
@@ -1440,7 +1767,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getSnapshotProposer",
+		Key:      "bor_getSnapshotProposer",
+		Tags:     []string{"bor"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getSnapshotProposer", []interface{}{}), nil
 		},
@@ -1456,7 +1785,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "bor_getSnapshotProposerSequence",
+		Key:      "bor_getSnapshotProposerSequence",
+		Tags:     []string{"bor"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("bor_getSnapshotProposerSequence", []interface{}{}), nil
 		},
@@ -1473,7 +1804,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_fillTransaction",
+		Key:      "Create Transaction Scenario: eth_fillTransaction",
+		Tags:     []string{"eth"},
+		Consumes: []string{"chainId", "account.nonce"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			txParams := prepareEstimateGasRequest(rm.account, generateInputForDeployTestContract(rm.expectedKeyToStoreInContract, rm.expectedValueToStoreInContract))
 			return NewRequest("eth_fillTransaction", []interface{}{txParams}), nil
@@ -1494,7 +1828,11 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getLogs",
+		Key:          "StateSyncTx Scenario: eth_getLogs",
+		Tags:         []string{"eth", "state-sync", "archive"},
+		HeadRelative: true,
+		Consumes:     []string{"mostRecentBlockNumber"},
+		Produces:     []string{"stateSyncTxHash", "stateSyncBlockHash", "stateSyncBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			// Define the event topic for StateCommitted(uint256 indexed stateId, bool success)
 			eventSignature := "StateCommitted(uint256,bool)"
@@ -1534,7 +1872,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getTransactionReceipt",
+		Key:      "StateSyncTx Scenario: eth_getTransactionReceipt",
+		Tags:     []string{"eth", "state-sync"},
+		Consumes: []string{"stateSyncTxHash"},
+		Produces: []string{"stateSyncTxIndex"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			if (rm.stateSyncTxHash == common.Hash{}) {
 				return nil, fmt.Errorf("no state sync tx given for request")
@@ -1563,7 +1904,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getTransactionByHash",
+		Key:      "StateSyncTx Scenario: eth_getTransactionByHash",
+		Tags:     []string{"eth", "state-sync"},
+		Consumes: []string{"stateSyncTxHash", "stateSyncBlockHash", "stateSyncTxIndex"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			if (rm.stateSyncBlockHash == common.Hash{}) {
 				return nil, fmt.Errorf("no state sync tx given for request")
@@ -1586,7 +1929,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getTransactionByBlockHashAndIndex",
+		Key:      "StateSyncTx Scenario: eth_getTransactionByBlockHashAndIndex",
+		Tags:     []string{"eth", "state-sync"},
+		Consumes: []string{"stateSyncBlockHash", "stateSyncTxIndex"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			if (rm.stateSyncBlockHash == common.Hash{}) {
 				return nil, fmt.Errorf("no state sync tx given for request")
@@ -1609,7 +1954,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getTransactionByBlockNumberAndIndex",
+		Key:      "StateSyncTx Scenario: eth_getTransactionByBlockNumberAndIndex",
+		Tags:     []string{"eth", "state-sync"},
+		Consumes: []string{"stateSyncBlockNumber", "stateSyncBlockHash", "stateSyncTxIndex"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			if rm.stateSyncBlockNumber == nil {
 				return nil, fmt.Errorf("no state sync tx given for request")
@@ -1631,7 +1978,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getTransactionReceiptsByBlock",
+		Key:      "StateSyncTx Scenario: eth_getTransactionReceiptsByBlock",
+		Tags:     []string{"eth", "state-sync"},
+		Consumes: []string{"stateSyncBlockHash"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			if (rm.stateSyncBlockHash == common.Hash{}) {
 				return nil, fmt.Errorf("no state sync tx given for request")
@@ -1648,7 +1997,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getBlockReceipts",
+		Key:      "StateSyncTx Scenario: eth_getBlockReceipts",
+		Tags:     []string{"eth", "state-sync"},
+		Consumes: []string{"stateSyncBlockHash"},
+		Produces: []string{"stateSyncExpectedBlockTransactionCount"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			if (rm.stateSyncBlockHash == common.Hash{}) {
 				return nil, fmt.Errorf("no state sync tx given for request")
@@ -1671,7 +2023,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getBlockTransactionCountByNumber",
+		Key:      "StateSyncTx Scenario: eth_getBlockTransactionCountByNumber",
+		Tags:     []string{"eth", "state-sync"},
+		Consumes: []string{"stateSyncBlockNumber", "stateSyncExpectedBlockTransactionCount"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getBlockTransactionCountByNumber", []interface{}{fmt.Sprintf("0x%x", rm.stateSyncBlockNumber)}), nil
 		},
@@ -1693,7 +2047,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "StateSyncTx Scenario: eth_getBlockTransactionCountByHash",
+		Key:      "StateSyncTx Scenario: eth_getBlockTransactionCountByHash",
+		Tags:     []string{"eth", "state-sync"},
+		Consumes: []string{"stateSyncBlockHash", "stateSyncExpectedBlockTransactionCount"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getBlockTransactionCountByHash", []interface{}{rm.stateSyncBlockHash}), nil
 		},
@@ -1715,7 +2071,13 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_sendRawTransaction",
+		Key:      "Create Transaction Scenario: eth_sendRawTransaction",
+		Tags:     []string{"eth", "write"},
+		Consumes: []string{"account.nonce", "gasPrice", "chainId"},
+		Produces: []string{"expectedRawTx", "pushedTxHash"},
+		// The pending tx would change the nonce and gas these expect.
+		DependsOn: []string{"Create Transaction Scenario: eth_estimateGas", "Create Transaction Scenario: eth_fillTransaction"},
+		Volatile:  true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			rm.expectedRawTx = generateRawTransaction(
 				rm.account.nonce.Uint64(),
@@ -1740,10 +2102,12 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_createAccessList",
+		Key:          "Create Transaction Scenario: eth_createAccessList",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_createAccessList",
-					[]interface{}{prepareEstimateGasRequest(rm.account, generateInputForDeployTestContract(rm.expectedKeyToStoreInContract, rm.expectedValueToStoreInContract))}),
+					[]interface{}{prepareEstimateGasRequest(rm.account, generateInputForDeployTestContract(rm.expectedKeyToStoreInContract, rm.expectedValueToStoreInContract)), rm.blockTag()}),
 				nil
 		},
 		HandleResponse: func(rm *ResponseMap, resp Response) error {
@@ -1758,7 +2122,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getRawTransactionByHash",
+		Key:      "Create Transaction Scenario: eth_getRawTransactionByHash",
+		Tags:     []string{"eth"},
+		Consumes: []string{"pushedTxHash", "expectedRawTx"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getRawTransactionByHash",
 					[]interface{}{rm.pushedTxHash}),
@@ -1777,7 +2143,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getTransactionReceipt",
+		Key:      "Create Transaction Scenario: eth_getTransactionReceipt",
+		Tags:     []string{"eth"},
+		Consumes: []string{"pushedTxHash"},
+		Produces: []string{"pushedTxBlockNumber", "pushedTxBlockHash", "pushedTxTransactionIndex", "pushedTxDeployedContractAddress"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getTransactionReceipt",
 					[]interface{}{rm.pushedTxHash}),
@@ -1800,10 +2169,14 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getCode",
+		Key:          "Create Transaction Scenario: eth_getCode",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
+		Consumes:     []string{"pushedTxDeployedContractAddress", "pushedTxBlockNumber"},
+		Produces:     []string{"pushedTxDeployedContractRuntimeCode"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getCode",
-					[]interface{}{rm.pushedTxDeployedContractAddress, "latest"}),
+					[]interface{}{rm.pushedTxDeployedContractAddress, rm.contractBlockTag()}),
 				nil
 		},
 		HandleResponse: func(rm *ResponseMap, resp Response) error {
@@ -1838,7 +2211,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_call",
+		Key:      "Create Transaction Scenario: eth_call",
+		Tags:     []string{"eth"},
+		Consumes: []string{"pushedTxDeployedContractAddress", "pushedTxBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			txParams := map[string]interface{}{
 				"to":   fmt.Sprintf("%s", rm.pushedTxDeployedContractAddress),
@@ -1864,7 +2239,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getRawTransactionByBlockNumberAndIndex",
+		Key:      "Create Transaction Scenario: eth_getRawTransactionByBlockNumberAndIndex",
+		Tags:     []string{"eth"},
+		Consumes: []string{"pushedTxBlockNumber", "pushedTxTransactionIndex", "expectedRawTx"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getRawTransactionByBlockNumberAndIndex",
 					[]interface{}{fmt.Sprintf("0x%x", rm.pushedTxBlockNumber), fmt.Sprintf("0x%x", rm.pushedTxTransactionIndex)}),
@@ -1883,7 +2260,9 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getRawTransactionByBlockHashAndIndex",
+		Key:      "Create Transaction Scenario: eth_getRawTransactionByBlockHashAndIndex",
+		Tags:     []string{"eth"},
+		Consumes: []string{"pushedTxBlockHash", "pushedTxTransactionIndex", "expectedRawTx"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getRawTransactionByBlockHashAndIndex",
 					[]interface{}{rm.pushedTxBlockHash, fmt.Sprintf("0x%x", rm.pushedTxTransactionIndex)}),
@@ -1902,10 +2281,13 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getStorageAt",
+		Key:          "Create Transaction Scenario: eth_getStorageAt",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
+		Consumes:     []string{"pushedTxDeployedContractAddress", "pushedTxBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getStorageAt",
-					[]interface{}{rm.pushedTxDeployedContractAddress, "0x0", "latest"}),
+					[]interface{}{rm.pushedTxDeployedContractAddress, "0x0", rm.contractBlockTag()}),
 				nil
 		},
 		HandleResponse: func(rm *ResponseMap, resp Response) error {
@@ -1925,10 +2307,13 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getProof",
+		Key:          "Create Transaction Scenario: eth_getProof",
+		Tags:         []string{"eth"},
+		HeadRelative: true,
+		Consumes:     []string{"pushedTxDeployedContractAddress", "pushedTxDeployedContractRuntimeCode", "pushedTxBlockNumber"},
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getProof",
-					[]interface{}{rm.pushedTxDeployedContractAddress, []string{"0x0000000000000000000000000000000000000000000000000000000000000000"}, "latest"}),
+					[]interface{}{rm.pushedTxDeployedContractAddress, []string{"0x0000000000000000000000000000000000000000000000000000000000000000"}, rm.contractBlockTag()}),
 				nil
 		},
 		HandleResponse: func(rm *ResponseMap, resp Response) error {
@@ -1954,7 +2339,11 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_newFilter",
+		Key:      "Create Transaction Scenario: eth_newFilter",
+		Tags:     []string{"eth", "filters"},
+		Consumes: []string{"pushedTxBlockNumber", "pushedTxDeployedContractAddress"},
+		Produces: []string{"filterId"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			eventSignature := "ContractDeployed()"
 			eventTopic := crypto.Keccak256Hash([]byte(eventSignature))
@@ -1982,7 +2371,11 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_newBlockFilter",
+		Key:       "Create Transaction Scenario: eth_newBlockFilter",
+		Tags:      []string{"eth", "filters"},
+		Produces:  []string{"blockFilterId"},
+		DependsOn: []string{"Create Transaction Scenario: eth_getTransactionReceipt"},
+		Volatile:  true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_newBlockFilter",
 					[]interface{}{}),
@@ -1999,7 +2392,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getFilterChanges (from eth_newFilter)",
+		Key:      "Create Transaction Scenario: eth_getFilterChanges (from eth_newFilter)",
+		Tags:     []string{"eth", "filters"},
+		Consumes: []string{"filterId"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getFilterChanges",
 					[]interface{}{rm.filterId}),
@@ -2018,7 +2414,10 @@ var testCases = []TestCase{
 		},
 	},
 	{
-		Key: "Create Transaction Scenario: eth_getFilterChanges (from eth_newBlockFilter)",
+		Key:      "Create Transaction Scenario: eth_getFilterChanges (from eth_newBlockFilter)",
+		Tags:     []string{"eth", "filters"},
+		Consumes: []string{"blockFilterId"},
+		Volatile: true,
 		PrepareRequest: func(rm *ResponseMap) (*Request, error) {
 			return NewRequest("eth_getFilterChanges",
 					[]interface{}{rm.blockFilterId}),
@@ -2036,4 +2435,85 @@ var testCases = []TestCase{
 			return nil
 		},
 	},
+	{
+		Key:      "eth_subscribe (newHeads)",
+		Tags:     []string{"eth", "subscriptions"},
+		Volatile: true,
+		Subscription: &SubscriptionTest{
+			Params:  []interface{}{"newHeads"},
+			Min:     3,
+			Timeout: time.Minute,
+			Check: func(rm *ResponseMap, notifications []json.RawMessage) error {
+				if len(notifications) < 3 {
+					return fmt.Errorf("expected at least 3 heads, received %d", len(notifications))
+				}
+				return checkHeads(notifications)
+			},
+		},
+	},
+	{
+		Key:      "Create Transaction Scenario: eth_subscribe (logs)",
+		Tags:     []string{"eth", "subscriptions"},
+		Consumes: []string{"pushedTxHash", "pushedTxDeployedContractAddress"},
+		Volatile: true,
+		Subscription: &SubscriptionTest{
+			Params: []interface{}{"logs", map[string]interface{}{
+				"topics": [][]common.Hash{{crypto.Keccak256Hash([]byte("ContractDeployed()"))}},
+			}},
+			Min:     1,
+			Timeout: time.Minute,
+			Check: func(rm *ResponseMap, notifications []json.RawMessage) error {
+				found := false
+				var previous *types.Log
+				for _, notification := range notifications {
+					event, err := parseResponse[types.Log](notification)
+					if err != nil {
+						return err
+					}
+					if event.Removed {
+						continue
+					}
+					if previous != nil && (event.BlockNumber < previous.BlockNumber || (event.BlockNumber == previous.BlockNumber && event.Index <= previous.Index)) {
+						return fmt.Errorf("log %d of block %d followed log %d of block %d", event.Index, event.BlockNumber, previous.Index, previous.BlockNumber)
+					}
+					if event.TxHash == rm.pushedTxHash && event.Address == rm.pushedTxDeployedContractAddress {
+						found = true
+					}
+					previous = event
+				}
+				if !found {
+					return fmt.Errorf("no ContractDeployed log of %s among %d logs", rm.pushedTxDeployedContractAddress, len(notifications))
+				}
+				return nil
+			},
+		},
+	},
+	{
+		Key:      "Create Transaction Scenario: eth_subscribe (newPendingTransactions)",
+		Tags:     []string{"eth", "subscriptions"},
+		Consumes: []string{"pushedTxHash"},
+		Volatile: true,
+		Subscription: &SubscriptionTest{
+			Params:  []interface{}{"newPendingTransactions"},
+			Min:     1,
+			Timeout: time.Minute,
+			Check: func(rm *ResponseMap, notifications []json.RawMessage) error {
+				seen := make(map[common.Hash]bool)
+				for _, notification := range notifications {
+					txHash, err := parseResponse[common.Hash](notification)
+					if err != nil {
+						return err
+					}
+					if seen[*txHash] {
+						return fmt.Errorf("pending tx %s notified twice", txHash)
+					}
+					seen[*txHash] = true
+				}
+				if !seen[rm.pushedTxHash] {
+					return fmt.Errorf("pushed tx %s not among %d pending txs", rm.pushedTxHash, len(notifications))
+				}
+				return nil
+			},
+		},
+	},
 }
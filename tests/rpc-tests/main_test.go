@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// head is a newHeads notification for block number of branch, a hex digit
+// that starts its hash and that of its parent, of parentBranch.
+func head(number int, branch, parentBranch string) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"number":"0x%x","hash":"0x%s%063x","parentHash":"0x%s%063x"}`, number, branch, number, parentBranch, number-1))
+}
+
+func TestCheckHeads(t *testing.T) {
+	tests := []struct {
+		name  string
+		heads []json.RawMessage
+		err   string
+	}{
+		{
+			name:  "consecutive heads",
+			heads: []json.RawMessage{head(10, "a", "a"), head(11, "a", "a"), head(12, "a", "a")},
+		},
+		{
+			name:  "a head re-emitted on another branch",
+			heads: []json.RawMessage{head(10, "a", "a"), head(11, "a", "a"), head(11, "b", "a"), head(12, "b", "b")},
+		},
+		{
+			name:  "a reorg to a lower head",
+			heads: []json.RawMessage{head(10, "a", "a"), head(11, "a", "a"), head(12, "a", "a"), head(11, "b", "a"), head(12, "b", "b"), head(13, "b", "b")},
+		},
+		{
+			name:  "a reorg below the first head",
+			heads: []json.RawMessage{head(10, "a", "a"), head(11, "a", "a"), head(9, "b", "b"), head(10, "b", "b"), head(11, "b", "b"), head(12, "b", "b")},
+		},
+		{
+			name:  "a gap",
+			heads: []json.RawMessage{head(10, "a", "a"), head(11, "a", "a"), head(14, "a", "a")},
+			err:   "block 13 of its branch was skipped",
+		},
+		{
+			name:  "a gap after a reorg",
+			heads: []json.RawMessage{head(10, "a", "a"), head(11, "a", "a"), head(9, "b", "b"), head(13, "b", "b")},
+			err:   "block 12 of its branch was skipped",
+		},
+		{
+			name:  "a missing head of a reorged branch",
+			heads: []json.RawMessage{head(10, "a", "a"), head(11, "a", "a"), head(12, "a", "a"), head(9, "b", "b"), head(11, "b", "b")},
+			err:   "head 11 0xb",
+		},
+		{
+			name:  "a next head on an unseen branch",
+			heads: []json.RawMessage{head(10, "a", "a"), head(11, "b", "b"), head(12, "b", "b")},
+			err:   "block 10 of its branch was skipped",
+		},
+	}
+	for _, test := range tests {
+		err := checkHeads(test.heads)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// reportBodyLength is where requests and responses are cut in the reports.
+const reportBodyLength = 2000
+
+type testStatus string
+
+const (
+	statusPass testStatus = "pass"
+	statusFail testStatus = "fail"
+	statusSkip testStatus = "skip"
+)
+
+// testResult is the outcome of one test case. Latency is the round trip of the
+// JSON-RPC batch the test was sent in, so tests of a batch share it. Req and
+// Res are nil when the test did not get that far. Diffs are the differences
+// from the -compare-url endpoint's response; a test with any has failed.
+type testResult struct {
+	Key     string
+	Status  testStatus
+	Err     error
+	Latency time.Duration
+	Req     *Request
+	Res     *Response
+	Diffs   []string
+}
+
+// reportTarget is a report file to write, given as format=path.
+type reportTarget struct {
+	format string
+	path   string
+}
+
+// reportFlag collects the -report flags.
+type reportFlag []reportTarget
+
+func (f *reportFlag) String() string {
+	targets := make([]string, len(*f))
+	for i, target := range *f {
+		targets[i] = target.format + "=" + target.path
+	}
+	return strings.Join(targets, ",")
+}
+
+func (f *reportFlag) Set(value string) error {
+	format, path, ok := strings.Cut(value, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("want format=path, got %q", value)
+	}
+	if format != "junit" && format != "json" {
+		return fmt.Errorf("unknown report format %q, want junit or json", format)
+	}
+	*f = append(*f, reportTarget{format: format, path: path})
+	return nil
+}
+
+// testRun is a whole run of the suite, as written to the reports.
+type testRun struct {
+	RPCURL        string        `json:"rpcUrl"`
+	CompareURL    string        `json:"compareUrl,omitempty"`
+	ClientVersion string        `json:"clientVersion"`
+	StartedAt     time.Time     `json:"startedAt"`
+	Duration      time.Duration `json:"-"`
+	Results       []testResult  `json:"-"`
+}
+
+func (r *testRun) count(status testStatus) int {
+	n := 0
+	for _, result := range r.Results {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// differing returns the number of tests whose responses differ from those of
+// the compared endpoint.
+func (r *testRun) differing() int {
+	n := 0
+	for _, result := range r.Results {
+		if len(result.Diffs) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// reportBody returns v as JSON cut to reportBodyLength, or "" for nil.
+func reportBody[T any](v *T) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("error marshalling: %v", err)
+	}
+	return trimString(string(data), reportBodyLength)
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+type jsonTestResult struct {
+	Key       string   `json:"key"`
+	Status    string   `json:"status"`
+	Error     string   `json:"error,omitempty"`
+	LatencyMs float64  `json:"latencyMs"`
+	Request   string   `json:"request,omitempty"`
+	Response  string   `json:"response,omitempty"`
+	Diffs     []string `json:"differences,omitempty"`
+}
+
+type jsonReport struct {
+	*testRun
+	DurationMs float64          `json:"durationMs"`
+	Passed     int              `json:"passed"`
+	Failed     int              `json:"failed"`
+	Skipped    int              `json:"skipped"`
+	Differing  int              `json:"differing"`
+	Tests      []jsonTestResult `json:"tests"`
+}
+
+func writeJSONReport(path string, run *testRun) error {
+	report := jsonReport{
+		testRun:    run,
+		DurationMs: float64(run.Duration) / float64(time.Millisecond),
+		Passed:     run.count(statusPass),
+		Failed:     run.count(statusFail),
+		Skipped:    run.count(statusSkip),
+		Differing:  run.differing(),
+		Tests:      make([]jsonTestResult, len(run.Results)),
+	}
+	for i, result := range run.Results {
+		report.Tests[i] = jsonTestResult{
+			Key:       result.Key,
+			Status:    string(result.Status),
+			Error:     errorText(result.Err),
+			LatencyMs: float64(result.Latency) / float64(time.Millisecond),
+			Request:   reportBody(result.Req),
+			Response:  reportBody(result.Res),
+			Diffs:     result.Diffs,
+		}
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Skipped   *junitMessage `xml:"skipped"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func writeJUnitReport(path string, run *testRun) error {
+	suite := junitTestSuite{
+		Name:      "rpc-tests",
+		Tests:     len(run.Results),
+		Failures:  run.count(statusFail),
+		Skipped:   run.count(statusSkip),
+		Time:      junitSeconds(run.Duration),
+		Timestamp: run.StartedAt.UTC().Format(time.RFC3339),
+		Properties: []junitProperty{
+			{Name: "rpcUrl", Value: run.RPCURL},
+			{Name: "clientVersion", Value: run.ClientVersion},
+		},
+	}
+	if run.CompareURL != "" {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "compareUrl", Value: run.CompareURL})
+	}
+	for _, result := range run.Results {
+		testCase := junitTestCase{
+			Name:      result.Key,
+			ClassName: "rpc-tests",
+			Time:      junitSeconds(result.Latency),
+		}
+		switch result.Status {
+		case statusFail:
+			testCase.Failure = &junitMessage{Message: errorText(result.Err), Text: strings.Join(result.Diffs, "\n")}
+		case statusSkip:
+			testCase.Skipped = &junitMessage{Message: errorText(result.Err)}
+		}
+		if request := reportBody(result.Req); request != "" {
+			testCase.SystemOut = fmt.Sprintf("request: %s\nresponse: %s\n", request, reportBody(result.Res))
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0o644)
+}
+
+// writeReports writes run to every report target.
+func writeReports(targets reportFlag, run *testRun) error {
+	for _, target := range targets {
+		var err error
+		switch target.format {
+		case "junit":
+			err = writeJUnitReport(target.path, run)
+		case "json":
+			err = writeJSONReport(target.path, run)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing %s report %s: %w", target.format, target.path, err)
+		}
+	}
+	return nil
+}
+
+// clientVersion asks the node for its web3_clientVersion, for the reports.
+func clientVersion(ctx context.Context, transport rpcTransport) (string, error) {
+	responses, err := transport.Call(ctx, []Request{*NewRequest("web3_clientVersion", []interface{}{})})
+	if err != nil {
+		return "", err
+	}
+	if len(responses) == 0 {
+		return "", fmt.Errorf("no response to web3_clientVersion")
+	}
+	if responses[0].Error != nil {
+		return "", fmt.Errorf("request error; message: %s | code: %d", responses[0].Error.Message, responses[0].Error.Code)
+	}
+	version, err := parseResponse[string](responses[0].Result)
+	if err != nil {
+		return "", err
+	}
+	return *version, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reportRun is a run with a test of every outcome: a pass, a failure that
+// differs from the compared endpoint, a failure with an error, a skip and a
+// pass whose response is longer than reportBodyLength.
+func reportRun() *testRun {
+	req := NewRequest("eth_chainId", []interface{}{})
+	res := &Response{JsonRPC: "2.0", ID: req.ID, Result: json.RawMessage(`"0x89"`)}
+	long := &Response{JsonRPC: "2.0", ID: req.ID, Result: json.RawMessage(`"0x` + strings.Repeat("ab", reportBodyLength) + `"`)}
+	return &testRun{
+		RPCURL:        "http://localhost:8545",
+		CompareURL:    "http://localhost:8546",
+		ClientVersion: "bor/v2.0.0",
+		StartedAt:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:      1500 * time.Millisecond,
+		Results: []testResult{
+			{Key: "eth_chainId", Status: statusPass, Latency: 10 * time.Millisecond, Req: req, Res: res},
+			{Key: "eth_getBalance", Status: statusFail, Err: errors.New("response differs from http://localhost:8546"), Req: req, Res: res, Diffs: []string{`result: "0x1" != "0x2"`}},
+			{Key: "eth_call", Status: statusFail, Err: errors.New("request error; message: execution reverted | code: 3"), Req: req},
+			{Key: "eth_sendRawTransaction", Status: statusSkip, Err: errors.New(`skipped: upstream "eth_getTransactionCount" failed`)},
+			{Key: "eth_getBlockByNumber", Status: statusPass, Req: req, Res: long},
+		},
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	dir := t.TempDir()
+	var targets reportFlag
+	for _, value := range []string{"json=" + filepath.Join(dir, "report.json"), "junit=" + filepath.Join(dir, "report.xml")} {
+		if err := targets.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeReports(targets, reportRun()); err != nil {
+		t.Fatalf("writeReports: %v", err)
+	}
+	truncated := reportBodyLength + len("...")
+
+	data, err := os.ReadFile(filepath.Join(dir, "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		RPCURL     string           `json:"rpcUrl"`
+		CompareURL string           `json:"compareUrl"`
+		DurationMs float64          `json:"durationMs"`
+		Passed     int              `json:"passed"`
+		Failed     int              `json:"failed"`
+		Skipped    int              `json:"skipped"`
+		Differing  int              `json:"differing"`
+		Tests      []jsonTestResult `json:"tests"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("parsing the JSON report: %v", err)
+	}
+	if report.Passed != 2 || report.Failed != 2 || report.Skipped != 1 || report.Differing != 1 {
+		t.Errorf("JSON report counts %d passed, %d failed, %d skipped, %d differing, want 2, 2, 1 and 1", report.Passed, report.Failed, report.Skipped, report.Differing)
+	}
+	if report.RPCURL != "http://localhost:8545" || report.CompareURL != "http://localhost:8546" || report.DurationMs != 1500 {
+		t.Errorf("JSON report run is %s against %s in %vms", report.RPCURL, report.CompareURL, report.DurationMs)
+	}
+	if len(report.Tests) != 5 {
+		t.Fatalf("JSON report has %d tests, want 5", len(report.Tests))
+	}
+	if got := report.Tests[1].Diffs; len(got) != 1 || got[0] != `result: "0x1" != "0x2"` {
+		t.Errorf("JSON report differences = %q", got)
+	}
+	if got := report.Tests[3]; got.Status != "skip" || got.Error != `skipped: upstream "eth_getTransactionCount" failed` {
+		t.Errorf("JSON report skip = %s: %q", got.Status, got.Error)
+	}
+	if got := report.Tests[4].Response; len(got) != truncated || !strings.HasSuffix(got, "...") {
+		t.Errorf("JSON report response is %d bytes, want it cut to %d", len(got), truncated)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "report.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(data, &suites); err != nil {
+		t.Fatalf("parsing the JUnit report: %v", err)
+	}
+	if len(suites.Suites) != 1 {
+		t.Fatalf("JUnit report has %d suites, want 1", len(suites.Suites))
+	}
+	suite := suites.Suites[0]
+	if suite.Tests != 5 || suite.Failures != 2 || suite.Skipped != 1 || suite.Time != "1.500" || suite.Timestamp != "2024-01-02T03:04:05Z" {
+		t.Errorf("JUnit suite has %d tests, %d failures, %d skipped in %ss at %s", suite.Tests, suite.Failures, suite.Skipped, suite.Time, suite.Timestamp)
+	}
+	if len(suite.Cases) != 5 {
+		t.Fatalf("JUnit report has %d cases, want 5", len(suite.Cases))
+	}
+	if failure := suite.Cases[1].Failure; failure == nil || failure.Text != `result: "0x1" != "0x2"` {
+		t.Errorf("JUnit failure = %+v, want the differences", failure)
+	}
+	if failure := suite.Cases[2].Failure; failure == nil || !strings.Contains(failure.Message, "execution reverted") {
+		t.Errorf("JUnit failure = %+v, want the error", failure)
+	}
+	if skipped := suite.Cases[3].Skipped; skipped == nil || skipped.Message != `skipped: upstream "eth_getTransactionCount" failed` {
+		t.Errorf("JUnit skip = %+v", skipped)
+	}
+	if suite.Cases[0].Failure != nil || suite.Cases[0].Skipped != nil {
+		t.Errorf("JUnit pass has a failure or skip: %+v", suite.Cases[0])
+	}
+	_, response, _ := strings.Cut(suite.Cases[4].SystemOut, "response: ")
+	if response = strings.TrimSuffix(response, "\n"); len(response) != truncated || !strings.HasSuffix(response, "...") {
+		t.Errorf("JUnit response is %d bytes, want it cut to %d", len(response), truncated)
+	}
+}
+
+func TestReportFlag(t *testing.T) {
+	var f reportFlag
+	for _, value := range []string{"junit=report.xml", "json=out/report.json"} {
+		if err := f.Set(value); err != nil {
+			t.Errorf("Set(%q): %v", value, err)
+		}
+	}
+	if got := f.String(); got != "junit=report.xml,json=out/report.json" {
+		t.Errorf("String() = %q", got)
+	}
+
+	for _, value := range []string{"report.xml", "junit=", "html=report.html"} {
+		if err := f.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", value)
+		}
+	}
+	if len(f) != 2 {
+		t.Errorf("rejected values were added: %v", f)
+	}
+}
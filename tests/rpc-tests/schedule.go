@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// testPlan is the order the test cases run in. Tests in the same batch do not
+// depend on each other and are sent in a single JSON-RPC batch.
+type testPlan struct {
+	batches []BatchTestCase
+	// upstream maps a test key to the keys of the tests it directly depends on.
+	upstream map[string][]string
+}
+
+// responseMapHasField reports whether path names a ResponseMap field, with a
+// dot for a field of a nested struct (account.nonce).
+func responseMapHasField(path string) bool {
+	t := reflect.TypeOf(ResponseMap{})
+	for _, name := range strings.Split(path, ".") {
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+		field, ok := t.FieldByName(name)
+		if !ok {
+			return false
+		}
+		t = field.Type
+	}
+	return true
+}
+
+// scheduleTestCases sorts testCases into batches from the ResponseMap fields
+// they produce and consume and their DependsOn keys: a test runs in the batch
+// after the last of the tests it depends on. Within a batch tests keep the
+// order of testCases. Unknown keys, fields and tags, fields produced by more
+// than one test or by none, and dependency cycles are rejected.
+func scheduleTestCases(testCases []TestCase) (*testPlan, error) {
+	index := make(map[string]int, len(testCases))
+	for i, testCase := range testCases {
+		if _, ok := index[testCase.Key]; ok {
+			return nil, fmt.Errorf("duplicate test case key %q", testCase.Key)
+		}
+		index[testCase.Key] = i
+		for _, tag := range testCase.Tags {
+			if _, ok := testTags[tag]; !ok {
+				return nil, fmt.Errorf("test case %q has unknown tag %q", testCase.Key, tag)
+			}
+		}
+		if testCase.Subscription != nil && len(testCase.Produces) > 0 {
+			return nil, fmt.Errorf("subscription test case %q cannot produce ResponseMap fields", testCase.Key)
+		}
+	}
+
+	producers := make(map[string]string)
+	for _, testCase := range testCases {
+		for _, field := range testCase.Produces {
+			if !responseMapHasField(field) {
+				return nil, fmt.Errorf("test case %q produces unknown ResponseMap field %q", testCase.Key, field)
+			}
+			if other, ok := producers[field]; ok {
+				return nil, fmt.Errorf("ResponseMap field %q is produced by both %q and %q", field, other, testCase.Key)
+			}
+			producers[field] = testCase.Key
+		}
+	}
+
+	plan := &testPlan{upstream: make(map[string][]string, len(testCases))}
+	for _, testCase := range testCases {
+		seen := make(map[string]bool)
+		add := func(key string) {
+			if !seen[key] {
+				seen[key] = true
+				plan.upstream[testCase.Key] = append(plan.upstream[testCase.Key], key)
+			}
+		}
+		for _, field := range testCase.Consumes {
+			if !responseMapHasField(field) {
+				return nil, fmt.Errorf("test case %q consumes unknown ResponseMap field %q", testCase.Key, field)
+			}
+			producer, ok := producers[field]
+			if !ok {
+				return nil, fmt.Errorf("test case %q consumes ResponseMap field %q, which no test case produces", testCase.Key, field)
+			}
+			add(producer)
+		}
+		for _, key := range testCase.DependsOn {
+			if _, ok := index[key]; !ok {
+				return nil, fmt.Errorf("test case %q depends on unknown test case %q", testCase.Key, key)
+			}
+			add(key)
+		}
+	}
+
+	// Kahn's algorithm, one level per batch.
+	waiting := make(map[string]int, len(testCases))
+	downstream := make(map[string][]string)
+	for key, upstream := range plan.upstream {
+		waiting[key] = len(upstream)
+		for _, up := range upstream {
+			downstream[up] = append(downstream[up], key)
+		}
+	}
+	var ready []int
+	for i, testCase := range testCases {
+		if waiting[testCase.Key] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	scheduled := 0
+	for len(ready) > 0 {
+		batch := make(BatchTestCase, 0, len(ready))
+		var next []int
+		for _, i := range ready {
+			batch = append(batch, testCases[i])
+			for _, down := range downstream[testCases[i].Key] {
+				if waiting[down]--; waiting[down] == 0 {
+					next = append(next, index[down])
+				}
+			}
+		}
+		plan.batches = append(plan.batches, batch)
+		scheduled += len(batch)
+		sort.Ints(next)
+		ready = next
+	}
+
+	if scheduled < len(testCases) {
+		return nil, fmt.Errorf("dependency cycle: %s", findCycle(testCases, plan.upstream, waiting))
+	}
+	return plan, nil
+}
+
+// findCycle returns a cycle among the tests Kahn's algorithm could not
+// schedule, as "a -> b -> a".
+func findCycle(testCases []TestCase, upstream map[string][]string, waiting map[string]int) string {
+	var start string
+	for _, testCase := range testCases {
+		if waiting[testCase.Key] > 0 {
+			start = testCase.Key
+			break
+		}
+	}
+
+	// Every unscheduled test has an unscheduled upstream, so walking upstream
+	// must come back to a test already on the path.
+	position := make(map[string]int)
+	var path []string
+	for key := start; ; {
+		if i, ok := position[key]; ok {
+			cycle := append(path[i:], key)
+			for l, r := 0, len(cycle)-1; l < r; l, r = l+1, r-1 {
+				cycle[l], cycle[r] = cycle[r], cycle[l]
+			}
+			return strings.Join(cycle, " -> ")
+		}
+		position[key] = len(path)
+		path = append(path, key)
+		for _, up := range upstream[key] {
+			if waiting[up] > 0 {
+				key = up
+				break
+			}
+		}
+	}
+}
+
+// failedUpstream returns the failed test a test depends on, directly or
+// through skipped tests, given failed maps each test that did not pass to the
+// failed test it traces back to.
+func (p *testPlan) failedUpstream(key string, failed map[string]string) (string, bool) {
+	for _, up := range p.upstream[key] {
+		if root, ok := failed[up]; ok {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+// withoutTestCases returns testCases without the tests of keys, which must
+// all exist.
+func withoutTestCases(testCases []TestCase, keys []string) ([]TestCase, error) {
+	exclude := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		exclude[key] = true
+	}
+	selected := make([]TestCase, 0, len(testCases))
+	for _, testCase := range testCases {
+		if exclude[testCase.Key] {
+			delete(exclude, testCase.Key)
+			continue
+		}
+		selected = append(selected, testCase)
+	}
+	for _, key := range keys {
+		if exclude[key] {
+			return nil, fmt.Errorf("unknown test case %q", key)
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testCase(key string, produces, consumes, dependsOn []string) TestCase {
+	return TestCase{Key: key, Produces: produces, Consumes: consumes, DependsOn: dependsOn}
+}
+
+// batchKeys returns the keys of every batch of plan, in order.
+func batchKeys(plan *testPlan) [][]string {
+	keys := make([][]string, len(plan.batches))
+	for i, batch := range plan.batches {
+		for _, testCase := range batch {
+			keys[i] = append(keys[i], testCase.Key)
+		}
+	}
+	return keys
+}
+
+func TestScheduleTestCases(t *testing.T) {
+	tests := []struct {
+		name      string
+		testCases []TestCase
+		batches   [][]string
+		err       string
+	}{
+		{
+			name: "independent tests share a batch",
+			testCases: []TestCase{
+				testCase("a", nil, nil, nil),
+				testCase("b", nil, nil, nil),
+			},
+			batches: [][]string{{"a", "b"}},
+		},
+		{
+			name: "levels follow produced fields and DependsOn",
+			testCases: []TestCase{
+				testCase("tx", []string{"pushedTxHash"}, []string{"chainId"}, nil),
+				testCase("chain", []string{"chainId"}, nil, nil),
+				testCase("receipt", []string{"pushedTxBlockNumber"}, []string{"pushedTxHash"}, nil),
+				testCase("block", nil, []string{"pushedTxBlockNumber"}, []string{"chain"}),
+				testCase("version", nil, nil, nil),
+				testCase("filter", nil, nil, []string{"tx"}),
+			},
+			batches: [][]string{{"chain", "version"}, {"tx"}, {"receipt", "filter"}, {"block"}},
+		},
+		{
+			name: "nested fields",
+			testCases: []TestCase{
+				testCase("nonce", []string{"account.nonce"}, nil, nil),
+				testCase("send", nil, []string{"account.nonce"}, nil),
+			},
+			batches: [][]string{{"nonce"}, {"send"}},
+		},
+		{
+			name:      "duplicate key",
+			testCases: []TestCase{testCase("a", nil, nil, nil), testCase("a", nil, nil, nil)},
+			err:       `duplicate test case key "a"`,
+		},
+		{
+			name:      "unknown tag",
+			testCases: []TestCase{{Key: "a", Tags: []string{"nope"}}},
+			err:       `test case "a" has unknown tag "nope"`,
+		},
+		{
+			name:      "unknown DependsOn key",
+			testCases: []TestCase{testCase("a", nil, nil, []string{"missing"})},
+			err:       `test case "a" depends on unknown test case "missing"`,
+		},
+		{
+			name:      "unknown produced field",
+			testCases: []TestCase{testCase("a", []string{"noSuchField"}, nil, nil)},
+			err:       `test case "a" produces unknown ResponseMap field "noSuchField"`,
+		},
+		{
+			name:      "unknown nested field",
+			testCases: []TestCase{testCase("a", []string{"chainId.value"}, nil, nil)},
+			err:       `test case "a" produces unknown ResponseMap field "chainId.value"`,
+		},
+		{
+			name:      "unknown consumed field",
+			testCases: []TestCase{testCase("a", nil, []string{"noSuchField"}, nil)},
+			err:       `test case "a" consumes unknown ResponseMap field "noSuchField"`,
+		},
+		{
+			name: "field produced twice",
+			testCases: []TestCase{
+				testCase("a", []string{"chainId"}, nil, nil),
+				testCase("b", []string{"chainId"}, nil, nil),
+			},
+			err: `ResponseMap field "chainId" is produced by both "a" and "b"`,
+		},
+		{
+			name:      "field produced by none",
+			testCases: []TestCase{testCase("a", nil, []string{"chainId"}, nil)},
+			err:       `test case "a" consumes ResponseMap field "chainId", which no test case produces`,
+		},
+		{
+			name:      "subscription producing a field",
+			testCases: []TestCase{{Key: "a", Produces: []string{"chainId"}, Subscription: &SubscriptionTest{}}},
+			err:       `subscription test case "a" cannot produce ResponseMap fields`,
+		},
+		{
+			name: "cycle",
+			testCases: []TestCase{
+				testCase("root", nil, nil, nil),
+				testCase("a", []string{"chainId"}, nil, []string{"root", "b"}),
+				testCase("b", nil, []string{"chainId"}, nil),
+			},
+			err: "dependency cycle: a -> b -> a",
+		},
+		{
+			name: "cycle behind an unscheduled test",
+			testCases: []TestCase{
+				testCase("after", nil, nil, []string{"x"}),
+				testCase("x", nil, nil, []string{"y"}),
+				testCase("y", nil, nil, []string{"z"}),
+				testCase("z", nil, nil, []string{"x"}),
+			},
+			err: "dependency cycle: x -> z -> y -> x",
+		},
+		{
+			name:      "self dependency",
+			testCases: []TestCase{testCase("a", nil, nil, []string{"a"})},
+			err:       "dependency cycle: a -> a",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan, err := scheduleTestCases(test.testCases)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("scheduleTestCases: %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scheduleTestCases: %v", err)
+			}
+			if got := batchKeys(plan); !reflect.DeepEqual(got, test.batches) {
+				t.Fatalf("batches = %v, want %v", got, test.batches)
+			}
+		})
+	}
+}
+
+func TestFailedUpstream(t *testing.T) {
+	plan, err := scheduleTestCases([]TestCase{
+		testCase("a", nil, nil, nil),
+		testCase("b", nil, nil, []string{"a"}),
+		testCase("c", nil, nil, []string{"b"}),
+		testCase("d", nil, nil, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed, so b is skipped and c traces back to a through b.
+	failed := map[string]string{"a": "a"}
+	root, ok := plan.failedUpstream("b", failed)
+	if !ok || root != "a" {
+		t.Fatalf("failedUpstream(b) = %q, %v, want a", root, ok)
+	}
+	failed["b"] = root
+	if root, ok := plan.failedUpstream("c", failed); !ok || root != "a" {
+		t.Fatalf("failedUpstream(c) = %q, %v, want a", root, ok)
+	}
+	if root, ok := plan.failedUpstream("d", failed); ok {
+		t.Fatalf("failedUpstream(d) = %q, want none", root)
+	}
+}
+
+func TestWithoutTestCases(t *testing.T) {
+	testCases := []TestCase{testCase("a", nil, nil, nil), testCase("b", nil, nil, nil), testCase("c", nil, nil, nil)}
+
+	selected, err := withoutTestCases(testCases, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, testCase := range selected {
+		keys = append(keys, testCase.Key)
+	}
+	if strings.Join(keys, ",") != "a,c" {
+		t.Fatalf("withoutTestCases = %v, want a,c", keys)
+	}
+
+	if _, err := withoutTestCases(testCases, []string{"missing"}); err == nil || err.Error() != `unknown test case "missing"` {
+		t.Fatalf("withoutTestCases of an unknown key: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// testTags are the tags a TestCase can carry.
+var testTags = map[string]string{
+	"bor":           "calls a bor_* method",
+	"eth":           "calls an eth_* method",
+	"state-sync":    "checks the state-sync txs bor adds to blocks",
+	"write":         "sends a transaction, which needs a funded account",
+	"filters":       "creates or polls a filter, which lives on a single node",
+	"archive":       "reads far behind the head, which pruned or range-limited nodes may refuse",
+	"subscriptions": "opens an eth_subscribe subscription, which needs a ws:// or IPC endpoint",
+}
+
+// testProfiles map a -profile name to the tags it excludes.
+var testProfiles = map[string][]string{
+	"full":      nil,
+	"read-only": {"write"},
+}
+
+// readOnlyForbiddenMethods are never sent with the read-only profile, whatever
+// the tags say.
+var readOnlyForbiddenMethods = map[string]bool{
+	"eth_sendRawTransaction": true,
+	"eth_sendTransaction":    true,
+}
+
+// testSelector matches test cases by tag or by a regular expression on their
+// key. An item of the comma-separated list it is parsed from is a tag when it
+// is one of testTags, and a regular expression otherwise.
+type testSelector struct {
+	tags     map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func parseTestSelector(value string) (*testSelector, error) {
+	selector := &testSelector{tags: make(map[string]bool)}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if _, ok := testTags[item]; ok {
+			selector.tags[item] = true
+			continue
+		}
+		pattern, err := regexp.Compile(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither a tag nor a valid regexp: %w", item, err)
+		}
+		selector.patterns = append(selector.patterns, pattern)
+	}
+	return selector, nil
+}
+
+func (s *testSelector) empty() bool {
+	return len(s.tags) == 0 && len(s.patterns) == 0
+}
+
+func (s *testSelector) matches(testCase TestCase) bool {
+	for tag := range s.tags {
+		if testCase.hasTag(tag) {
+			return true
+		}
+	}
+	for _, pattern := range s.patterns {
+		if pattern.MatchString(testCase.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t TestCase) hasTag(tag string) bool {
+	for _, own := range t.Tags {
+		if own == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// testSelection is the part of a plan that runs. Excluded tests are left out
+// and the tests depending on them are skipped.
+type testSelection struct {
+	run      map[string]bool
+	excluded map[string]bool
+}
+
+// selectTestCases picks the tests matching include (all with an empty one)
+// and the tests they depend on, then leaves out those matching exclude.
+func (p *testPlan) selectTestCases(include, exclude *testSelector) *testSelection {
+	selection := &testSelection{run: make(map[string]bool), excluded: make(map[string]bool)}
+	var wanted []string
+	for _, batch := range p.batches {
+		for _, testCase := range batch {
+			if include.empty() || include.matches(testCase) {
+				wanted = append(wanted, testCase.Key)
+			}
+		}
+	}
+	for len(wanted) > 0 {
+		key := wanted[len(wanted)-1]
+		wanted = wanted[:len(wanted)-1]
+		if selection.run[key] {
+			continue
+		}
+		selection.run[key] = true
+		wanted = append(wanted, p.upstream[key]...)
+	}
+
+	for _, batch := range p.batches {
+		for _, testCase := range batch {
+			if selection.run[testCase.Key] && exclude.matches(testCase) {
+				delete(selection.run, testCase.Key)
+				selection.excluded[testCase.Key] = true
+			}
+		}
+	}
+	return selection
+}
+
+// printTestPlan lists the batches of the selected tests, with their tags and
+// why they would be skipped.
+func printTestPlan(plan *testPlan, selection *testSelection) {
+	excludedUpstream := make(map[string]string)
+	for key := range selection.excluded {
+		excludedUpstream[key] = key
+	}
+	count := 0
+	for i, batch := range plan.batches {
+		var lines []string
+		for _, testCase := range batch {
+			if !selection.run[testCase.Key] {
+				continue
+			}
+			line := fmt.Sprintf("  %s [%s]", testCase.Key, strings.Join(testCase.Tags, ", "))
+			if upstream, ok := plan.failedUpstream(testCase.Key, excludedUpstream); ok {
+				excludedUpstream[testCase.Key] = upstream
+				line += fmt.Sprintf(" (skipped: upstream %q excluded)", upstream)
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Printf("Batch %d:\n%s\n", i+1, strings.Join(lines, "\n"))
+		count += len(lines)
+	}
+
+	excluded := make([]string, 0, len(selection.excluded))
+	for key := range selection.excluded {
+		excluded = append(excluded, key)
+	}
+	sort.Strings(excluded)
+	if len(excluded) > 0 {
+		fmt.Printf("Excluded:\n  %s\n", strings.Join(excluded, "\n  "))
+	}
+	fmt.Printf("%d tests selected, %d excluded\n", count, len(excluded))
+}
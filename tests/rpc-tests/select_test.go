@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// selectionPlan is a write test between an eth test it consumes from and the
+// tests depending on it, next to an unrelated bor test.
+func selectionPlan(t *testing.T) *testPlan {
+	t.Helper()
+	plan, err := scheduleTestCases([]TestCase{
+		{Key: "chain", Tags: []string{"eth"}, Produces: []string{"chainId"}},
+		{Key: "tx", Tags: []string{"eth", "write"}, Produces: []string{"pushedTxHash"}, Consumes: []string{"chainId"}},
+		{Key: "receipt", Tags: []string{"eth"}, Consumes: []string{"pushedTxHash"}},
+		{Key: "logs", Tags: []string{"eth", "state-sync"}, DependsOn: []string{"receipt"}},
+		{Key: "snapshot", Tags: []string{"bor"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sameKeys(a, b []string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+func TestSelectTestCases(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  string
+		exclude  string
+		run      []string
+		excluded []string
+	}{
+		{
+			name: "everything by default",
+			run:  []string{"chain", "logs", "receipt", "snapshot", "tx"},
+		},
+		{
+			name:    "include by tag",
+			include: "bor",
+			run:     []string{"snapshot"},
+		},
+		{
+			name:    "include pulls in what a test depends on",
+			include: "^receipt$",
+			run:     []string{"chain", "receipt", "tx"},
+		},
+		{
+			name:    "include the whole chain through DependsOn",
+			include: "logs",
+			run:     []string{"chain", "logs", "receipt", "tx"},
+		},
+		{
+			name:    "include by tag and regexp",
+			include: "state-sync,snap",
+			run:     []string{"chain", "logs", "receipt", "snapshot", "tx"},
+		},
+		{
+			name:     "exclude by tag keeps the dependents, to be skipped",
+			exclude:  "write",
+			run:      []string{"chain", "logs", "receipt", "snapshot"},
+			excluded: []string{"tx"},
+		},
+		{
+			name:     "exclude wins over a dependency of an included test",
+			include:  "^logs$",
+			exclude:  "^chain$",
+			run:      []string{"logs", "receipt", "tx"},
+			excluded: []string{"chain"},
+		},
+		{
+			name:    "exclude only applies to selected tests",
+			include: "bor",
+			exclude: "write",
+			run:     []string{"snapshot"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			include, err := parseTestSelector(test.include)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exclude, err := parseTestSelector(test.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selection := selectionPlan(t).selectTestCases(include, exclude)
+			if got := sortedKeys(selection.run); !sameKeys(got, test.run) {
+				t.Errorf("run = %v, want %v", got, test.run)
+			}
+			if got := sortedKeys(selection.excluded); !sameKeys(got, test.excluded) {
+				t.Errorf("excluded = %v, want %v", got, test.excluded)
+			}
+		})
+	}
+}
+
+func TestParseTestSelector(t *testing.T) {
+	selector, err := parseTestSelector(" write, eth_get.*Logs ,,bor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sortedKeys(selector.tags); !reflect.DeepEqual(got, []string{"bor", "write"}) {
+		t.Errorf("tags = %v, want bor and write", got)
+	}
+	if len(selector.patterns) != 1 || selector.patterns[0].String() != "eth_get.*Logs" {
+		t.Errorf("patterns = %v, want eth_get.*Logs", selector.patterns)
+	}
+
+	if selector, err := parseTestSelector(""); err != nil || !selector.empty() {
+		t.Errorf("empty selector = %+v, %v", selector, err)
+	}
+	if _, err := parseTestSelector("eth_call("); err == nil {
+		t.Error("an invalid regexp was accepted")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// errNoSubscriptions is returned by transports that cannot push notifications.
+var errNoSubscriptions = errors.New("subscriptions need a ws:// or IPC endpoint")
+
+// rpcTransport sends JSON-RPC batches to a node and opens subscriptions on it.
+type rpcTransport interface {
+	Call(ctx context.Context, requests []Request) ([]Response, error)
+	Subscribe(ctx context.Context, params []interface{}) (*subscription, error)
+	Close()
+}
+
+// dialTransport picks the transport from the scheme of rawURL: plain HTTP
+// POSTs for http(s)://, and a go-ethereum RPC client for ws(s):// and IPC
+// socket paths.
+func dialTransport(ctx context.Context, rawURL string) (rpcTransport, error) {
+	if isHTTPURL(rawURL) {
+		return httpTransport{url: rawURL}, nil
+	}
+	client, err := rpc.DialContext(ctx, rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s: %w", rawURL, err)
+	}
+	return &clientTransport{client: client}, nil
+}
+
+func isHTTPURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// supportsSubscriptions reports whether the transport for rawURL can push
+// notifications.
+func supportsSubscriptions(rawURL string) bool {
+	return rawURL != "" && !isHTTPURL(rawURL)
+}
+
+// httpTransport posts every batch in its own HTTP request.
+type httpTransport struct {
+	url string
+}
+
+func (t httpTransport) Call(_ context.Context, requests []Request) ([]Response, error) {
+	return CallEthereumRPC(requests, t.url)
+}
+
+func (t httpTransport) Subscribe(context.Context, []interface{}) (*subscription, error) {
+	return nil, errNoSubscriptions
+}
+
+func (t httpTransport) Close() {}
+
+// clientTransport sends batches over a persistent WebSocket or IPC connection.
+// The client numbers requests itself, so responses are matched back to the
+// requests by position.
+type clientTransport struct {
+	client *rpc.Client
+}
+
+func (t *clientTransport) Call(ctx context.Context, requests []Request) ([]Response, error) {
+	batch := make([]rpc.BatchElem, len(requests))
+	results := make([]json.RawMessage, len(requests))
+	for i, req := range requests {
+		args, err := requestArgs(req.Params)
+		if err != nil {
+			return nil, err
+		}
+		batch[i] = rpc.BatchElem{Method: req.Method, Args: args, Result: &results[i]}
+	}
+	if err := t.client.BatchCallContext(ctx, batch); err != nil {
+		return nil, fmt.Errorf("error making RPC call: %w", err)
+	}
+
+	responses := make([]Response, len(requests))
+	for i, elem := range batch {
+		responses[i] = Response{JsonRPC: "2.0", ID: requests[i].ID, Result: results[i]}
+		if elem.Error == nil {
+			continue
+		}
+		rpcErr := &RPCError{Message: elem.Error.Error()}
+		var coded rpc.Error
+		if errors.As(elem.Error, &coded) {
+			rpcErr.Code = coded.ErrorCode()
+		}
+		responses[i].Result = nil
+		responses[i].Error = rpcErr
+	}
+	return responses, nil
+}
+
+func (t *clientTransport) Subscribe(ctx context.Context, params []interface{}) (*subscription, error) {
+	s := &subscription{notifications: make(chan json.RawMessage), done: make(chan struct{})}
+	sub, err := t.client.Subscribe(ctx, "eth", s.notifications, params...)
+	if err != nil {
+		return nil, err
+	}
+	s.sub = sub
+	go s.collect()
+	return s, nil
+}
+
+func (t *clientTransport) Close() {
+	t.client.Close()
+}
+
+// requestArgs spreads the params of a Request into positional arguments.
+func requestArgs(params interface{}) ([]interface{}, error) {
+	switch params := params.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		return params, nil
+	default:
+		return nil, fmt.Errorf("params must be a list, got %T", params)
+	}
+}
+
+// subscription collects the notifications of an eth_subscribe subscription
+// until it is stopped.
+type subscription struct {
+	sub           *rpc.ClientSubscription
+	notifications chan json.RawMessage
+	done          chan struct{}
+
+	mu       sync.Mutex
+	received []json.RawMessage
+	err      error
+}
+
+func (s *subscription) collect() {
+	defer close(s.done)
+	for {
+		select {
+		case notification := <-s.notifications:
+			s.mu.Lock()
+			s.received = append(s.received, notification)
+			s.mu.Unlock()
+		case err := <-s.sub.Err():
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// wait polls the notifications received until there are at least min of
+// them and check accepts them, or until timeout is over, then stops the
+// subscription and returns them with check's verdict. A busy node notifies
+// about everyone else's txs and logs too, so the first notifications rarely
+// hold the ones a test waits for.
+func (s *subscription) wait(min int, timeout time.Duration, check func([]json.RawMessage) error) ([]json.RawMessage, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		received, err := append([]json.RawMessage(nil), s.received...), s.err
+		s.mu.Unlock()
+		if err != nil || time.Now().After(deadline) {
+			break
+		}
+		if len(received) >= min && check(received) == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.sub.Unsubscribe()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.received, fmt.Errorf("subscription failed: %w", s.err)
+	}
+	if len(s.received) < min {
+		return s.received, fmt.Errorf("expected at least %d notifications within %s, received %d", min, timeout, len(s.received))
+	}
+	return s.received, check(s.received)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// pendingService notifies the tx hashes it is given on eth_subscribe
+// ("newPendingTransactions"), one every few milliseconds, like a node that
+// sees the txs of other senders before the one a test pushed.
+type pendingService struct {
+	hashes []string
+}
+
+func (p *pendingService) NewPendingTransactions(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, ok := rpc.NotifierFromContext(ctx)
+	if !ok {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	go func() {
+		for _, hash := range p.hashes {
+			time.Sleep(5 * time.Millisecond)
+			if err := notifier.Notify(sub.ID, hash); err != nil {
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+func TestSubscriptionWaitPollsUntilCheckPasses(t *testing.T) {
+	hashes := make([]string, 5)
+	for i := range hashes {
+		hashes[i] = fmt.Sprintf("0x%064x", i)
+	}
+	server := rpc.NewServer("", 0, 0)
+	if err := server.RegisterName("eth", &pendingService{hashes: hashes}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// The pushed tx is the last one notified.
+	pushed := fmt.Sprintf("%q", hashes[len(hashes)-1])
+	check := func(notifications []json.RawMessage) error {
+		for _, notification := range notifications {
+			if string(notification) == pushed {
+				return nil
+			}
+		}
+		return fmt.Errorf("pushed tx not among %d pending txs", len(notifications))
+	}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		check   func([]json.RawMessage) error
+		count   int
+		err     string
+	}{
+		{name: "the check passes on a later notification", timeout: 10 * time.Second, check: check, count: len(hashes)},
+		{name: "the check never passes", timeout: 200 * time.Millisecond, check: func([]json.RawMessage) error { return fmt.Errorf("never") }, count: len(hashes), err: "never"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &clientTransport{client: rpc.DialInProc(server)}
+			defer transport.Close()
+
+			sub, err := transport.Subscribe(context.Background(), []interface{}{"newPendingTransactions"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			notifications, err := sub.wait(1, test.timeout, test.check)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("wait: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Fatalf("wait: %v, want %q", err, test.err)
+			}
+			if len(notifications) != test.count {
+				t.Fatalf("wait returned %d notifications, want %d", len(notifications), test.count)
+			}
+		})
+	}
+}
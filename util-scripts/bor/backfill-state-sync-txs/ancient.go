@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Freezer tables bor moves finished blocks into, keyed by block number.
+const (
+	freezerHeaderTable     = "headers"
+	freezerHashTable       = "hashes"
+	freezerBodiesTable     = "bodies"
+	freezerReceiptTable    = "receipts"
+	freezerBorReceiptTable = "matic-bor-receipts"
+)
+
+// freezerIndexEntrySize is the size of one index entry: a 2 byte data file
+// number followed by a 4 byte end offset in that file.
+const freezerIndexEntrySize = 6
+
+// freezer is a read-only view of bor's ancient store. It understands just
+// enough of the freezer table layout to serve single items.
+type freezer struct {
+	tables map[string]*freezerTable
+}
+
+// openFreezer opens the chain freezer under ancientDir. It returns nil
+// without an error when the node has no freezer.
+func openFreezer(ancientDir string) (*freezer, error) {
+	// Newer nodes keep the chain freezer in ancient/chain, older ones use
+	// ancient itself.
+	dir := filepath.Join(ancientDir, "chain")
+	if _, err := os.Stat(dir); err != nil {
+		dir = ancientDir
+	}
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	f := &freezer{tables: make(map[string]*freezerTable)}
+	for _, name := range []string{freezerHeaderTable, freezerHashTable, freezerBodiesTable, freezerReceiptTable, freezerBorReceiptTable} {
+		table, err := openFreezerTable(dir, name)
+		if err != nil {
+			f.close()
+			return nil, err
+		}
+		if table != nil {
+			f.tables[name] = table
+		}
+	}
+	if len(f.tables) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// get resolves a chaindata key of a frozen block to its freezer item. Items
+// stored per hash are only returned if the hash is the frozen canonical one.
+func (f *freezer) get(key []byte) ([]byte, error) {
+	var table string
+	switch {
+	case len(key) == 1+8+1 && key[0] == 'h' && key[9] == 'n':
+		return f.retrieve(freezerHashTable, binary.BigEndian.Uint64(key[1:9]))
+	case len(key) == 1+8+32 && key[0] == 'h':
+		table = freezerHeaderTable
+	case len(key) == 1+8+32 && key[0] == 'b':
+		table = freezerBodiesTable
+	case len(key) == 1+8+32 && key[0] == 'r':
+		table = freezerReceiptTable
+	default:
+		number, hash, ok := decodeBorReceiptKey(key)
+		if !ok {
+			return nil, errNotFound
+		}
+		return f.retrieveCanonical(freezerBorReceiptTable, number, hash.Bytes())
+	}
+	return f.retrieveCanonical(table, binary.BigEndian.Uint64(key[1:9]), key[9:])
+}
+
+func (f *freezer) retrieveCanonical(table string, number uint64, hash []byte) ([]byte, error) {
+	canonical, err := f.retrieve(freezerHashTable, number)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(canonical, hash) {
+		return nil, errNotFound
+	}
+	return f.retrieve(table, number)
+}
+
+func (f *freezer) retrieve(table string, number uint64) ([]byte, error) {
+	t, ok := f.tables[table]
+	if !ok {
+		return nil, errNotFound
+	}
+	return t.retrieve(number)
+}
+
+func (f *freezer) close() {
+	for _, t := range f.tables {
+		t.close()
+	}
+}
+
+// freezerTable reads items from one table: an index file of 6 byte entries
+// and numbered data files, snappy-compressed unless the index is raw.
+type freezerTable struct {
+	dir        string
+	name       string
+	compressed bool
+	index      *os.File
+
+	// tail is the number of items deleted from the front of the table and
+	// items the total including those, both fixed when the table is opened.
+	tail  uint64
+	items uint64
+
+	mu    sync.Mutex
+	files map[uint32]*os.File
+}
+
+func openFreezerTable(dir, name string) (*freezerTable, error) {
+	t := &freezerTable{dir: dir, name: name, files: make(map[uint32]*os.File)}
+
+	index, err := os.Open(filepath.Join(dir, name+".cidx"))
+	if errors.Is(err, os.ErrNotExist) {
+		index, err = os.Open(filepath.Join(dir, name+".ridx"))
+	} else {
+		t.compressed = true
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open freezer table %s: %w", name, err)
+	}
+	t.index = index
+
+	info, err := index.Stat()
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	entries := uint64(info.Size() / freezerIndexEntrySize)
+	if entries == 0 {
+		return t, nil
+	}
+
+	// The first entry does not point at data, its offset holds the tail.
+	first, err := t.indexEntry(0)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	t.tail = uint64(first.offset)
+	t.items = t.tail + entries - 1
+	return t, nil
+}
+
+type freezerIndexEntry struct {
+	filenum uint32
+	offset  uint32
+}
+
+func (t *freezerTable) indexEntry(i uint64) (freezerIndexEntry, error) {
+	buf := make([]byte, freezerIndexEntrySize)
+	if _, err := t.index.ReadAt(buf, int64(i*freezerIndexEntrySize)); err != nil {
+		return freezerIndexEntry{}, fmt.Errorf("failed to read index of freezer table %s: %w", t.name, err)
+	}
+	return freezerIndexEntry{
+		filenum: uint32(binary.BigEndian.Uint16(buf[:2])),
+		offset:  binary.BigEndian.Uint32(buf[2:]),
+	}, nil
+}
+
+func (t *freezerTable) retrieve(number uint64) ([]byte, error) {
+	if number < t.tail || number >= t.items {
+		return nil, errNotFound
+	}
+	rel := number - t.tail
+
+	start, err := t.indexEntry(rel)
+	if err != nil {
+		return nil, err
+	}
+	end, err := t.indexEntry(rel + 1)
+	if err != nil {
+		return nil, err
+	}
+	// An item never spans data files: if the entries differ the item starts
+	// at the beginning of the later file. The first item always starts at 0.
+	if rel == 0 || start.filenum != end.filenum {
+		start = freezerIndexEntry{filenum: end.filenum}
+	}
+
+	file, err := t.dataFile(end.filenum)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, end.offset-start.offset)
+	if _, err := file.ReadAt(data, int64(start.offset)); err != nil {
+		return nil, fmt.Errorf("failed to read item %d of freezer table %s: %w", number, t.name, err)
+	}
+	if !t.compressed {
+		return data, nil
+	}
+	return snappy.Decode(nil, data)
+}
+
+func (t *freezerTable) dataFile(num uint32) (*os.File, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f, ok := t.files[num]; ok {
+		return f, nil
+	}
+	ext := "rdat"
+	if t.compressed {
+		ext = "cdat"
+	}
+	f, err := os.Open(filepath.Join(t.dir, fmt.Sprintf("%s.%04d.%s", t.name, num, ext)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data file %d of freezer table %s: %w", num, t.name, err)
+	}
+	t.files[num] = f
+	return f, nil
+}
+
+func (t *freezerTable) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, f := range t.files {
+		f.Close()
+	}
+	t.index.Close()
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// archiveFormat identifies the header of a bor receipt archive.
+const archiveFormat = "bor-receipt-archive"
+
+// An archive is a gzip stream of:
+//
+//	header      one line of JSON (archiveHeader)
+//	records     uvarint key length, key, uvarint value length, value
+//	end         uvarint 0
+//	trailer     uvarint record count, sha256 of everything before "end"
+//
+// Keys are always non-empty, so a zero length can only mark the end. The
+// checksum covers the header, so a file cut short or edited by hand is refused
+// as a whole before any key is imported.
+type archiveHeader struct {
+	Format      string      `json:"format"`
+	Version     int         `json:"version"`
+	ChainID     uint64      `json:"chainId"`
+	GenesisHash common.Hash `json:"genesisHash"`
+	StartBlock  uint64      `json:"startBlock"`
+	EndBlock    uint64      `json:"endBlock"`
+}
+
+// exportResult is the outcome of an export-bor-receipts run.
+type exportResult struct {
+	File       string `json:"file"`
+	StartBlock uint64 `json:"startBlock"`
+	EndBlock   uint64 `json:"endBlock"`
+	Receipts   int    `json:"receipts"`
+	Lookups    int    `json:"lookups"`
+	// MissingLookups counts receipts exported without their lookup entry,
+	// which the source node did not have either.
+	MissingLookups int    `json:"missingLookups"`
+	Checksum       string `json:"checksum"`
+}
+
+// importResult is the outcome of an import-bor-receipts run.
+type importResult struct {
+	File    string `json:"file"`
+	Entries int    `json:"entries"`
+	writeResult
+}
+
+// archiveWriter writes the records of an archive and keeps its checksum.
+type archiveWriter struct {
+	gz    *gzip.Writer
+	w     io.Writer
+	sum   hash.Hash
+	count uint64
+	buf   [binary.MaxVarintLen64]byte
+}
+
+func newArchiveWriter(w io.Writer, header archiveHeader) (*archiveWriter, error) {
+	gz := gzip.NewWriter(w)
+	a := &archiveWriter{gz: gz, sum: sha256.New()}
+	a.w = io.MultiWriter(gz, a.sum)
+
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *archiveWriter) writeBytes(w io.Writer, b []byte) error {
+	n := binary.PutUvarint(a.buf[:], uint64(len(b)))
+	if _, err := w.Write(a.buf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func (a *archiveWriter) Add(key, value []byte) error {
+	if err := a.writeBytes(a.w, key); err != nil {
+		return err
+	}
+	if err := a.writeBytes(a.w, value); err != nil {
+		return err
+	}
+	a.count++
+	return nil
+}
+
+// Close writes the end marker and trailer and returns the checksum.
+func (a *archiveWriter) Close() (common.Hash, error) {
+	checksum := common.BytesToHash(a.sum.Sum(nil))
+
+	trailer := []byte{0}
+	trailer = binary.AppendUvarint(trailer, a.count)
+	trailer = append(trailer, checksum.Bytes()...)
+	if _, err := a.gz.Write(trailer); err != nil {
+		return common.Hash{}, err
+	}
+	return checksum, a.gz.Close()
+}
+
+// ExportBorReceipts dumps the matic-bor-receipt- and matic-bor-tx-lookup-
+// entries of the canonical blocks [startBlock, endBlock] of the chaindata to
+// an archive that import-bor-receipts can load into another node offline.
+// Frozen blocks are read from the freezer like any other.
+func ExportBorReceipts(dataPath, outputFile string, startBlock, endBlock uint64, force bool) (*exportResult, error) {
+	if startBlock > endBlock {
+		return nil, fmt.Errorf("start block %d is after end block %d", startBlock, endBlock)
+	}
+
+	db, err := openChaindata(dataPath, openOptions{readOnly: true, force: force})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	chain, err := readChainIdentity(db)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Get(canonicalHashKey(endBlock)); err != nil {
+		return nil, fmt.Errorf("end block %d is not in the chaindata: %w", endBlock, err)
+	}
+
+	// Written under a temporary name so that an interrupted export never
+	// leaves something that looks like an archive behind.
+	tmp := outputFile + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive %s: %w", tmp, err)
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	bw := bufio.NewWriter(file)
+	archive, err := newArchiveWriter(bw, archiveHeader{
+		Format:      archiveFormat,
+		Version:     1,
+		ChainID:     chain.ChainID,
+		GenesisHash: chain.Genesis,
+		StartBlock:  startBlock,
+		EndBlock:    endBlock,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &exportResult{File: outputFile, StartBlock: startBlock, EndBlock: endBlock}
+	bar := out.Progress("Exporting", "blocks", endBlock-startBlock+1, 0)
+	defer bar.Done()
+	blocksTotal.Update(int64(endBlock - startBlock + 1))
+	for number := startBlock; ; number++ {
+		canonical, err := db.Get(canonicalHashKey(number))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read canonical hash of block %d: %w", number, err)
+		}
+		blockHash := common.BytesToHash(canonical)
+
+		key := borReceiptKey(number, blockHash)
+		receipt, err := db.Get(key)
+		switch {
+		case err == errNotFound:
+		case err != nil:
+			return nil, fmt.Errorf("failed to read bor receipt of block %d: %w", number, err)
+		default:
+			if err := archive.Add(key, receipt); err != nil {
+				return nil, fmt.Errorf("failed to write archive %s: %w", tmp, err)
+			}
+			result.Receipts++
+
+			lookupKey := borTxLookupKey(derivedBorTxHash(number, blockHash))
+			lookup, err := db.Get(lookupKey)
+			switch {
+			case err == errNotFound:
+				result.MissingLookups++
+				out.Warnf("Block %d has a bor receipt but no bor tx lookup entry", number)
+			case err != nil:
+				return nil, fmt.Errorf("failed to read bor tx lookup of block %d: %w", number, err)
+			default:
+				if err := archive.Add(lookupKey, lookup); err != nil {
+					return nil, fmt.Errorf("failed to write archive %s: %w", tmp, err)
+				}
+				result.Lookups++
+			}
+		}
+
+		bar.Set(number - startBlock + 1)
+		blocksDone.Update(int64(number - startBlock + 1))
+		if number == endBlock {
+			break
+		}
+	}
+	bar.Done()
+
+	checksum, err := archive.Close()
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write archive %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, outputFile); err != nil {
+		return nil, fmt.Errorf("failed to move archive to %s: %w", outputFile, err)
+	}
+	result.Checksum = checksum.Hex()
+
+	out.Printf("Exported %d bor receipts and %d lookup entries of blocks %d-%d to %s (sha256 %s)\n",
+		result.Receipts, result.Lookups, startBlock, endBlock, outputFile, result.Checksum)
+	if result.MissingLookups > 0 {
+		out.Warnf("%d receipts have no lookup entry on this node, they were exported without one", result.MissingLookups)
+	}
+	return result, nil
+}
+
+// readArchive streams the records of an archive to fn, size at a time, after
+// calling checkHeader, when given, with its header. It returns the number of
+// records once their count and checksum are checked, so a caller must not act
+// on what fn was given before then. Errors of checkHeader and fn are returned
+// as they are.
+func readArchive(path string, size int, checkHeader func(*archiveHeader) error, fn func([]keyChange) error) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var callbackErr error
+	count, err := decodeArchive(bufio.NewReader(file), size, func(header *archiveHeader) error {
+		if checkHeader != nil {
+			callbackErr = checkHeader(header)
+		}
+		return callbackErr
+	}, func(changes []keyChange) error {
+		callbackErr = fn(changes)
+		return callbackErr
+	})
+	if err != nil && err != callbackErr {
+		return 0, fmt.Errorf("invalid archive %s: %w", path, err)
+	}
+	return count, err
+}
+
+func decodeArchive(r io.Reader, size int, checkHeader func(*archiveHeader) error, fn func([]keyChange) error) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	br := bufio.NewReader(gz)
+
+	// The checksum covers every byte read up to the end marker.
+	sum := sha256.New()
+
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return 0, fmt.Errorf("failed to read header: %w", unexpectedEOF(err))
+	}
+	sum.Write(line)
+	var header archiveHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return 0, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Format != archiveFormat {
+		return 0, fmt.Errorf("not a bor receipt archive, header format is %q", header.Format)
+	}
+	if header.Version != 1 {
+		return 0, fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+	if err := checkHeader(&header); err != nil {
+		return 0, err
+	}
+
+	var prefix [binary.MaxVarintLen64]byte
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil || n == 0 {
+			return nil, unexpectedEOF(err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		sum.Write(prefix[:binary.PutUvarint(prefix[:], n)])
+		sum.Write(b)
+		return b, nil
+	}
+
+	records := 0
+	changes := make([]keyChange, 0, size)
+	for ; ; records++ {
+		key, err := readBytes()
+		if err != nil {
+			return 0, fmt.Errorf("record %d: %w", records, err)
+		}
+		if key == nil {
+			break
+		}
+		value, err := readBytes()
+		if err != nil {
+			return 0, fmt.Errorf("record %d: %w", records, err)
+		}
+		if value == nil {
+			return 0, fmt.Errorf("record %d: empty value for key 0x%x", records, key)
+		}
+		if err := checkArchiveKey(&header, key); err != nil {
+			return 0, fmt.Errorf("record %d: %w", records, err)
+		}
+		changes = append(changes, keyChange{Key: key, Value: value})
+		if len(changes) == size {
+			if err := fn(changes); err != nil {
+				return 0, err
+			}
+			changes = changes[:0]
+		}
+	}
+	if len(changes) > 0 {
+		if err := fn(changes); err != nil {
+			return 0, err
+		}
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read trailer: %w", unexpectedEOF(err))
+	}
+	var checksum common.Hash
+	if _, err := io.ReadFull(br, checksum[:]); err != nil {
+		return 0, fmt.Errorf("failed to read trailer: %w", unexpectedEOF(err))
+	}
+	if count != uint64(records) {
+		return 0, fmt.Errorf("trailer counts %d records, found %d", count, records)
+	}
+	if got := common.BytesToHash(sum.Sum(nil)); got != checksum {
+		return 0, fmt.Errorf("checksum mismatch: trailer has %s, content hashes to %s", checksum.Hex(), got.Hex())
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return 0, fmt.Errorf("unexpected data after the trailer")
+	}
+	return records, nil
+}
+
+// unexpectedEOF turns the end of the stream in the middle of an archive into
+// a clearer error.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("archive is truncated")
+	}
+	return err
+}
+
+// checkArchiveKey refuses anything but the bor receipt of a block in the
+// archive's range and bor tx lookup entries.
+func checkArchiveKey(header *archiveHeader, key []byte) error {
+	if _, ok := decodeBorTxLookupKey(key); ok {
+		return nil
+	}
+	number, _, ok := decodeBorReceiptKey(key)
+	if !ok {
+		return fmt.Errorf("key 0x%x is neither a bor receipt nor a bor tx lookup entry", key)
+	}
+	if number < header.StartBlock || number > header.EndBlock {
+		return fmt.Errorf("bor receipt of block %d is outside the archive's blocks %d-%d", number, header.StartBlock, header.EndBlock)
+	}
+	return nil
+}
+
+// ImportBorReceipts loads an archive written by export-bor-receipts into the
+// chaindata, the same way write-missing-state-sync-tx applies an instruction
+// file. The archive is read twice rather than held in memory: once for the
+// chain checks, which skipChainCheck overrides, and its count and checksum,
+// then to stage its entries a chunk at a time into one batch, journaled to
+// journalFile (default <archive>.journal) and committed once the whole archive
+// has been read again.
+func ImportBorReceipts(dataPath, archiveFile, journalFile string, dryRun, force, skipChainCheck bool) (*importResult, error) {
+	if journalFile == "" {
+		journalFile = archiveFile + ".journal"
+	}
+
+	db, err := openChaindata(dataPath, openOptions{readOnly: dryRun, force: force})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var header *archiveHeader
+	count, err := readArchive(archiveFile, writeChunkSize, func(h *archiveHeader) error {
+		header = h
+		return checkLocalChain(db, chainIdentity{ChainID: h.ChainID, Genesis: h.GenesisHash}, archiveFile, skipChainCheck)
+	}, func(changes []keyChange) error {
+		return checkCanonical(db, changes, skipChainCheck)
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Infof("Archive %s holds %d entries of blocks %d-%d of chain %d",
+		archiveFile, count, header.StartBlock, header.EndBlock, header.ChainID)
+
+	w := newChangeWriter(db, dataPath, journalFile, archiveFile, dryRun)
+	defer w.close()
+	restaged, err := readArchive(archiveFile, writeChunkSize, nil, w.stage)
+	if err == nil && restaged != count {
+		err = fmt.Errorf("archive %s changed while it was imported, it now holds %d entries", archiveFile, restaged)
+	}
+	if err == nil {
+		err = w.commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &importResult{
+		File:        archiveFile,
+		Entries:     count,
+		writeResult: *reportWrite(w.summary, journalFile, dryRun),
+	}, nil
+}
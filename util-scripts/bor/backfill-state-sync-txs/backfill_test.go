@@ -0,0 +1,1249 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/golang/snappy"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestMain(m *testing.M) {
+	out.text = io.Discard
+	os.Exit(m.Run())
+}
+
+// testChain is the chain both the fake RPC and the test chaindata agree on.
+type testChain struct {
+	chainID uint64
+	head    uint64
+	// syncs maps a state ID to the block that commits it.
+	syncs map[uint64]uint64
+}
+
+func (c *testChain) blockHash(number uint64) common.Hash {
+	return crypto.Keccak256Hash(binary.BigEndian.AppendUint64([]byte("block"), number))
+}
+
+// stateSyncLogs returns the StateCommitted logs of blocks [from, to] in block
+// and state ID order.
+func (c *testChain) stateSyncLogs(from, to uint64) []*types.Log {
+	var logs []*types.Log
+	for number := from; number <= to && number <= c.head; number++ {
+		for id := uint64(1); id <= uint64(len(c.syncs))+1; id++ {
+			if block, ok := c.syncs[id]; !ok || block != number {
+				continue
+			}
+			hash := c.blockHash(number)
+			logs = append(logs, &types.Log{
+				Address:     stateReceiverAddress,
+				Topics:      []common.Hash{stateCommittedTopic, common.BigToHash(new(big.Int).SetUint64(id)), {}},
+				Data:        []byte{byte(id)},
+				BlockNumber: number,
+				TxHash:      derivedBorTxHash(number, hash),
+				BlockHash:   hash,
+				Index:       uint(len(logs)),
+			})
+		}
+	}
+	return logs
+}
+
+// fakeRPC serves the JSON-RPC methods the tool calls from a testChain.
+// maxRange, when set, rejects eth_getLogs over more blocks, like providers do.
+// failFrom, when set, fails eth_getLogs reaching that block. widest is the
+// largest eth_getLogs range asked for.
+type fakeRPC struct {
+	chain    *testChain
+	maxRange uint64
+	failFrom uint64
+
+	mu     sync.Mutex
+	calls  map[string]int
+	widest uint64
+}
+
+func newFakeRPC(t *testing.T, chain *testChain, maxRange uint64) (*fakeRPC, string) {
+	t.Helper()
+	f := &fakeRPC{chain: chain, maxRange: maxRange, calls: make(map[string]int)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+type fakeRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type fakeResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *fakeError      `json:"error,omitempty"`
+}
+
+type fakeError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (f *fakeRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		var reqs []fakeRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resps := make([]fakeResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = f.handle(req)
+		}
+		json.NewEncoder(w).Encode(resps)
+		return
+	}
+
+	var req fakeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(f.handle(req))
+}
+
+func (f *fakeRPC) handle(req fakeRequest) fakeResponse {
+	f.mu.Lock()
+	f.calls[req.Method]++
+	f.mu.Unlock()
+
+	resp := fakeResponse{Version: "2.0", ID: req.ID}
+	fail := func(code int, format string, args ...interface{}) fakeResponse {
+		resp.Error = &fakeError{Code: code, Message: fmt.Sprintf(format, args...)}
+		return resp
+	}
+
+	switch req.Method {
+	case "eth_chainId":
+		resp.Result = hexutil.Uint64(f.chain.chainID)
+	case "eth_blockNumber":
+		resp.Result = hexutil.Uint64(f.chain.head)
+	case "eth_getBlockByNumber":
+		var number hexutil.Uint64
+		if err := json.Unmarshal(req.Params[0], &number); err != nil {
+			return fail(-32602, "invalid block number: %v", err)
+		}
+		if uint64(number) > f.chain.head {
+			resp.Result = nil
+			break
+		}
+		resp.Result = rpcHeader{Hash: f.chain.blockHash(uint64(number)), Number: number}
+	case "eth_getLogs":
+		var filter struct {
+			FromBlock hexutil.Uint64 `json:"fromBlock"`
+			ToBlock   hexutil.Uint64 `json:"toBlock"`
+		}
+		if err := json.Unmarshal(req.Params[0], &filter); err != nil {
+			return fail(-32602, "invalid filter: %v", err)
+		}
+		f.mu.Lock()
+		f.widest = max(f.widest, uint64(filter.ToBlock-filter.FromBlock)+1)
+		f.mu.Unlock()
+		if f.maxRange > 0 && uint64(filter.ToBlock-filter.FromBlock)+1 > f.maxRange {
+			return fail(-32005, "block range too large, max %d", f.maxRange)
+		}
+		if f.failFrom > 0 && uint64(filter.ToBlock) >= f.failFrom {
+			return fail(-32000, "internal error")
+		}
+		logs := f.chain.stateSyncLogs(uint64(filter.FromBlock), uint64(filter.ToBlock))
+		if logs == nil {
+			logs = []*types.Log{}
+		}
+		resp.Result = logs
+	case "eth_getTransactionReceipt":
+		var txHash common.Hash
+		if err := json.Unmarshal(req.Params[0], &txHash); err != nil {
+			return fail(-32602, "invalid tx hash: %v", err)
+		}
+		for number := uint64(0); number <= f.chain.head; number++ {
+			hash := f.chain.blockHash(number)
+			if derivedBorTxHash(number, hash) != txHash {
+				continue
+			}
+			logs := f.chain.stateSyncLogs(number, number)
+			if len(logs) == 0 {
+				break
+			}
+			resp.Result = map[string]interface{}{
+				"transactionHash":   txHash,
+				"blockHash":         hash,
+				"blockNumber":       hexutil.Uint64(number),
+				"status":            hexutil.Uint64(1),
+				"cumulativeGasUsed": hexutil.Uint64(0),
+				"logs":              logs,
+			}
+			return resp
+		}
+		resp.Result = nil
+	default:
+		return fail(-32601, "the method %s does not exist/is not available", req.Method)
+	}
+	return resp
+}
+
+func (f *fakeRPC) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// newTestChaindata creates a Pebble chaindata on an in-memory filesystem with
+// the canonical hashes of blocks [0, head] and a chain config for chainID.
+func newTestChaindata(t *testing.T, chain *testChain, chainID uint64) string {
+	t.Helper()
+
+	prev := chaindataFS
+	chaindataFS = vfs.NewMem()
+	t.Cleanup(func() { chaindataFS = prev })
+
+	dataPath := "/data"
+	pdb, err := pebble.Open(filepath.Join(dataPath, "bor", "chaindata"), &pebble.Options{FS: chaindataFS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := openChaindata(dataPath, openOptions{force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for number := uint64(0); number <= chain.head; number++ {
+		if err := db.Put(canonicalHashKey(number), chain.blockHash(number).Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := fmt.Sprintf(`{"chainId":%d}`, chainID)
+	if err := db.Put(append(append([]byte{}, configPrefix...), chain.blockHash(0).Bytes()...), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	return dataPath
+}
+
+func newTestChain() *testChain {
+	return &testChain{
+		chainID: 137,
+		head:    100,
+		syncs:   map[uint64]uint64{1: 5, 2: 5, 3: 17, 4: 42, 5: 60},
+	}
+}
+
+func findOptions(url, outputFile string) FindOptions {
+	return FindOptions{
+		StartBlock:   0,
+		EndBlock:     100,
+		Interval:     10,
+		RemoteRPC:    url,
+		OutputFile:   outputFile,
+		ProgressFile: outputFile + ".progress",
+		Concurrency:  3,
+		BatchSize:    2,
+	}
+}
+
+// Find, write and verify must agree on every format of instruction file.
+func TestFindWriteVerify(t *testing.T) {
+	// Stage the file a few instructions at a time into one batch.
+	prev := writeChunkSize
+	writeChunkSize = 3
+	t.Cleanup(func() { writeChunkSize = prev })
+
+	for _, name := range []string{"instructions.json", "instructions.ndjson", "instructions.csv.gz"} {
+		t.Run(name, func(t *testing.T) {
+			chain := newTestChain()
+			_, url := newFakeRPC(t, chain, 0)
+			dataPath := newTestChaindata(t, chain, chain.chainID)
+			outputFile := filepath.Join(t.TempDir(), name)
+			ctx := context.Background()
+
+			progress, err := FindAllStateSyncTransactions(ctx, findOptions(url, outputFile))
+			if err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			// Blocks 5, 17, 42 and 60 each get a lookup and a receipt.
+			if !progress.Done || progress.Instructions != 8 {
+				t.Fatalf("find wrote %d instructions (done %v), want 8", progress.Instructions, progress.Done)
+			}
+
+			journalFile := outputFile + ".journal"
+			written, err := WriteMissingStateSyncTransactions(ctx, dataPath, outputFile, journalFile, url, 0, false, true, false)
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if written.Created != 8 || written.Overwritten != 0 {
+				t.Fatalf("write created %d and overwrote %d keys, want 8 and 0", written.Created, written.Overwritten)
+			}
+
+			report, err := VerifyStateSyncTransactions(dataPath, outputFile, true, false)
+			if err != nil {
+				t.Fatalf("verify: %v (issues %+v)", err, report)
+			}
+			if report.Entries != 8 || report.Verified != 8 {
+				t.Fatalf("verify checked %d entries and verified %d, want 8", report.Entries, report.Verified)
+			}
+
+			// The chaindata now has everything, so a scan against it finds
+			// nothing left to write.
+			opts := findOptions(url, filepath.Join(t.TempDir(), name))
+			opts.DataPath, opts.Force = dataPath, true
+			progress, err = FindAllStateSyncTransactions(ctx, opts)
+			if err != nil {
+				t.Fatalf("find against the chaindata: %v", err)
+			}
+			if progress.Instructions != 0 || progress.Stats.Present != 8 {
+				t.Fatalf("find against the chaindata wrote %d instructions with %d present, want 0 and 8", progress.Instructions, progress.Stats.Present)
+			}
+
+			if _, err := RollbackJournal(dataPath, journalFile, false, false, false); err != nil {
+				t.Fatalf("rollback: %v", err)
+			}
+			report, err = VerifyStateSyncTransactions(dataPath, outputFile, true, false)
+			if err == nil || len(report.Issues) != 8 {
+				t.Fatalf("verify after rollback: %v with %d issues, want 8 issues", err, len(report.Issues))
+			}
+		})
+	}
+}
+
+// An interrupted scan resumes after its last completed window, dropping what
+// was written past it, and only with the options it was started with.
+func TestFindResume(t *testing.T) {
+	chain := newTestChain()
+	fake, url := newFakeRPC(t, chain, 0)
+	outputFile := filepath.Join(t.TempDir(), "instructions.ndjson")
+	ctx := context.Background()
+
+	prev := logRetryBackoff
+	logRetryBackoff = time.Millisecond
+	t.Cleanup(func() { logRetryBackoff = prev })
+
+	opts := findOptions(url, outputFile)
+	opts.Concurrency = 1
+	fake.failFrom = 50
+	progress, err := FindAllStateSyncTransactions(ctx, opts)
+	if err == nil {
+		t.Fatal("find succeeded through a failing RPC")
+	}
+	// Windows grow with the eth_getLogs range, so the scan stops at the start
+	// of whichever window reached block 50, with the state syncs before it.
+	want := 0
+	for _, number := range []uint64{5, 17, 42, 60} {
+		if number < progress.NextBlock {
+			want += 2
+		}
+	}
+	if progress.NextBlock == 0 || progress.NextBlock > 50 || progress.Instructions != want || progress.Done {
+		t.Fatalf("interrupted at block %d with %d instructions (done %v), want a block in 1-50 and %d", progress.NextBlock, progress.Instructions, progress.Done, want)
+	}
+
+	// Whatever an unfinished window left past the checkpoint is discarded.
+	file, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"kind":"partial`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	fake.failFrom = 0
+	refused := []struct {
+		name   string
+		change func(*FindOptions)
+		field  string
+	}{
+		{name: "another range", change: func(o *FindOptions) { o.EndBlock = 90 }, field: "endBlock"},
+		{name: "another format", change: func(o *FindOptions) { o.OutputFile = outputFile + ".gz" }, field: "format"},
+		{name: "a block list", change: func(o *FindOptions) { o.Blocks = []uint64{5, 60} }, field: "blocks"},
+	}
+	for _, test := range refused {
+		resumed := opts
+		resumed.Resume = true
+		test.change(&resumed)
+		if _, err := FindAllStateSyncTransactions(ctx, resumed); err == nil || !strings.Contains(err.Error(), test.field) {
+			t.Errorf("resume with %s: %v, want a refusal naming %s", test.name, err, test.field)
+		}
+	}
+
+	opts.Resume = true
+	progress, err = FindAllStateSyncTransactions(ctx, opts)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if !progress.Done || progress.Instructions != 8 {
+		t.Fatalf("resume wrote %d instructions (done %v), want 8", progress.Instructions, progress.Done)
+	}
+
+	reader, err := openInstructionReader(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	var blocks []uint64
+	for {
+		instruction, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading the resumed file: %v", err)
+		}
+		blocks = append(blocks, instruction.BlockNumber)
+	}
+	if want := []uint64{5, 5, 17, 17, 42, 42, 60, 60}; !reflect.DeepEqual(blocks, want) {
+		t.Fatalf("resumed file has instructions of blocks %v, want %v", blocks, want)
+	}
+}
+
+// A provider that caps eth_getLogs ranges below --interval must not lose any
+// state sync.
+func TestFindSplitsRangesOverProviderLimit(t *testing.T) {
+	chain := newTestChain()
+	rpc, url := newFakeRPC(t, chain, 4)
+	dir := t.TempDir()
+
+	opts := findOptions(url, filepath.Join(dir, "instructions.ndjson"))
+	opts.Interval = 50
+	progress, err := FindAllStateSyncTransactions(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if progress.Instructions != 8 {
+		t.Fatalf("find wrote %d instructions, want 8", progress.Instructions)
+	}
+	if rpc.count("eth_getLogs") < 100/4 {
+		t.Fatalf("only %d eth_getLogs calls for 101 blocks with a limit of 4", rpc.count("eth_getLogs"))
+	}
+}
+
+func TestFindGrowsWindowPastInterval(t *testing.T) {
+	chain := newTestChain()
+	rpc, url := newFakeRPC(t, chain, 0)
+	dir := t.TempDir()
+
+	opts := findOptions(url, filepath.Join(dir, "instructions.ndjson"))
+	opts.Interval = 2
+	opts.Concurrency = 1
+	progress, err := FindAllStateSyncTransactions(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if progress.Instructions != 8 {
+		t.Fatalf("find wrote %d instructions, want 8", progress.Instructions)
+	}
+	if rpc.widest <= opts.Interval {
+		t.Fatalf("widest eth_getLogs range is %d blocks, want more than the interval of %d", rpc.widest, opts.Interval)
+	}
+	if calls := rpc.count("eth_getLogs"); calls >= 101/2 {
+		t.Fatalf("%d eth_getLogs calls for 101 blocks, the window did not grow past the interval of %d", calls, opts.Interval)
+	}
+}
+
+// codedError is a JSON-RPC error with a code, as the rpc client returns them.
+type codedError struct {
+	code    int
+	message string
+}
+
+func (e codedError) Error() string  { return e.message }
+func (e codedError) ErrorCode() int { return e.code }
+
+func TestIsRangeError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{codedError{-32005, "query returned more than 10000 results"}, true},
+		{codedError{-32005, "limit exceeded"}, true},
+		{codedError{-32005, "daily request count exceeded, request rate limited"}, false},
+		{codedError{-32000, "query returned more than 10000 results"}, true},
+		{errors.New("Log response size exceeded. You can make eth_getLogs requests with up to a 2K block range"), true},
+		{errors.New("eth_getLogs is limited to a 10,000 range"), true},
+		{errors.New("block range is too wide"), true},
+		{errors.New("429 Too Many Requests: more than 100 requests per second"), false},
+		{errors.New("401 Unauthorized: API key limited to 3 block range queries"), false},
+		{errors.New("504 Gateway Timeout: query timeout"), false},
+		{codedError{-32000, "header not found"}, false},
+	}
+	for _, test := range tests {
+		if got := isRangeError(test.err); got != test.want {
+			t.Errorf("isRangeError(%q) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestFindByStateIDReportsGaps(t *testing.T) {
+	chain := newTestChain()
+	delete(chain.syncs, 3)
+	_, url := newFakeRPC(t, chain, 0)
+
+	opts := findOptions(url, filepath.Join(t.TempDir(), "instructions.ndjson"))
+	opts.StartBlock, opts.EndBlock = 0, 0
+	opts.FromStateID, opts.ToStateID = 1, 5
+	progress, err := FindAllStateSyncTransactions(context.Background(), opts)
+	if err == nil {
+		t.Fatal("find accepted a state ID range with a gap")
+	}
+	if progress == nil || len(progress.Gaps) != 1 || progress.Gaps[0] != (stateIDGap{From: 3, To: 3}) {
+		t.Fatalf("gaps = %+v, want state ID 3", progress)
+	}
+	if progress.StartBlock != 5 || progress.EndBlock != 60 {
+		t.Fatalf("state IDs 1-5 resolved to blocks %d-%d, want 5-60", progress.StartBlock, progress.EndBlock)
+	}
+}
+
+func TestWriteRefusesAnotherChain(t *testing.T) {
+	for _, name := range []string{"instructions.json", "instructions.ndjson"} {
+		t.Run(name, func(t *testing.T) {
+			chain := newTestChain()
+			_, url := newFakeRPC(t, chain, 0)
+			dataPath := newTestChaindata(t, chain, 80001)
+			outputFile := filepath.Join(t.TempDir(), name)
+			ctx := context.Background()
+
+			if _, err := FindAllStateSyncTransactions(ctx, findOptions(url, outputFile)); err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			_, err := WriteMissingStateSyncTransactions(ctx, dataPath, outputFile, outputFile+".journal", "", 0, false, true, false)
+			if err == nil || !strings.Contains(err.Error(), "chain 137") {
+				t.Fatalf("write to a chain 80001 chaindata: %v, want a chain mismatch", err)
+			}
+			if _, err := os.Stat(outputFile + ".journal"); !os.IsNotExist(err) {
+				t.Fatal("a refused write left a journal behind")
+			}
+		})
+	}
+}
+
+// Files of the original JSON array format have no header to check the chain
+// against, so only --skip-chain-check writes them, not --force.
+func TestWriteRefusesHeaderlessFile(t *testing.T) {
+	chain := newTestChain()
+	dataPath := newTestChaindata(t, chain, chain.chainID)
+	txFile := filepath.Join(t.TempDir(), "instructions.json")
+	txHash := derivedBorTxHash(5, chain.blockHash(5))
+	legacy := fmt.Sprintf(`[{"key": "%s", "value": "%s"}]`,
+		hexutil.Encode(borTxLookupKey(txHash)), hexutil.Encode(big.NewInt(5).Bytes()))
+	if err := os.WriteFile(txFile, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, force := range []bool{false, true} {
+		_, err := WriteMissingStateSyncTransactions(ctx, dataPath, txFile, txFile+".journal", "", 0, false, force, false)
+		if err == nil || !strings.Contains(err.Error(), "has no header") || !strings.Contains(err.Error(), "--skip-chain-check") {
+			t.Fatalf("write of a headerless file with force %v: %v, want it refused", force, err)
+		}
+	}
+	written, err := WriteMissingStateSyncTransactions(ctx, dataPath, txFile, txFile+".journal", "", 0, false, false, true)
+	if err != nil || written.Created != 1 {
+		t.Fatalf("write of a headerless file skipping the chain check: %v with %+v, want 1 key created", err, written)
+	}
+}
+
+func TestWriteRefusesNonCanonicalBlocks(t *testing.T) {
+	chain := newTestChain()
+	_, url := newFakeRPC(t, chain, 0)
+	dataPath := newTestChaindata(t, chain, chain.chainID)
+	outputFile := filepath.Join(t.TempDir(), "instructions.ndjson")
+	ctx := context.Background()
+
+	if _, err := FindAllStateSyncTransactions(ctx, findOptions(url, outputFile)); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+
+	// The local node followed another fork at block 42.
+	db, err := openChaindata(dataPath, openOptions{force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(canonicalHashKey(42), common.HexToHash("0x42").Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = WriteMissingStateSyncTransactions(ctx, dataPath, outputFile, outputFile+".journal", "", 0, false, true, false)
+	if err == nil || !strings.Contains(err.Error(), "block 42") {
+		t.Fatalf("write with a non-canonical block 42: %v, want it refused", err)
+	}
+
+	report, err := VerifyStateSyncTransactions(dataPath, outputFile, true, false)
+	if err == nil || report.Verified != 0 {
+		t.Fatalf("verify after a refused write: %v with %d verified, want nothing written", err, report.Verified)
+	}
+
+	written, err := WriteMissingStateSyncTransactions(ctx, dataPath, outputFile, outputFile+".journal", "", 0, false, false, true)
+	if err != nil || written.Created != 8 {
+		t.Fatalf("write skipping the chain check: %v with %+v, want 8 keys created", err, written)
+	}
+}
+
+// failingDB fails every read of key, like a corrupted or unreadable entry.
+type failingDB struct {
+	Database
+	key []byte
+}
+
+func (f failingDB) Get(key []byte) ([]byte, error) {
+	if bytes.Equal(key, f.key) {
+		return nil, errors.New("read error")
+	}
+	return f.Database.Get(key)
+}
+
+// A write that fails in a later chunk leaves the DB as it was, unless chunks
+// were asked for, which then have to be rolled back with the journal.
+func TestWriteFailingLaterChunk(t *testing.T) {
+	prev := writeChunkSize
+	writeChunkSize = 3
+	t.Cleanup(func() { writeChunkSize = prev })
+
+	chain := newTestChain()
+	_, url := newFakeRPC(t, chain, 0)
+	txFile := filepath.Join(t.TempDir(), "instructions.ndjson")
+	if _, err := FindAllStateSyncTransactions(context.Background(), findOptions(url, txFile)); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	var keys [][]byte
+	err := readInstructionChunks(txFile, writeChunkSize, nil, func(changes []keyChange) error {
+		for _, change := range changes {
+			keys = append(keys, change.Key)
+		}
+		return nil
+	})
+	if err != nil || len(keys) != 8 {
+		t.Fatalf("read %d instructions (%v), want 8", len(keys), err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		chunkSize int
+		written   int
+	}{
+		{name: "one batch", written: 0},
+		{name: "chunks of 3", chunkSize: 3, written: 6},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dataPath := newTestChaindata(t, chain, chain.chainID)
+			journalFile := filepath.Join(t.TempDir(), "instructions.journal")
+			db, err := openChaindata(dataPath, openOptions{force: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The key of the seventh instruction, in the third chunk, can't be read.
+			w := newChangeWriter(failingDB{db, keys[6]}, dataPath, journalFile, txFile, false)
+			err = writeInstructions(w, txFile, test.chunkSize)
+			w.close()
+			if err == nil || !strings.Contains(err.Error(), "read error") {
+				t.Fatalf("write: %v, want the read error", err)
+			}
+			for i, key := range keys {
+				_, err := db.Get(key)
+				if written := i < test.written; written != (err == nil) {
+					t.Errorf("instruction %d: read %v, want written %v", i, err, written)
+				}
+			}
+			db.Close()
+
+			_, err = os.Stat(journalFile)
+			if test.written == 0 {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("journal of a write that never committed: %v, want it removed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("journal of the committed chunks: %v", err)
+			}
+			if _, err := RollbackJournal(dataPath, journalFile, false, false, false); err != nil {
+				t.Fatalf("rollback: %v", err)
+			}
+			db, err = openChaindata(dataPath, openOptions{readOnly: true, force: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i, key := range keys {
+				if _, err := db.Get(key); err != errNotFound {
+					t.Errorf("instruction %d after rollback: %v, want it deleted", i, err)
+				}
+			}
+		})
+	}
+}
+
+// An exported archive imports back into the chaindata it came from once its
+// entries were rolled back, and the import can be rolled back in turn.
+func TestExportImportRoundTrip(t *testing.T) {
+	prev := writeChunkSize
+	writeChunkSize = 3
+	t.Cleanup(func() { writeChunkSize = prev })
+
+	chain := newTestChain()
+	_, url := newFakeRPC(t, chain, 0)
+	dataPath := newTestChaindata(t, chain, chain.chainID)
+	dir := t.TempDir()
+	txFile := filepath.Join(dir, "instructions.ndjson")
+	ctx := context.Background()
+
+	if _, err := FindAllStateSyncTransactions(ctx, findOptions(url, txFile)); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if _, err := WriteMissingStateSyncTransactions(ctx, dataPath, txFile, txFile+".journal", "", 0, false, true, false); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	archiveFile := filepath.Join(dir, "receipts.bra")
+	exported, err := ExportBorReceipts(dataPath, archiveFile, 0, chain.head, true)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if exported.Receipts != 4 || exported.Lookups != 4 {
+		t.Fatalf("export wrote %d receipts and %d lookups, want 4 and 4", exported.Receipts, exported.Lookups)
+	}
+	if _, err := RollbackJournal(dataPath, txFile+".journal", false, true, false); err != nil {
+		t.Fatalf("rollback of the write: %v", err)
+	}
+
+	imported, err := ImportBorReceipts(dataPath, archiveFile, "", false, true, false)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if imported.Entries != 8 || imported.Created != 8 || imported.JournalFile != archiveFile+".journal" {
+		t.Fatalf("import read %d entries and created %d keys journaled to %q, want 8, 8 and %s.journal", imported.Entries, imported.Created, imported.JournalFile, archiveFile)
+	}
+	report, err := VerifyStateSyncTransactions(dataPath, txFile, true, false)
+	if err != nil || report.Verified != 8 {
+		t.Fatalf("verify after import: %v with %d verified, want 8", err, report.Verified)
+	}
+
+	journal, err := loadJournal(imported.JournalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal.Entries) != 8 || journal.Source != archiveFile {
+		t.Fatalf("import journal has %d entries from %q, want 8 from %s", len(journal.Entries), journal.Source, archiveFile)
+	}
+	if _, err := RollbackJournal(dataPath, imported.JournalFile, false, true, false); err != nil {
+		t.Fatalf("rollback of the import: %v", err)
+	}
+	report, err = VerifyStateSyncTransactions(dataPath, txFile, true, false)
+	if err == nil || len(report.Issues) != 8 {
+		t.Fatalf("verify after rolling back the import: %v with %d issues, want 8", err, len(report.Issues))
+	}
+}
+
+// An archive with a single byte changed is refused as a whole.
+func TestImportRefusesChangedArchive(t *testing.T) {
+	chain := newTestChain()
+	_, url := newFakeRPC(t, chain, 0)
+	dataPath := newTestChaindata(t, chain, chain.chainID)
+	dir := t.TempDir()
+	txFile := filepath.Join(dir, "instructions.ndjson")
+	ctx := context.Background()
+
+	if _, err := FindAllStateSyncTransactions(ctx, findOptions(url, txFile)); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if _, err := WriteMissingStateSyncTransactions(ctx, dataPath, txFile, txFile+".journal", "", 0, false, true, false); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	archiveFile := filepath.Join(dir, "receipts.bra")
+	if _, err := ExportBorReceipts(dataPath, archiveFile, 0, chain.head, true); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if _, err := RollbackJournal(dataPath, txFile+".journal", false, true, false); err != nil {
+		t.Fatalf("rollback of the write: %v", err)
+	}
+
+	// Flip the last byte of the last value, just before the end marker, the
+	// record count and the checksum, and gzip the archive again.
+	compressed, err := os.ReadFile(archiveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)-1-1-1-common.HashLength] ^= 0xff
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(content)
+	zw.Close()
+	if err := os.WriteFile(archiveFile, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ImportBorReceipts(dataPath, archiveFile, "", false, true, false); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("import of a changed archive: %v, want a checksum mismatch", err)
+	}
+	if _, err := os.Stat(archiveFile + ".journal"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a refused import left a journal behind: %v", err)
+	}
+	report, err := VerifyStateSyncTransactions(dataPath, txFile, true, false)
+	if err == nil || report.Verified != 0 {
+		t.Fatalf("verify after a refused import: %v with %d verified, want nothing written", err, report.Verified)
+	}
+}
+
+func TestRollbackRefusesChangedKeys(t *testing.T) {
+	chain := newTestChain()
+	dataPath := newTestChaindata(t, chain, chain.chainID)
+	journalFile := filepath.Join(t.TempDir(), "changes.journal")
+
+	a, b := []byte("key-a"), []byte("key-b")
+	db, err := openChaindata(dataPath, openOptions{force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// key-a is given twice in the first batch: it ends up with its last value
+	// and is counted and journaled once. The second batch changes it again.
+	w := newChangeWriter(db, dataPath, journalFile, "test", false)
+	if err := w.apply([]keyChange{{Key: a, Value: []byte{1}}, {Key: b, Value: []byte{2}}, {Key: a, Value: []byte{3}}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := w.apply([]keyChange{{Key: a, Value: []byte{5}}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	w.close()
+	if w.summary.Created != 2 || w.summary.Overwritten != 1 {
+		t.Fatalf("apply created %d keys and overwrote %d, want 2 and 1", w.summary.Created, w.summary.Overwritten)
+	}
+	if value, err := db.Get(a); err != nil || !bytes.Equal(value, []byte{5}) {
+		t.Fatalf("key-a holds 0x%x (%v), want 0x05", value, err)
+	}
+	if err := db.Put(b, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	journal, err := loadJournal(journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal.Entries) != 3 {
+		t.Fatalf("journal has %d entries, want 3", len(journal.Entries))
+	}
+
+	if _, err := RollbackJournal("/other", journalFile, false, false, false); err == nil || !strings.Contains(err.Error(), "was written for /data") {
+		t.Fatalf("rollback into another data path: %v, want it refused", err)
+	}
+	if _, err := RollbackJournal(dataPath, journalFile, false, false, false); err == nil || !strings.Contains(err.Error(), "1 of 2 keys") {
+		t.Fatalf("rollback over a changed key: %v, want it refused", err)
+	}
+	// --force only gets past a live node or LOCK, not the journal checks.
+	if _, err := RollbackJournal(dataPath, journalFile, false, true, false); err == nil || !strings.Contains(err.Error(), "1 of 2 keys") {
+		t.Fatalf("rollback over a changed key with --force: %v, want it refused", err)
+	}
+	if _, err := RollbackJournal(dataPath, journalFile, false, false, true); err != nil {
+		t.Fatalf("rollback skipping the journal check: %v", err)
+	}
+
+	db, err = openChaindata(dataPath, openOptions{readOnly: true, force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range [][]byte{a, b} {
+		if _, err := db.Get(key); err != errNotFound {
+			t.Fatalf("%s after rollback: %v, want it deleted", key, err)
+		}
+	}
+}
+
+func TestGCBorReceiptsAfterReorg(t *testing.T) {
+	chain := newTestChain()
+	dataPath := newTestChaindata(t, chain, chain.chainID)
+	journalFile := filepath.Join(t.TempDir(), "gc.journal")
+
+	// Blocks 5 and 17 are canonical. Block 42 was reorged out: its receipt and
+	// lookup still name the old hash. The lookup of block 17 was written at the
+	// wrong height, and a receipt survived a rewind past block 150.
+	orphan := common.HexToHash("0xdead")
+	puts := []keyChange{
+		{Key: borReceiptKey(5, chain.blockHash(5)), Value: []byte{0xc0}},
+		{Key: borTxLookupKey(derivedBorTxHash(5, chain.blockHash(5))), Value: borTxLookupValue(5)},
+		{Key: borReceiptKey(17, chain.blockHash(17)), Value: []byte{0xc0}},
+		{Key: borTxLookupKey(derivedBorTxHash(17, chain.blockHash(17))), Value: borTxLookupValue(18)},
+		{Key: borReceiptKey(42, orphan), Value: []byte{0xc0}},
+		{Key: borTxLookupKey(derivedBorTxHash(42, orphan)), Value: borTxLookupValue(42)},
+		{Key: borReceiptKey(150, orphan), Value: []byte{0xc0}},
+	}
+	db, err := openChaindata(dataPath, openOptions{force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, put := range puts {
+		if err := db.Put(put.Key, put.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	opts := GCOptions{DataPath: dataPath, JournalFile: journalFile, Force: true}
+	report, err := GCBorReceipts(opts)
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if report.Receipts != 4 || report.Lookups != 3 || report.OrphanReceipts != 2 || report.StaleLookups != 1 || report.MisplacedLookups != 1 {
+		t.Fatalf("gc report = %+v", report)
+	}
+	if report.Write != nil {
+		t.Fatal("gc without delete wrote to the chaindata")
+	}
+
+	opts.EndBlock = 20
+	if report, err := GCBorReceipts(opts); err != nil || len(report.Issues) != 1 {
+		t.Fatalf("gc of blocks 0-20: %v with %+v, want only the misplaced lookup", err, report)
+	}
+	// The misplaced lookup points into 18-20 but its receipt is at 17: it is
+	// still repointed, not deleted.
+	opts.StartBlock = 18
+	if report, err := GCBorReceipts(opts); err != nil || report.Receipts != 0 || report.MisplacedLookups != 1 || report.StaleLookups != 0 {
+		t.Fatalf("gc of blocks 18-20: %v with %+v, want the lookup repointed", err, report)
+	}
+	opts.StartBlock, opts.EndBlock = 0, 0
+
+	opts.Delete = true
+	report, err = GCBorReceipts(opts)
+	if err != nil {
+		t.Fatalf("gc --delete: %v", err)
+	}
+	if report.Write == nil || report.Write.Deleted != 3 || report.Write.Overwritten != 1 {
+		t.Fatalf("gc --delete wrote %+v, want 3 deletes and 1 overwrite", report.Write)
+	}
+
+	db, err = openChaindata(dataPath, openOptions{readOnly: true, force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]byte{puts[4].Key, puts[5].Key, puts[6].Key} {
+		if _, err := db.Get(key); err != errNotFound {
+			t.Errorf("key %x survived gc: %v", key, err)
+		}
+	}
+	if value, err := db.Get(puts[3].Key); err != nil || decodeBorTxLookupValue(value) != 17 {
+		t.Errorf("lookup of block 17 = %x, %v, want it repointed at 17", value, err)
+	}
+	db.Close()
+
+	opts.Delete = false
+	if report, err := GCBorReceipts(opts); err != nil || len(report.Issues) != 0 {
+		t.Fatalf("gc after delete: %v with %+v, want a clean chaindata", err, report)
+	}
+
+	if _, err := RollbackJournal(dataPath, journalFile, false, false, false); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if report, err := GCBorReceipts(opts); err != nil || len(report.Issues) != 4 {
+		t.Fatalf("gc after rollback: %v with %+v, want the 4 issues back", err, report)
+	}
+}
+
+// fakeHeimdall serves clerk event records over the Heimdall REST API, with
+// numbers encoded as strings like Heimdall's amino JSON does.
+func newFakeHeimdall(t *testing.T, chainID uint64, times map[uint64]float64) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/clerk/event-record/list" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		var from, to float64
+		var page, limit int
+		fmt.Sscan(q.Get("from-time"), &from)
+		fmt.Sscan(q.Get("to-time"), &to)
+		fmt.Sscan(q.Get("page"), &page)
+		fmt.Sscan(q.Get("limit"), &limit)
+
+		records := []map[string]string{}
+		for id := uint64(1); id <= uint64(len(times)); id++ {
+			if times[id] < from || times[id] >= to {
+				continue
+			}
+			sec, frac := math.Modf(times[id])
+			records = append(records, map[string]string{
+				"id":           fmt.Sprint(id),
+				"contract":     "0x0000000000000000000000000000000000000abc",
+				"data":         "0x01",
+				"tx_hash":      common.BigToHash(new(big.Int).SetUint64(id)).Hex(),
+				"log_index":    "0",
+				"bor_chain_id": fmt.Sprint(chainID),
+				"record_time":  time.Unix(int64(sec), int64(frac*1e9)).UTC().Format(time.RFC3339Nano),
+			})
+		}
+		first := min((page-1)*limit, len(records))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"height": "1",
+			"result": records[first:min(first+limit, len(records))],
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestFindFromHeimdall(t *testing.T) {
+	chain := newTestChain()
+	dataPath := newTestChaindata(t, chain, chain.chainID)
+
+	// Sprints of 16 blocks, 2s apart. Before Indore at block 64 a sprint
+	// start takes the records older than the previous sprint start, after it
+	// those older than its own time less 10s.
+	db, err := openChaindata(dataPath, openOptions{force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for number := uint64(0); number <= chain.head; number++ {
+		header, err := rlp.EncodeToBytes(&types.Header{
+			Number:     new(big.Int).SetUint64(number),
+			Difficulty: big.NewInt(1),
+			Time:       1000 + 2*number,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put(headerKey(number, chain.blockHash(number)), header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := `{"chainId":137,"bor":{"sprint":{"0":16},"indoreBlock":64,"stateSyncConfirmationDelay":{"64":10}}}`
+	if err := db.Put(append(append([]byte{}, configPrefix...), chain.blockHash(0).Bytes()...), []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	// Block 96 already has a receipt, which a rebuilt one must not replace.
+	if err := db.Put(borReceiptKey(96, chain.blockHash(96)), []byte{0xc0}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Cutoffs: 16 -> 1000, 32 -> 1032, 48 -> 1064, 64 -> 1118, 80 -> 1150,
+	// 96 -> 1182. Record 6 is left for block 112, past the range.
+	url := newFakeHeimdall(t, chain.chainID, map[uint64]float64{
+		1: 999.5, 2: 1000, 3: 1031, 4: 1100, 5: 1181.9, 6: 1182,
+	})
+	want := map[uint64][]uint64{16: {1}, 32: {2, 3}, 64: {4}}
+
+	// By default only the tx lookups are written.
+	outputFile := filepath.Join(t.TempDir(), "instructions.ndjson")
+	opts := findOptions("", outputFile)
+	opts.StartBlock, opts.Interval = 1, 40
+	opts.HeimdallURL, opts.DataPath, opts.Force = url, dataPath, true
+	progress, err := FindAllStateSyncTransactions(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("find from Heimdall: %v", err)
+	}
+	if progress.Instructions != 4 || progress.Stats.Missing != 4 {
+		t.Fatalf("find wrote %d instructions with stats %+v, want 4 lookups", progress.Instructions, progress.Stats)
+	}
+	_, err = readAllInstructions(outputFile, func(instruction WriteInstruction) error {
+		if instruction.Kind != kindBorTxLookup {
+			t.Errorf("block %d: find wrote a %s without --approximate-receipts", instruction.BlockNumber, instruction.Kind)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputFile = filepath.Join(t.TempDir(), "approximate.ndjson")
+	opts.OutputFile, opts.ProgressFile = outputFile, ""
+	opts.ApproximateReceipts = true
+	progress, err = FindAllStateSyncTransactions(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("find approximate receipts from Heimdall: %v", err)
+	}
+	if progress.Instructions != 7 || progress.Stats.Present != 1 || progress.Stats.Missing != 7 {
+		t.Fatalf("find wrote %d instructions with stats %+v, want 7 with 1 present", progress.Instructions, progress.Stats)
+	}
+
+	got := make(map[uint64][]uint64)
+	header, err := readAllInstructions(outputFile, func(instruction WriteInstruction) error {
+		hash := chain.blockHash(instruction.BlockNumber)
+		if instruction.TxHash != derivedBorTxHash(instruction.BlockNumber, hash).Hex() {
+			t.Errorf("block %d: tx %s is not the derived bor tx hash", instruction.BlockNumber, instruction.TxHash)
+		}
+		if instruction.Kind == kindBorReceipt {
+			t.Errorf("block %d: a rebuilt receipt is not marked approximate", instruction.BlockNumber)
+		}
+		if instruction.Kind != kindBorReceiptApproximate {
+			return nil
+		}
+		var receipt types.ReceiptForStorage
+		if err := rlp.DecodeBytes(hexutil.MustDecode(instruction.Value), &receipt); err != nil {
+			return err
+		}
+		for _, log := range receipt.Logs {
+			id, ok := stateIDOf(log)
+			if !ok {
+				t.Errorf("block %d: log %+v is not a StateCommitted log", instruction.BlockNumber, log)
+			}
+			got[instruction.BlockNumber] = append(got[instruction.BlockNumber], id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("state IDs by block = %v, want %v", got, want)
+	}
+	if header == nil || !header.ApproximateReceipts {
+		t.Fatalf("header = %+v, want approximate receipts marked", header)
+	}
+}
+
+// writeFreezerTable writes a freezer table of items numbered from tail, with
+// the items before tail pruned, two items per data file.
+func writeFreezerTable(t *testing.T, dir, name string, compressed bool, tail uint64, items [][]byte) {
+	t.Helper()
+	idx, dat := "ridx", "rdat"
+	if compressed {
+		idx, dat = "cidx", "cdat"
+	}
+	entry := func(filenum, offset uint32) []byte {
+		return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint16(nil, uint16(filenum)), offset)
+	}
+
+	index := entry(0, uint32(tail))
+	var data []byte
+	filenum := uint32(0)
+	flush := func() {
+		path := filepath.Join(dir, fmt.Sprintf("%s.%04d.%s", name, filenum, dat))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, item := range items {
+		if i > 0 && i%2 == 0 {
+			flush()
+			filenum, data = filenum+1, nil
+		}
+		if compressed {
+			item = snappy.Encode(nil, item)
+		}
+		data = append(data, item...)
+		index = append(index, entry(filenum, uint32(len(data)))...)
+	}
+	flush()
+	if err := os.WriteFile(filepath.Join(dir, name+"."+idx), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A LevelDB chaindata with a freezer serves frozen bor receipts of canonical
+// blocks from the freezer and everything else from the key-value store.
+func TestOpenChaindataLevelDBWithFreezer(t *testing.T) {
+	chain := newTestChain()
+	dataPath := t.TempDir()
+	dbPath := filepath.Join(dataPath, "bor", "chaindata")
+
+	ldb, err := leveldb.OpenFile(dbPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ldb.Put(borReceiptKey(50, chain.blockHash(50)), []byte("live"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ldb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks 2-5 are frozen, 0 and 1 were pruned from the freezer.
+	freezerDir := filepath.Join(dbPath, "ancient", "chain")
+	if err := os.MkdirAll(freezerDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var hashes, receipts [][]byte
+	for number := uint64(2); number <= 5; number++ {
+		hashes = append(hashes, chain.blockHash(number).Bytes())
+		receipts = append(receipts, []byte(fmt.Sprintf("frozen receipt %d", number)))
+	}
+	writeFreezerTable(t, freezerDir, freezerHashTable, false, 2, hashes)
+	writeFreezerTable(t, freezerDir, freezerBorReceiptTable, true, 2, receipts)
+
+	db, err := openChaindata(dataPath, openOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := db.(*freezerDatabase); !ok {
+		t.Fatalf("opened %T, want the freezer fallback", db)
+	}
+
+	tests := []struct {
+		name  string
+		key   []byte
+		value string
+	}{
+		{name: "first frozen item", key: borReceiptKey(2, chain.blockHash(2)), value: "frozen receipt 2"},
+		{name: "item starting a data file", key: borReceiptKey(4, chain.blockHash(4)), value: "frozen receipt 4"},
+		{name: "last frozen item", key: borReceiptKey(5, chain.blockHash(5)), value: "frozen receipt 5"},
+		{name: "frozen canonical hash", key: canonicalHashKey(3), value: string(chain.blockHash(3).Bytes())},
+		{name: "key-value store", key: borReceiptKey(50, chain.blockHash(50)), value: "live"},
+		{name: "non-canonical hash", key: borReceiptKey(3, chain.blockHash(30))},
+		{name: "pruned block", key: borReceiptKey(1, chain.blockHash(1))},
+		{name: "past the freezer", key: borReceiptKey(6, chain.blockHash(6))},
+	}
+	for _, test := range tests {
+		value, err := db.Get(test.key)
+		switch {
+		case test.value == "" && err != errNotFound:
+			t.Errorf("%s: got 0x%x (%v), want not found", test.name, value, err)
+		case test.value != "" && (err != nil || string(value) != test.value):
+			t.Errorf("%s: got %q (%v), want %q", test.name, value, err, test.value)
+		}
+	}
+	if _, err := keyValueStore(db).Get(borReceiptKey(2, chain.blockHash(2))); err != errNotFound {
+		t.Fatalf("key-value store served a frozen receipt: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// configPrefix is the geth prefix of the chain config, stored under the
+// genesis hash.
+var configPrefix = []byte("ethereum-config-")
+
+// canonicalHashKey is the geth key of the canonical hash of a block number.
+func canonicalHashKey(number uint64) []byte {
+	key := make([]byte, 0, 10)
+	key = append(key, 'h')
+	key = binary.BigEndian.AppendUint64(key, number)
+	return append(key, 'n')
+}
+
+// headerKey is the geth key of a block header.
+func headerKey(number uint64, hash common.Hash) []byte {
+	key := make([]byte, 0, 1+8+common.HashLength)
+	key = append(key, 'h')
+	key = binary.BigEndian.AppendUint64(key, number)
+	return append(key, hash.Bytes()...)
+}
+
+// chainIdentity is what tells two networks apart: the chain ID and the hash
+// of block 0.
+type chainIdentity struct {
+	ChainID uint64
+	Genesis common.Hash
+}
+
+// readChainIdentity reads the genesis hash and the chain ID of its chain
+// config from the chaindata.
+func readChainIdentity(db Database) (chainIdentity, error) {
+	genesis, err := db.Get(canonicalHashKey(0))
+	if err != nil {
+		return chainIdentity{}, fmt.Errorf("failed to read genesis hash: %w", err)
+	}
+	data, err := db.Get(append(append([]byte{}, configPrefix...), genesis...))
+	if err != nil {
+		return chainIdentity{}, fmt.Errorf("failed to read chain config of genesis 0x%x: %w", genesis, err)
+	}
+
+	var config struct {
+		ChainID *big.Int `json:"chainId"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return chainIdentity{}, fmt.Errorf("failed to parse chain config: %w", err)
+	}
+	if config.ChainID == nil {
+		return chainIdentity{}, fmt.Errorf("chain config has no chain ID")
+	}
+	return chainIdentity{ChainID: config.ChainID.Uint64(), Genesis: common.BytesToHash(genesis)}, nil
+}
+
+// remoteChainIdentity asks a node for its chain ID and block 0.
+func remoteChainIdentity(ctx context.Context, client *rpc.Client) (chainIdentity, error) {
+	var chainID hexutil.Uint64
+	if err := client.CallContext(ctx, &chainID, "eth_chainId"); err != nil {
+		return chainIdentity{}, fmt.Errorf("failed to get chain ID: %w", err)
+	}
+	var genesis *rpcHeader
+	if err := client.CallContext(ctx, &genesis, "eth_getBlockByNumber", hexutil.EncodeUint64(0), false); err != nil {
+		return chainIdentity{}, fmt.Errorf("failed to get genesis block: %w", err)
+	}
+	if genesis == nil {
+		return chainIdentity{}, fmt.Errorf("genesis block not found")
+	}
+	return chainIdentity{ChainID: uint64(chainID), Genesis: genesis.Hash}, nil
+}
+
+// refuseChain returns err, a mismatch between the chaindata and the data
+// checked against it, with the flag that overrides it, or only warns about it
+// when skip is set.
+func refuseChain(err error, skip bool) error {
+	if !skip {
+		return fmt.Errorf("%w (use --skip-chain-check to override)", err)
+	}
+	out.Warnf("%v, overridden by --skip-chain-check", err)
+	return nil
+}
+
+// checkRemoteChain refuses to patch db with data from a node of another
+// network, unless skip is set.
+func checkRemoteChain(ctx context.Context, db Database, remoteRPC string, skip bool) error {
+	client, err := rpc.DialContext(ctx, remoteRPC)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RPC %s: %w", remoteRPC, err)
+	}
+	defer client.Close()
+
+	remote, err := remoteChainIdentity(ctx, client)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remoteRPC, err)
+	}
+	return checkLocalChain(db, remote, remoteRPC, skip)
+}
+
+// checkLocalChain compares the chain of db with want, which describes source,
+// and refuses a mismatch unless skip is set. A zero genesis in want is not
+// compared.
+func checkLocalChain(db Database, want chainIdentity, source string, skip bool) error {
+	local, err := readChainIdentity(db)
+	if err != nil {
+		return fmt.Errorf("cannot check the chain of %s against the chaindata: %w", source, err)
+	}
+	if local.ChainID != want.ChainID {
+		return refuseChain(fmt.Errorf("%s is chain %d but the chaindata is chain %d", source, want.ChainID, local.ChainID), skip)
+	}
+	if want.Genesis != (common.Hash{}) && local.Genesis != want.Genesis {
+		return refuseChain(fmt.Errorf("%s has genesis %s but the chaindata has genesis %s", source, want.Genesis.Hex(), local.Genesis.Hex()), skip)
+	}
+	return nil
+}
+
+// checkInstructionChain refuses an instruction file made for another chain
+// than the one of db. Files of the original JSON array format have no header
+// and are refused too. skip overrides both.
+func checkInstructionChain(db Database, txFile string, header *instructionHeader, skip bool) error {
+	if header == nil {
+		return refuseChain(fmt.Errorf("%s has no header, so the network it was made for cannot be checked", txFile), skip)
+	}
+	return checkLocalChain(db, chainIdentity{ChainID: header.ChainID, Genesis: header.GenesisHash}, txFile, skip)
+}
+
+// checkCanonical makes sure every bor receipt among changes is keyed by the
+// block hash the chaindata holds as canonical for its number, unless skip is
+// set. A receipt written under any other hash would never be read by the
+// node.
+func checkCanonical(db Database, changes []keyChange, skip bool) error {
+	var (
+		first   error
+		invalid int
+	)
+	for _, change := range changes {
+		number, hash, ok := decodeBorReceiptKey(change.Key)
+		if !ok || change.Delete {
+			continue
+		}
+		canonical, err := db.Get(canonicalHashKey(number))
+		switch {
+		case err == errNotFound:
+			err = fmt.Errorf("block %d is not in the local chain", number)
+		case err != nil:
+			return fmt.Errorf("failed to read canonical hash of block %d: %w", number, err)
+		case common.BytesToHash(canonical) != hash:
+			err = fmt.Errorf("bor receipt for block %d is keyed by %s but the canonical hash is 0x%x", number, hash.Hex(), canonical)
+		}
+		if err != nil {
+			invalid++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if invalid == 1 {
+		return refuseChain(first, skip)
+	}
+	if invalid > 1 {
+		return refuseChain(fmt.Errorf("%d bor receipts are not for canonical blocks, first: %w", invalid, first), skip)
+	}
+	return nil
+}
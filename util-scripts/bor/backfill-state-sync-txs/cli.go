@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// Exit codes of the CLI.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// runFunc runs a command once its flags are parsed. The result is printed as
+// JSON on stdout when --json is given.
+type runFunc func(ctx context.Context) (interface{}, error)
+
+// command is one subcommand. setup registers its flags on fs and returns the
+// function that runs it.
+type command struct {
+	name    string
+	summary string
+	setup   func(fs *flag.FlagSet, shared *sharedFlags) runFunc
+}
+
+// sharedFlags holds the flags that mean the same thing on every command that
+// takes them.
+type sharedFlags struct {
+	dataPath       string
+	force          bool
+	skipChainCheck bool
+	remoteRPC      string
+
+	// Output flags, accepted before or after the command name.
+	json        bool
+	quiet       bool
+	verbose     bool
+	metricsAddr string
+}
+
+// output registers --json, --quiet, --verbose and --metrics-addr, defaulting
+// to what was given before the command name.
+func (s *sharedFlags) output(fs *flag.FlagSet) {
+	fs.BoolVar(&s.json, "json", s.json, "Print the result as JSON on stdout, with all other output on stderr")
+	fs.BoolVar(&s.quiet, "quiet", s.quiet, "Only print warnings and the outcome of the command, no progress")
+	fs.BoolVar(&s.verbose, "verbose", s.verbose, "Also print the detail of every window")
+	fs.StringVar(&s.metricsAddr, "metrics-addr", s.metricsAddr, "Serve Prometheus metrics on this address, e.g. 127.0.0.1:9100")
+}
+
+// chaindata registers --data-path and --force.
+func (s *sharedFlags) chaindata(fs *flag.FlagSet, usage string) {
+	fs.StringVar(&s.dataPath, "data-path", "", usage)
+	fs.BoolVar(&s.force, "force", false, "Open the chaindata even if a running bor node or a held LOCK file is detected")
+}
+
+// chainCheck registers --skip-chain-check.
+func (s *sharedFlags) chainCheck(fs *flag.FlagSet) {
+	fs.BoolVar(&s.skipChainCheck, "skip-chain-check", false, "Go on when the chain ID, genesis or canonical blocks of the data do not match the chaindata, or an instruction file has no header to check")
+}
+
+// remote registers --remote-rpc.
+func (s *sharedFlags) remote(fs *flag.FlagSet, usage string) {
+	fs.StringVar(&s.remoteRPC, "remote-rpc", "", usage)
+}
+
+// usageError is returned by a command whose flags are incomplete or
+// inconsistent. It exits with exitUsage after printing the command's help.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...interface{}) error {
+	return usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// required returns a usageError naming the first of the given string flags
+// that was left empty.
+func required(fs *flag.FlagSet, names ...string) error {
+	for _, name := range names {
+		if fs.Lookup(name).Value.String() == "" {
+			return usagef("--%s is required", name)
+		}
+	}
+	return nil
+}
+
+func commandByName(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [--json] [--quiet|--verbose] [--metrics-addr addr] <command> [flags]\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(tw, "  help\tShow help for a command\n")
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun '%s help <command>' for the flags of a command.\n", os.Args[0])
+}
+
+// newCommandFlags builds the flag set of cmd with the output flags registered
+// next to the command's own flags.
+func newCommandFlags(cmd command, shared *sharedFlags) (*flag.FlagSet, runFunc) {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	shared.output(fs)
+	run := cmd.setup(fs, shared)
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "Usage: %s %s [flags]\n\n%s\n\nFlags:\n", os.Args[0], cmd.name, cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs, run
+}
+
+// run executes the command line and returns the process exit code.
+func run(args []string) int {
+	global := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	shared := &sharedFlags{}
+	shared.output(global)
+	global.Usage = func() { printUsage(global.Output()) }
+	if err := global.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	args = global.Args()
+
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+	if args[0] == "help" {
+		if len(args) == 1 {
+			printUsage(os.Stdout)
+			return exitOK
+		}
+		cmd, ok := commandByName(args[1])
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[1])
+			printUsage(os.Stderr)
+			return exitUsage
+		}
+		fs, _ := newCommandFlags(cmd, &sharedFlags{})
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+		return exitOK
+	}
+
+	cmd, ok := commandByName(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+
+	fs, runCmd := newCommandFlags(cmd, shared)
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s: unexpected arguments: %s\n\n", cmd.name, strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return exitUsage
+	}
+	if shared.quiet && shared.verbose {
+		fmt.Fprintf(os.Stderr, "%s: --quiet and --verbose cannot be combined\n\n", cmd.name)
+		fs.Usage()
+		return exitUsage
+	}
+	out.setJSON(shared.json)
+	switch {
+	case shared.quiet:
+		out.setLevel(levelWarn)
+	case shared.verbose:
+		out.setLevel(levelDebug)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if shared.metricsAddr != "" {
+		if err := serveMetrics(ctx, shared.metricsAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %v\n", cmd.name, err)
+			return exitFailure
+		}
+	}
+
+	result, err := runCmd(ctx)
+	var uerr usageError
+	if errors.As(err, &uerr) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n\n", cmd.name, err)
+		fs.Usage()
+		return exitUsage
+	}
+	out.Result(result, err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", cmd.name, err)
+		return exitFailure
+	}
+	return exitOK
+}
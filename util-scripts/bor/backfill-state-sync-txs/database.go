@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/syndtr/goleveldb/leveldb"
+	leveldberrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// errNotFound is returned by Database.Get for keys that are in neither the
+// key-value store nor the freezer, whatever the engine behind it.
+var errNotFound = errors.New("not found")
+
+// Database is the view of a bor chaindata directory that every subcommand
+// works against. Reads fall back to the freezer for frozen blocks, while
+// writes only ever touch the key-value store.
+type Database interface {
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// NewBatch returns a batch whose Commit applies all its writes atomically
+	// and durably.
+	NewBatch() Batch
+	// NewIterator walks the key-value store over [lower, upper). A nil upper
+	// bound iterates to the end.
+	NewIterator(lower, upper []byte) Iterator
+	Close() error
+}
+
+type Batch interface {
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Commit() error
+	Close() error
+}
+
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Close() error
+}
+
+// Storage engines as detected by detectEngine.
+const (
+	enginePebble  = "pebble"
+	engineLevelDB = "leveldb"
+)
+
+// chaindataFS is the filesystem chaindata is looked up and opened on with
+// Pebble. Tests replace it with an in-memory vfs.NewMem.
+var chaindataFS = vfs.Default
+
+// detectEngine tells a Pebble directory from a LevelDB one the same way geth
+// does: both have a CURRENT file, only Pebble writes OPTIONS files.
+func detectEngine(dbPath string) (string, error) {
+	if _, err := chaindataFS.Stat(filepath.Join(dbPath, "CURRENT")); err != nil {
+		return "", fmt.Errorf("no chaindata found at %s: %w", dbPath, err)
+	}
+	names, err := chaindataFS.List(dbPath)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "OPTIONS") {
+			return enginePebble, nil
+		}
+	}
+	return engineLevelDB, nil
+}
+
+// openOptions controls how openChaindata opens the database.
+type openOptions struct {
+	// readOnly opens the engine read-only, for commands that never write.
+	readOnly bool
+	// force skips the running-node and lock checks of ensureNotLive.
+	force bool
+}
+
+// openChaindata opens the chaindata under the data directory with whichever
+// engine created it, together with its freezer when there is one. It refuses
+// to open a database that a running bor node may be using.
+func openChaindata(dataPath string, opts openOptions) (Database, error) {
+	dbPath := filepath.Join(dataPath, "bor", "chaindata")
+	engine, err := detectEngine(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureNotLive(dbPath, opts.force); err != nil {
+		return nil, err
+	}
+
+	var kv Database
+	switch engine {
+	case enginePebble:
+		db, err := pebble.Open(dbPath, &pebble.Options{ReadOnly: opts.readOnly, FS: chaindataFS})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open Pebble DB at %s: %w", dbPath, err)
+		}
+		kv = &pebbleDatabase{db: db}
+	case engineLevelDB:
+		db, err := leveldb.OpenFile(dbPath, &opt.Options{ReadOnly: opts.readOnly})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open LevelDB at %s: %w", dbPath, err)
+		}
+		kv = &levelDBDatabase{db: db}
+	}
+
+	ancient, err := openFreezer(filepath.Join(dbPath, "ancient"))
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	if ancient == nil {
+		return kv, nil
+	}
+	return &freezerDatabase{Database: kv, ancient: ancient}, nil
+}
+
+// pebbleDatabase implements Database on a Pebble store.
+type pebbleDatabase struct {
+	db *pebble.DB
+}
+
+func (d *pebbleDatabase) Get(key []byte) ([]byte, error) {
+	dat, closer, err := d.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, len(dat))
+	copy(ret, dat)
+	if err = closer.Close(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (d *pebbleDatabase) Put(key []byte, value []byte) error {
+	return d.db.Set(key, value, pebble.Sync)
+}
+
+func (d *pebbleDatabase) Delete(key []byte) error {
+	return d.db.Delete(key, pebble.Sync)
+}
+
+func (d *pebbleDatabase) NewBatch() Batch {
+	return &pebbleBatch{b: d.db.NewBatch()}
+}
+
+func (d *pebbleDatabase) NewIterator(lower, upper []byte) Iterator {
+	iter, err := d.db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	return &pebbleIterator{iter: iter, err: err}
+}
+
+func (d *pebbleDatabase) Close() error {
+	return d.db.Close()
+}
+
+type pebbleBatch struct {
+	b *pebble.Batch
+}
+
+func (b *pebbleBatch) Put(key []byte, value []byte) error { return b.b.Set(key, value, nil) }
+func (b *pebbleBatch) Delete(key []byte) error            { return b.b.Delete(key, nil) }
+func (b *pebbleBatch) Commit() error                      { return b.b.Commit(pebble.Sync) }
+func (b *pebbleBatch) Close() error                       { return b.b.Close() }
+
+type pebbleIterator struct {
+	iter    *pebble.Iterator
+	err     error
+	started bool
+}
+
+func (it *pebbleIterator) Next() bool {
+	if it.iter == nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		return it.iter.First()
+	}
+	return it.iter.Next()
+}
+
+func (it *pebbleIterator) Key() []byte   { return it.iter.Key() }
+func (it *pebbleIterator) Value() []byte { return it.iter.Value() }
+
+func (it *pebbleIterator) Error() error {
+	if it.err != nil || it.iter == nil {
+		return it.err
+	}
+	return it.iter.Error()
+}
+
+func (it *pebbleIterator) Close() error {
+	if it.iter == nil {
+		return nil
+	}
+	return it.iter.Close()
+}
+
+// levelDBDatabase implements Database on a LevelDB store, as still used by
+// older archive nodes.
+type levelDBDatabase struct {
+	db *leveldb.DB
+}
+
+var syncWrite = &opt.WriteOptions{Sync: true}
+
+func (d *levelDBDatabase) Get(key []byte) ([]byte, error) {
+	dat, err := d.db.Get(key, nil)
+	if err == leveldberrors.ErrNotFound {
+		return nil, errNotFound
+	}
+	return dat, err
+}
+
+func (d *levelDBDatabase) Put(key []byte, value []byte) error {
+	return d.db.Put(key, value, syncWrite)
+}
+
+func (d *levelDBDatabase) Delete(key []byte) error {
+	return d.db.Delete(key, syncWrite)
+}
+
+func (d *levelDBDatabase) NewBatch() Batch {
+	return &levelDBBatch{db: d.db, b: new(leveldb.Batch)}
+}
+
+func (d *levelDBDatabase) NewIterator(lower, upper []byte) Iterator {
+	return &levelDBIterator{iter: d.db.NewIterator(&util.Range{Start: lower, Limit: upper}, nil)}
+}
+
+func (d *levelDBDatabase) Close() error {
+	return d.db.Close()
+}
+
+type levelDBBatch struct {
+	db *leveldb.DB
+	b  *leveldb.Batch
+}
+
+func (b *levelDBBatch) Put(key []byte, value []byte) error { b.b.Put(key, value); return nil }
+func (b *levelDBBatch) Delete(key []byte) error            { b.b.Delete(key); return nil }
+func (b *levelDBBatch) Commit() error                      { return b.db.Write(b.b, syncWrite) }
+func (b *levelDBBatch) Close() error                       { b.b.Reset(); return nil }
+
+type levelDBIterator struct {
+	iter iterator.Iterator
+}
+
+func (it *levelDBIterator) Next() bool    { return it.iter.Next() }
+func (it *levelDBIterator) Key() []byte   { return it.iter.Key() }
+func (it *levelDBIterator) Value() []byte { return it.iter.Value() }
+func (it *levelDBIterator) Error() error  { return it.iter.Error() }
+func (it *levelDBIterator) Close() error  { it.iter.Release(); return nil }
+
+// freezerDatabase serves keys of frozen blocks from the ancient store when
+// the key-value store no longer has them. The freezer is never written.
+type freezerDatabase struct {
+	Database
+	ancient *freezer
+}
+
+func (d *freezerDatabase) Get(key []byte) ([]byte, error) {
+	value, err := d.Database.Get(key)
+	if err != errNotFound {
+		return value, err
+	}
+	return d.ancient.get(key)
+}
+
+func (d *freezerDatabase) Close() error {
+	d.ancient.close()
+	return d.Database.Close()
+}
+
+// keyValueStore strips the freezer fallback off db, for callers that need to
+// know what the key-value store itself holds.
+func keyValueStore(db Database) Database {
+	if f, ok := db.(*freezerDatabase); ok {
+		return f.Database
+	}
+	return db
+}
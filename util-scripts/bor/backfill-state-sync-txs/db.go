@@ -1,35 +1,161 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"os"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
-// WriteMissingStateSyncTransactions reads the missing StateSyncTxs from file and write on the data path
-func WriteMissingStateSyncTransactions(dataPath string, txFile string) {
-	// Open the file for reading
-	file, err := os.Open(txFile)
+// writeResult is the outcome of a write-missing-state-sync-tx run. JournalFile
+// is empty when nothing was journaled.
+type writeResult struct {
+	changeSummary
+	JournalFile string `json:"journalFile,omitempty"`
+	DryRun      bool   `json:"dryRun"`
+}
+
+// writeChunkSize is the number of instructions write-missing-state-sync-tx
+// decodes and stages at a time.
+var writeChunkSize = 10000
+
+// WriteMissingStateSyncTransactions reads the missing StateSyncTxs from file and writes them on the
+// data path in a single batch, committed once the whole file is staged, so that an interrupted write
+// leaves the DB untouched. The previous state of every key is journaled to journalFile, which is
+// synced before the batch is committed (see RollbackJournal). With chunkSize, every chunkSize
+// instructions are committed in a batch of their own instead, and an interrupted write has to be
+// rolled back with the journal. With dryRun the changes are only printed. Nothing is written unless
+// the file, and remoteRPC when given, are of the chain of the chaindata and every bor receipt in the
+// file is keyed by a canonical block, unless skipChainCheck is set.
+func WriteMissingStateSyncTransactions(ctx context.Context, dataPath, txFile, journalFile, remoteRPC string, chunkSize int, dryRun, force, skipChainCheck bool) (*writeResult, error) {
+	if journalFile == "" {
+		journalFile = txFile + ".journal"
+	}
+
+	db, err := openChaindata(dataPath, openOptions{readOnly: dryRun, force: force})
 	if err != nil {
-		fmt.Errorf("failed to open file %s: %w", txFile, err)
+		return nil, err
 	}
-	defer file.Close()
+	defer db.Close()
 
-	// Read all bytes from the file
-	data, err := io.ReadAll(file)
+	// Check the whole file before the first batch, so a bad instruction or a
+	// non-canonical receipt aborts before the DB is touched. The file is read
+	// twice rather than held in memory.
+	count := 0
+	err = readInstructionChunks(txFile, writeChunkSize, func(header *instructionHeader) error {
+		if err := checkInstructionChain(db, txFile, header, skipChainCheck); err != nil {
+			return err
+		}
+		if header != nil && header.ApproximateReceipts {
+			out.Warnf("%s holds approximate bor receipts rebuilt from Heimdall, which may differ from the canonical ones", txFile)
+		}
+		if remoteRPC != "" {
+			return checkRemoteChain(ctx, db, remoteRPC, skipChainCheck)
+		}
+		return nil
+	}, func(changes []keyChange) error {
+		count += len(changes)
+		return checkCanonical(db, changes, skipChainCheck)
+	})
 	if err != nil {
-		fmt.Errorf("failed to read file %s: %w", txFile, err)
+		return nil, err
 	}
+	out.Infof("Found %d instructions to write on db", count)
 
-	// Unmarshal JSON into the same struct type
-	var instructions []WriteInstruction
-	if err := json.Unmarshal(data, &instructions); err != nil {
-		fmt.Errorf("failed to unmarshal JSON: %w", err)
+	w := newChangeWriter(db, dataPath, journalFile, txFile, dryRun)
+	defer w.close()
+	if err := writeInstructions(w, txFile, chunkSize); err != nil {
+		if w.committed > 0 {
+			out.Warnf("The write stopped part way, roll back %s to undo the chunks already applied", journalFile)
+		}
+		return nil, err
 	}
 
-	fmt.Printf("Found %d instructions to write on db", len(instructions))
-	for _, instruction := range instructions {
-		DebugWriteKey(dataPath, instruction.Key, instruction.Value)
+	return reportWrite(w.summary, journalFile, dryRun), nil
+}
+
+// writeInstructions stages the instructions of txFile on w, writeChunkSize at
+// a time, and commits them in one batch, or every chunkSize of them when it is
+// not zero.
+func writeInstructions(w *changeWriter, txFile string, chunkSize int) error {
+	size := writeChunkSize
+	if chunkSize > 0 {
+		size = chunkSize
+	}
+	err := readInstructionChunks(txFile, size, nil, func(changes []keyChange) error {
+		if err := w.stage(changes); err != nil {
+			return err
+		}
+		if chunkSize > 0 {
+			return w.commit()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.commit()
+}
+
+// readInstructionChunks decodes the instructions of txFile into changes and
+// calls fn with every size of them, after calling checkHeader, when given,
+// with the file's header.
+func readInstructionChunks(txFile string, size int, checkHeader func(*instructionHeader) error, fn func([]keyChange) error) error {
+	reader, err := openInstructionReader(txFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if checkHeader != nil {
+		if err := checkHeader(reader.Header()); err != nil {
+			return err
+		}
+	}
+
+	changes := make([]keyChange, 0, size)
+	for index := 0; ; index++ {
+		instruction, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key, err := hexutil.Decode(instruction.Key)
+		if err != nil {
+			return fmt.Errorf("instruction %d: invalid hex key %s: %w", index, instruction.Key, err)
+		}
+		value, err := hexutil.Decode(instruction.Value)
+		if err != nil {
+			return fmt.Errorf("instruction %d: invalid hex value for key %s: %w", index, instruction.Key, err)
+		}
+		changes = append(changes, keyChange{Key: key, Value: value})
+		if len(changes) == size {
+			if err := fn(changes); err != nil {
+				return err
+			}
+			changes = changes[:0]
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return fn(changes)
+}
+
+// reportWrite prints the outcome of applyChanges and returns it as a result.
+func reportWrite(summary changeSummary, journalFile string, dryRun bool) *writeResult {
+	result := &writeResult{changeSummary: summary, DryRun: dryRun}
+	if dryRun {
+		out.Printf("Dry run: would create %d keys, overwrite %d, delete %d, leave %d unchanged\n", summary.Created, summary.Overwritten, summary.Deleted, summary.Unchanged)
+		return result
+	}
+	out.Printf("Created %d keys, overwrote %d, deleted %d, left %d unchanged\n", summary.Created, summary.Overwritten, summary.Deleted, summary.Unchanged)
+	if summary.Created+summary.Overwritten+summary.Deleted > 0 {
+		out.Printf("Previous values journaled to %s\n", journalFile)
+		result.JournalFile = journalFile
 	}
+	return result
 }
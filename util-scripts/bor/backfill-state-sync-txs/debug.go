@@ -1,24 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"log"
-	"path/filepath"
+	"math/big"
+	"strings"
 
-	"github.com/cockroachdb/pebble"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
-type ReceiptJustLogs struct {
-	Logs []*types.Log `json:"logs"              gencodec:"required"`
-}
-
 var (
 	borTxLookupPrefix = []byte(borTxLookupPrefixStr)
 	borReceiptPrefix  = []byte("matic-bor-receipt-") // borReceiptPrefix + number + block hash -> bor block receipt
@@ -29,190 +27,241 @@ const (
 	borTxLookupPrefixStr = "matic-bor-tx-lookup-"
 )
 
-// DebugEncodeBorReceiptKey encodes a bor receipt key for debugging (empty implementation)
-func DebugEncodeBorReceiptKey(number uint64, blockHashString string) string {
-	blockHashString = blockHashString[2:]
-	hash := common.HexToHash(blockHashString)
-	enc := make([]byte, 8)
-	binary.BigEndian.PutUint64(enc, number)
+// parseHex decodes hex given on the command line, with or without the 0x
+// prefix.
+func parseHex(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex %q: %w", s, err)
+	}
+	return b, nil
+}
+
+// parseHash decodes a 32-byte hash given on the command line. Unlike
+// common.HexToHash it refuses input of any other length instead of padding or
+// cutting it.
+func parseHash(s string) (common.Hash, error) {
+	b, err := parseHex(s)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if len(b) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("invalid hash %q: %d bytes, want %d", s, len(b), common.HashLength)
+	}
+	return common.BytesToHash(b), nil
+}
+
+// DebugEncodeBorReceiptKey prints the matic-bor-receipt- key of a block.
+func DebugEncodeBorReceiptKey(number uint64, blockHashString string) (string, error) {
+	hash, err := parseHash(blockHashString)
+	if err != nil {
+		return "", err
+	}
+	output := hexutil.Encode(borReceiptKey(number, hash))
+	out.Println(output)
+	return output, nil
+}
+
+// borReceiptKey returns the matic-bor-receipt- key of a block.
+func borReceiptKey(number uint64, hash common.Hash) []byte {
+	key := make([]byte, 0, len(borReceiptPrefix)+8+common.HashLength)
+	key = append(key, borReceiptPrefix...)
+	key = binary.BigEndian.AppendUint64(key, number)
+	return append(key, hash.Bytes()...)
+}
+
+// borTxLookupKey returns the matic-bor-tx-lookup- key of a state-sync tx.
+func borTxLookupKey(txHash common.Hash) []byte {
+	key := make([]byte, 0, len(borTxLookupPrefix)+common.HashLength)
+	key = append(key, borTxLookupPrefix...)
+	return append(key, txHash.Bytes()...)
+}
+
+// borTxLookupValue encodes a block number the way bor stores it in a tx
+// lookup entry.
+func borTxLookupValue(number uint64) []byte {
+	return new(big.Int).SetUint64(number).Bytes()
+}
 
-	bytesKey := append(append(borReceiptPrefix, enc...), hash.Bytes()...)
-	output := fmt.Sprintf("0x%s", common.Bytes2Hex(bytesKey))
-	fmt.Println(output)
-	return output
+// derivedBorTxHash is the hash bor gives the state-sync tx of a block: the
+// keccak256 of the block's bor receipt key.
+func derivedBorTxHash(number uint64, blockHash common.Hash) common.Hash {
+	return crypto.Keccak256Hash(borReceiptKey(number, blockHash))
+}
 
+// decodeBorReceiptKey splits a matic-bor-receipt- key into its block number and hash.
+func decodeBorReceiptKey(key []byte) (uint64, common.Hash, bool) {
+	if len(key) != len(borReceiptPrefix)+8+common.HashLength || !bytes.HasPrefix(key, borReceiptPrefix) {
+		return 0, common.Hash{}, false
+	}
+	rest := key[len(borReceiptPrefix):]
+	return binary.BigEndian.Uint64(rest[:8]), common.BytesToHash(rest[8:]), true
 }
 
-// DebugEncodeBorTxLookupEntry encodes a bor transaction lookup entry for debugging (empty implementation)
-func DebugEncodeBorTxLookupEntry(hashString string) string {
-	hashString = hashString[2:]
+// decodeBorTxLookupKey returns the tx hash of a matic-bor-tx-lookup- key.
+func decodeBorTxLookupKey(key []byte) (common.Hash, bool) {
+	if len(key) != len(borTxLookupPrefix)+common.HashLength || !bytes.HasPrefix(key, borTxLookupPrefix) {
+		return common.Hash{}, false
+	}
+	return common.BytesToHash(key[len(borTxLookupPrefix):]), true
+}
 
-	hash := common.HexToHash(hashString)
-	bytesKey := append(borTxLookupPrefix, hash.Bytes()...)
+// decodeBorTxLookupValue returns the block number stored in a tx lookup entry,
+// which bor writes as the minimal big-endian bytes of the number.
+func decodeBorTxLookupValue(value []byte) uint64 {
+	return new(big.Int).SetBytes(value).Uint64()
+}
 
-	output := fmt.Sprintf("0x%s", common.Bytes2Hex(bytesKey))
-	fmt.Println(output)
-	return output
+// DebugEncodeBorTxLookupEntry prints the matic-bor-tx-lookup- key of a
+// state-sync tx.
+func DebugEncodeBorTxLookupEntry(hashString string) (string, error) {
+	hash, err := parseHash(hashString)
+	if err != nil {
+		return "", err
+	}
+	output := hexutil.Encode(borTxLookupKey(hash))
+	out.Println(output)
+	return output, nil
 }
 
 // DebugEncodeBorReceiptValue queries the TX receipt by hash and hex encode it encodes the recept to byte value to be stored on db
-func DebugEncodeBorReceiptValue(hashString string, remoteRPCUrl string) string {
-	hashString = hashString[2:]
-	txHash := common.HexToHash(hashString)
+func DebugEncodeBorReceiptValue(hashString string, remoteRPCUrl string) (string, error) {
+	txHash, err := parseHash(hashString)
+	if err != nil {
+		return "", err
+	}
 
 	ctx := context.Background()
 	// Connect to the RPC server
 	client, err := rpc.DialContext(ctx, remoteRPCUrl)
 	if err != nil {
-		fmt.Printf("failed to connect to RPC %s: %w\n", remoteRPCUrl, err)
-		return ""
+		return "", fmt.Errorf("failed to connect to RPC %s: %w", remoteRPCUrl, err)
 	}
 	defer client.Close()
 
 	// Prepare the variable to hold the parsed receipt
-	var receiptJustLogs *ReceiptJustLogs
+	var receipt *rpcReceipt
 
 	// Call eth_getTransactionReceipt and unmarshal into the Receipt struct
-	err = client.CallContext(ctx, &receiptJustLogs, "eth_getTransactionReceipt", txHash)
+	err = client.CallContext(ctx, &receipt, "eth_getTransactionReceipt", txHash)
 	if err != nil {
-		fmt.Printf("failed to get receipt for %s: %w\n", txHash, err)
-		return ""
+		return "", fmt.Errorf("failed to get receipt for %s: %w", txHash, err)
+	}
+	if receipt == nil {
+		return "", fmt.Errorf("receipt for %s not found", txHash)
 	}
-	fmt.Printf("%d\n\n", len(receiptJustLogs.Logs))
+	out.Printf("%d\n\n", len(receipt.Logs))
 
-	bytes, err := rlp.EncodeToBytes(&types.ReceiptForStorage{
-		Status: types.ReceiptStatusSuccessful, // make receipt status successful
-		Logs:   receiptJustLogs.Logs,
-	})
+	bytes, err := encodeBorReceipt(receipt)
 	if err != nil {
-		fmt.Printf("Failed to encode bor receipt", "err", err)
+		return "", fmt.Errorf("failed to encode bor receipt for %s: %w", txHash, err)
 	}
 
 	output := fmt.Sprintf("0x%s", common.Bytes2Hex(bytes))
-	fmt.Printf("\n\nEncoded Bor Receipt:\n\n%s\n", output)
-	return output
+	out.Printf("\n\nEncoded Bor Receipt:\n\n%s\n", output)
+	return output, nil
 }
 
-// DebugDeleteKey deletes a key in the data store for debugging (empty implementation)
-func DebugDeleteKey(dataPath string, key string) {
-	key = key[2:]
+// encodeBorReceipt RLP-encodes a bor receipt in the layout stored under the
+// matic-bor-receipt- key, with the status, cumulative gas and logs of the
+// receipt it was given. Every command that writes a bor receipt encodes it
+// here, so they agree on the value for the same block.
+func encodeBorReceipt(receipt *rpcReceipt) ([]byte, error) {
+	return rlp.EncodeToBytes(&types.ReceiptForStorage{
+		Status:            uint64(receipt.Status),
+		CumulativeGasUsed: uint64(receipt.CumulativeGasUsed),
+		Logs:              receipt.Logs,
+	})
+}
 
-	// Path to Pebble database (chaindata) under the data directory
-	dbPath := filepath.Join(dataPath, "bor", "chaindata")
-	db, err := pebble.Open(dbPath, &pebble.Options{})
+// DebugDeleteKey deletes a key from the offline chaindata.
+func DebugDeleteKey(dataPath string, key string, force bool) error {
+	// Decode hex-encoded key
+	keyBytes, err := parseHex(key)
 	if err != nil {
-		log.Fatalf("Failed to open Pebble DB at %s: %v", dbPath, err)
+		return fmt.Errorf("invalid key: %w", err)
 	}
-	defer db.Close()
 
-	// Decode hex-encoded key
-	keyBytes, err := hex.DecodeString(key)
+	// Open the chaindata (Pebble or LevelDB) under the data directory
+	db, err := openChaindata(dataPath, openOptions{force: force})
 	if err != nil {
-		log.Fatalf("Invalid hex key %s: %v", key, err)
+		return err
 	}
+	defer db.Close()
 
-	// Read value
-	err = Delete(db, keyBytes)
-	if err != nil {
-		if err == pebble.ErrNotFound {
-			fmt.Printf("Key %s not found in database\n", key)
-			return
-		}
-		log.Fatalf("Error deleting key %s: %v", key, err)
+	// Delete value
+	if err := db.Delete(keyBytes); err != nil {
+		return fmt.Errorf("error deleting key %s: %w", key, err)
 	}
-	fmt.Printf("Successfully deleted the key\n")
+	out.Printf("Successfully deleted the key\n")
+	return nil
 }
 
-// DebugReadKey reads a key from the offline Pebble database.
-func DebugReadKey(dataPath string, key string) {
-	key = key[2:]
-
-	// Path to Pebble database (chaindata) under the data directory
-	dbPath := filepath.Join(dataPath, "bor", "chaindata")
-	db, err := pebble.Open(dbPath, &pebble.Options{})
+// DebugReadKey reads a key from the offline chaindata, falling back to the freezer.
+func DebugReadKey(dataPath string, key string, force bool) (string, error) {
+	// Decode hex-encoded key
+	keyBytes, err := parseHex(key)
 	if err != nil {
-		log.Fatalf("Failed to open Pebble DB at %s: %v", dbPath, err)
+		return "", fmt.Errorf("invalid key: %w", err)
 	}
-	defer db.Close()
 
-	// Decode hex-encoded key
-	keyBytes, err := hex.DecodeString(key)
+	// Open the chaindata (Pebble or LevelDB) under the data directory
+	db, err := openChaindata(dataPath, openOptions{readOnly: true, force: force})
 	if err != nil {
-		log.Fatalf("Invalid hex key %s: %v", key, err)
+		return "", err
 	}
+	defer db.Close()
 
 	// Read value
-	value, err := Get(db, keyBytes)
+	value, err := db.Get(keyBytes)
+	if err == errNotFound {
+		return "", fmt.Errorf("key %s not found in database", key)
+	}
 	if err != nil {
-		if err == pebble.ErrNotFound {
-			fmt.Printf("Key %s not found in database\n", key)
-			return
-		}
-		log.Fatalf("Error reading key %s: %v", key, err)
+		return "", fmt.Errorf("error reading key %s: %w", key, err)
 	}
 
 	// Print value in hex
-	fmt.Printf("\n\nValue found on key:\n0x%x\n", value)
+	output := fmt.Sprintf("0x%x", value)
+	out.Printf("\n\nValue found on key:\n%s\n", output)
+	return output, nil
 }
 
-func DebugWriteKey(dataPath string, key string, value string) {
-	key = key[2:]
-	value = value[2:]
-
-	// Path to Pebble database (chaindata) under the data directory
-	dbPath := filepath.Join(dataPath, "bor", "chaindata")
-	db, err := pebble.Open(dbPath, &pebble.Options{})
+// DebugWriteKey writes a single key to the offline chaindata. A value from
+// another network or a receipt of a non-canonical block is refused unless
+// skipChainCheck is set.
+func DebugWriteKey(ctx context.Context, dataPath string, key string, value string, remoteRPC string, force, skipChainCheck bool) error {
+	// Decode hex-encoded key and value
+	keyBytes, err := parseHex(key)
 	if err != nil {
-		log.Fatalf("Failed to open Pebble DB at %s: %v", dbPath, err)
+		return fmt.Errorf("invalid key: %w", err)
 	}
-	defer db.Close()
-
-	// Decode hex-encoded key
-	keyBytes, err := hex.DecodeString(key)
+	valueBytes, err := parseHex(value)
 	if err != nil {
-		log.Fatalf("Invalid hex key %s: %v", key, err)
+		return fmt.Errorf("invalid value: %w", err)
 	}
 
-	// Decode hex-encoded key
-	valueBytes, err := hex.DecodeString(value)
+	// Open the chaindata (Pebble or LevelDB) under the data directory
+	db, err := openChaindata(dataPath, openOptions{force: force})
 	if err != nil {
-		log.Fatalf("Invalid hex value %s: %v", key, err)
+		return err
 	}
+	defer db.Close()
 
-	// Read value
-	err = Put(db, keyBytes, valueBytes)
-	if err != nil {
-		if err == pebble.ErrNotFound {
-			fmt.Printf("Key %s not found in database\n", key)
-			return
+	// Refuse a value from another network or a receipt of a non-canonical block
+	if remoteRPC != "" {
+		if err := checkRemoteChain(ctx, db, remoteRPC, skipChainCheck); err != nil {
+			return err
 		}
-		log.Fatalf("Error reading key %s: %v", key, err)
 	}
-
-	// Print value in hex
-	fmt.Printf("Successfully write the key\n")
-}
-
-func Get(db *pebble.DB, key []byte) ([]byte, error) {
-	dat, closer, err := db.Get(key)
-	if err != nil {
-		return nil, err
+	if err := checkCanonical(db, []keyChange{{Key: keyBytes, Value: valueBytes}}, skipChainCheck); err != nil {
+		return err
 	}
 
-	ret := make([]byte, len(dat))
-	copy(ret, dat)
-	if err = closer.Close(); err != nil {
-		return nil, err
+	// Write value
+	if err := db.Put(keyBytes, valueBytes); err != nil {
+		return fmt.Errorf("error writing key %s: %w", key, err)
 	}
-	return ret, nil
-}
-
-// Put inserts the given value into the key-value store.
-func Put(db *pebble.DB, key []byte, value []byte) error {
-	return db.Set(key, value, pebble.Sync)
-}
-
-// Delete removes the key from the key-value store.
-func Delete(db *pebble.DB, key []byte) error {
-	return db.Delete(key, pebble.Sync)
+	out.Printf("Successfully write the key\n")
+	return nil
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// A state-sync block of Polygon mainnet and the hash bor gave its state-sync
+// tx, as served by eth_getTransactionReceiptsByBlock.
+var (
+	goldenNumber    = uint64(74667488)
+	goldenBlockHash = common.HexToHash("0x38623e33fa0f94dd9276b7d44ea589608085b56c8fc87950612562b09e18b896")
+	goldenTxHash    = common.HexToHash("0xc048ab4888a7d0c044b85e3371b775efbeb7a7b9d93a1d229ee1b039150c3289")
+)
+
+func TestBorReceiptKeyGolden(t *testing.T) {
+	want := "0x" +
+		"6d617469632d626f722d726563656970742d" + // matic-bor-receipt-
+		"00000000047355e0" + // 74667488, big-endian
+		"38623e33fa0f94dd9276b7d44ea589608085b56c8fc87950612562b09e18b896"
+
+	if got := hexutil.Encode(borReceiptKey(goldenNumber, goldenBlockHash)); got != want {
+		t.Fatalf("borReceiptKey = %s, want %s", got, want)
+	}
+	for _, hash := range []string{goldenBlockHash.Hex(), goldenBlockHash.Hex()[2:]} {
+		got, err := DebugEncodeBorReceiptKey(goldenNumber, hash)
+		if err != nil {
+			t.Fatalf("DebugEncodeBorReceiptKey(%s): %v", hash, err)
+		}
+		if got != want {
+			t.Fatalf("DebugEncodeBorReceiptKey(%s) = %s, want %s", hash, got, want)
+		}
+	}
+
+	number, hash, ok := decodeBorReceiptKey(hexutil.MustDecode(want))
+	if !ok || number != goldenNumber || hash != goldenBlockHash {
+		t.Fatalf("decodeBorReceiptKey = %d, %s, %v", number, hash.Hex(), ok)
+	}
+}
+
+func TestBorTxLookupKeyGolden(t *testing.T) {
+	want := "0x" +
+		"6d617469632d626f722d74782d6c6f6f6b75702d" + // matic-bor-tx-lookup-
+		"c048ab4888a7d0c044b85e3371b775efbeb7a7b9d93a1d229ee1b039150c3289"
+
+	if got := hexutil.Encode(borTxLookupKey(goldenTxHash)); got != want {
+		t.Fatalf("borTxLookupKey = %s, want %s", got, want)
+	}
+	got, err := DebugEncodeBorTxLookupEntry(goldenTxHash.Hex())
+	if err != nil {
+		t.Fatalf("DebugEncodeBorTxLookupEntry: %v", err)
+	}
+	if got != want {
+		t.Fatalf("DebugEncodeBorTxLookupEntry = %s, want %s", got, want)
+	}
+
+	hash, ok := decodeBorTxLookupKey(hexutil.MustDecode(want))
+	if !ok || hash != goldenTxHash {
+		t.Fatalf("decodeBorTxLookupKey = %s, %v", hash.Hex(), ok)
+	}
+}
+
+func TestDerivedBorTxHashGolden(t *testing.T) {
+	if got := derivedBorTxHash(goldenNumber, goldenBlockHash); got != goldenTxHash {
+		t.Fatalf("derivedBorTxHash = %s, want %s", got.Hex(), goldenTxHash.Hex())
+	}
+}
+
+func TestDebugEncodeRejectsInvalidHashes(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"0x",
+		"0x1234",
+		"0xzz623e33fa0f94dd9276b7d44ea589608085b56c8fc87950612562b09e18b896",
+		goldenBlockHash.Hex() + "00",
+	} {
+		if key, err := DebugEncodeBorReceiptKey(goldenNumber, hash); err == nil {
+			t.Errorf("DebugEncodeBorReceiptKey(%q) = %s, want an error", hash, key)
+		}
+		if key, err := DebugEncodeBorTxLookupEntry(hash); err == nil {
+			t.Errorf("DebugEncodeBorTxLookupEntry(%q) = %s, want an error", hash, key)
+		}
+	}
+}
+
+// The bor receipt key follows the layout of geth's block receipts key, with
+// the number and hash behind its own prefix.
+func TestBorReceiptKeyMatchesGethLayout(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	rawdb.WriteReceipts(db, goldenBlockHash, goldenNumber, types.Receipts{})
+
+	var gethKey []byte
+	it := db.NewIterator([]byte("r"), nil)
+	for it.Next() {
+		gethKey = common.CopyBytes(it.Key())
+	}
+	it.Release()
+	if gethKey == nil {
+		t.Fatal("geth wrote no receipts key")
+	}
+
+	key := borReceiptKey(goldenNumber, goldenBlockHash)
+	if !bytes.Equal(key[len(borReceiptPrefix):], gethKey[1:]) {
+		t.Fatalf("bor receipt key suffix %x differs from geth's %x", key[len(borReceiptPrefix):], gethKey[1:])
+	}
+}
+
+// bor stores the block number of a tx lookup entry the way geth does: as the
+// minimal big-endian bytes of a big.Int.
+func TestBorTxLookupValueMatchesGeth(t *testing.T) {
+	for _, number := range []uint64{0, 1, 255, 256, goldenNumber, 1<<64 - 1} {
+		db := rawdb.NewMemoryDatabase()
+		rawdb.WriteTxLookupEntries(db, number, []common.Hash{goldenTxHash})
+		it := db.NewIterator([]byte("l"), nil)
+		if !it.Next() {
+			t.Fatalf("geth wrote no tx lookup entry for block %d", number)
+		}
+		gethValue := common.CopyBytes(it.Value())
+		it.Release()
+
+		value := borTxLookupValue(number)
+		if !bytes.Equal(value, gethValue) {
+			t.Errorf("borTxLookupValue(%d) = %x, geth writes %x", number, value, gethValue)
+		}
+		if !bytes.Equal(value, new(big.Int).SetUint64(number).Bytes()) {
+			t.Errorf("borTxLookupValue(%d) = %x is not big.Int bytes", number, value)
+		}
+		if got := decodeBorTxLookupValue(value); got != number {
+			t.Errorf("decodeBorTxLookupValue(%x) = %d, want %d", value, got, number)
+		}
+	}
+}
+
+func TestEncodeBorReceipt(t *testing.T) {
+	logs := []*types.Log{{
+		Address: stateReceiverAddress,
+		Topics:  []common.Hash{stateCommittedTopic, common.BigToHash(big.NewInt(42)), {}},
+		Data:    []byte{1, 2, 3},
+	}}
+	// The status and cumulative gas are those of the source receipt, so a
+	// reverted state sync is stored as reverted.
+	for _, status := range []uint64{types.ReceiptStatusSuccessful, types.ReceiptStatusFailed} {
+		value, err := encodeBorReceipt(&rpcReceipt{Status: hexutil.Uint64(status), CumulativeGasUsed: 21000, Logs: logs})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var receipt types.ReceiptForStorage
+		if err := rlp.DecodeBytes(value, &receipt); err != nil {
+			t.Fatalf("bor receipt does not decode as ReceiptForStorage: %v", err)
+		}
+		if receipt.Status != status || receipt.CumulativeGasUsed != 21000 {
+			t.Errorf("status %d and cumulative gas %d, want %d and 21000", receipt.Status, receipt.CumulativeGasUsed, status)
+		}
+		if len(receipt.Logs) != 1 || receipt.Logs[0].Address != stateReceiverAddress || !bytes.Equal(receipt.Logs[0].Data, logs[0].Data) {
+			t.Fatalf("logs did not round-trip: %+v", receipt.Logs)
+		}
+		if id, ok := stateIDOf(receipt.Logs[0]); !ok || id != 42 {
+			t.Errorf("stateIDOf = %d, %v, want 42", id, ok)
+		}
+	}
+}
+
+// ethdbDatabase adapts a geth key-value store to Database, so what geth's
+// rawdb writes can be read back through the tool.
+type ethdbDatabase struct {
+	ethdb.KeyValueStore
+}
+
+func (d ethdbDatabase) Get(key []byte) ([]byte, error) {
+	if ok, _ := d.KeyValueStore.Has(key); !ok {
+		return nil, errNotFound
+	}
+	return d.KeyValueStore.Get(key)
+}
+
+func (d ethdbDatabase) NewBatch() Batch                          { panic("not used") }
+func (d ethdbDatabase) NewIterator(lower, upper []byte) Iterator { panic("not used") }
+
+func TestReadChainIdentityFromGethSchema(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	genesis := common.HexToHash("0xa9c28ce2141b56c474f1dc504bee9b01eb1bd7d1a507580d5519d4437a97de1b")
+	rawdb.WriteCanonicalHash(db, genesis, 0)
+	rawdb.WriteCanonicalHash(db, goldenBlockHash, goldenNumber)
+	rawdb.WriteChainConfig(db, genesis, &params.ChainConfig{ChainID: big.NewInt(137)})
+
+	chain, err := readChainIdentity(ethdbDatabase{db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain.ChainID != 137 || chain.Genesis != genesis {
+		t.Fatalf("readChainIdentity = %+v", chain)
+	}
+
+	receipt := keyChange{Key: borReceiptKey(goldenNumber, goldenBlockHash), Value: []byte{0xc0}}
+	if err := checkCanonical(ethdbDatabase{db}, []keyChange{receipt}, false); err != nil {
+		t.Fatalf("checkCanonical refused the canonical block: %v", err)
+	}
+	receipt.Key = borReceiptKey(goldenNumber, genesis)
+	if err := checkCanonical(ethdbDatabase{db}, []keyChange{receipt}, false); err == nil {
+		t.Fatal("checkCanonical accepted a receipt keyed by a non-canonical hash")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Kinds of difference diff-state-sync reports for a state ID.
+const (
+	diffMissing = "missing" // on the source only
+	diffExtra   = "extra"   // on the target only
+	diffMoved   = "moved"   // in a different block or at a different tx index
+)
+
+// stateSyncLocation is where a node placed a state sync.
+type stateSyncLocation struct {
+	Block     uint64      `json:"block"`
+	BlockHash common.Hash `json:"blockHash"`
+	TxHash    common.Hash `json:"txHash"`
+	TxIndex   uint        `json:"txIndex"`
+}
+
+// stateSyncDiff is one state ID the two nodes disagree on.
+type stateSyncDiff struct {
+	StateID uint64             `json:"stateId"`
+	Kind    string             `json:"kind"`
+	Source  *stateSyncLocation `json:"source,omitempty"`
+	Target  *stateSyncLocation `json:"target,omitempty"`
+}
+
+// diffReport is the document diff-state-sync writes. Blocks can be passed to
+// find-all-state-sync-tx with --diff-file to rebuild just those blocks.
+type diffReport struct {
+	SourceRPC  string          `json:"sourceRpc"`
+	TargetRPC  string          `json:"targetRpc"`
+	StartBlock uint64          `json:"startBlock"`
+	EndBlock   uint64          `json:"endBlock"`
+	Source     int             `json:"source"`
+	Target     int             `json:"target"`
+	Diffs      []stateSyncDiff `json:"diffs"`
+
+	// Blocks lists the source blocks of every missing or moved state sync.
+	Blocks []uint64 `json:"blocks"`
+}
+
+// DiffOptions configures a diff-state-sync run.
+type DiffOptions struct {
+	SourceRPC   string
+	TargetRPC   string
+	StartBlock  uint64
+	EndBlock    uint64
+	Interval    uint64
+	OutputFile  string
+	Concurrency int
+	// RateLimit caps the requests per second sent to each endpoint.
+	RateLimit float64
+}
+
+// diffWindowResult holds the state syncs both nodes have in one window, by
+// state ID.
+type diffWindowResult struct {
+	scanWindow
+	source, target map[uint64]stateSyncLocation
+	err            error
+}
+
+// stateSyncsByID indexes StateCommitted logs by their state ID.
+func stateSyncsByID(logs []types.Log) map[uint64]stateSyncLocation {
+	byID := make(map[uint64]stateSyncLocation, len(logs))
+	for i := range logs {
+		id, ok := stateIDOf(&logs[i])
+		if !ok {
+			continue
+		}
+		byID[id] = stateSyncLocation{
+			Block:     logs[i].BlockNumber,
+			BlockHash: logs[i].BlockHash,
+			TxHash:    logs[i].TxHash,
+			TxIndex:   logs[i].TxIndex,
+		}
+	}
+	return byID
+}
+
+// DiffStateSyncs pulls the StateCommitted logs of [StartBlock, EndBlock] from
+// both nodes in windows that start at Interval blocks and then follow the
+// narrower of the two eth_getLogs ranges, and reports every state ID that the
+// target is missing, has in addition, or holds in a different place. The
+// report is written to OutputFile.
+func DiffStateSyncs(ctx context.Context, opts DiffOptions) (*diffReport, error) {
+	if opts.Interval == 0 {
+		return nil, fmt.Errorf("interval must be greater than zero")
+	}
+	if opts.StartBlock > opts.EndBlock {
+		return nil, fmt.Errorf("start block %d is after end block %d", opts.StartBlock, opts.EndBlock)
+	}
+	opts.Concurrency = max(opts.Concurrency, 1)
+
+	scanners := make([]*stateSyncScanner, 2)
+	for i, url := range []string{opts.SourceRPC, opts.TargetRPC} {
+		client, err := rpc.DialContext(ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to RPC %s: %w", url, err)
+		}
+		defer client.Close()
+		scanners[i] = &stateSyncScanner{
+			client:  client,
+			limiter: newTokenBucket(opts.RateLimit, opts.Concurrency),
+			window:  newLogWindow(opts.Interval),
+		}
+	}
+	source, target := scanners[0], scanners[1]
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan scanWindow)
+	results := make(chan diffWindowResult)
+
+	go func() {
+		defer close(jobs)
+		for from := opts.StartBlock; from <= opts.EndBlock; {
+			to := min(from+min(source.window.get(), target.window.get())-1, opts.EndBlock)
+			select {
+			case jobs <- scanWindow{from: from, to: to}:
+			case <-ctx.Done():
+				return
+			}
+			if to == opts.EndBlock {
+				return
+			}
+			from = to + 1
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range jobs {
+				res := diffWindowResult{scanWindow: w}
+
+				// Both endpoints are queried at the same time.
+				var targetLogs []types.Log
+				var targetErr error
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					targetLogs, targetErr = target.getStateCommittedLogs(ctx, w.from, w.to)
+				}()
+				sourceLogs, err := source.getStateCommittedLogs(ctx, w.from, w.to)
+				<-done
+
+				switch {
+				case err != nil:
+					res.err = fmt.Errorf("source: %w", err)
+				case targetErr != nil:
+					res.err = fmt.Errorf("target: %w", targetErr)
+				default:
+					res.source = stateSyncsByID(sourceLogs)
+					res.target = stateSyncsByID(targetLogs)
+				}
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	report := &diffReport{
+		SourceRPC:  opts.SourceRPC,
+		TargetRPC:  opts.TargetRPC,
+		StartBlock: opts.StartBlock,
+		EndBlock:   opts.EndBlock,
+		Diffs:      []stateSyncDiff{},
+		Blocks:     []uint64{},
+	}
+
+	// A state sync the target placed in another window shows up as missing in
+	// one window and extra in the other, so unmatched IDs are held until the
+	// whole range has been seen.
+	span := opts.EndBlock - opts.StartBlock + 1
+	bar := out.Progress("Comparing", "blocks", span, 0)
+	defer bar.Done()
+	blocksTotal.Update(int64(span))
+
+	var (
+		firstErr  error
+		done      uint64
+		unmatched = struct{ source, target map[uint64]stateSyncLocation }{
+			source: make(map[uint64]stateSyncLocation),
+			target: make(map[uint64]stateSyncLocation),
+		}
+	)
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+				cancel()
+			}
+			continue
+		}
+		report.Source += len(res.source)
+		report.Target += len(res.target)
+		out.Debugf("Blocks %d-%d: %d state syncs on source, %d on target", res.from, res.to, len(res.source), len(res.target))
+
+		for id, src := range res.source {
+			tgt, ok := res.target[id]
+			if !ok {
+				tgt, ok = unmatched.target[id]
+				delete(unmatched.target, id)
+			}
+			if !ok {
+				unmatched.source[id] = src
+				continue
+			}
+			delete(res.target, id)
+			if src != tgt {
+				src, tgt := src, tgt
+				report.Diffs = append(report.Diffs, stateSyncDiff{StateID: id, Kind: diffMoved, Source: &src, Target: &tgt})
+			}
+		}
+		for id, tgt := range res.target {
+			src, ok := unmatched.source[id]
+			if !ok {
+				unmatched.target[id] = tgt
+				continue
+			}
+			delete(unmatched.source, id)
+			if src != tgt {
+				src, tgt := src, tgt
+				report.Diffs = append(report.Diffs, stateSyncDiff{StateID: id, Kind: diffMoved, Source: &src, Target: &tgt})
+			}
+		}
+		windowsScanned.Inc(1)
+		done += res.to - res.from + 1
+		bar.Set(done)
+		blocksDone.Update(int64(done))
+	}
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	bar.Done()
+
+	for id, src := range unmatched.source {
+		src := src
+		report.Diffs = append(report.Diffs, stateSyncDiff{StateID: id, Kind: diffMissing, Source: &src})
+	}
+	for id, tgt := range unmatched.target {
+		tgt := tgt
+		report.Diffs = append(report.Diffs, stateSyncDiff{StateID: id, Kind: diffExtra, Target: &tgt})
+	}
+	sort.Slice(report.Diffs, func(i, j int) bool { return report.Diffs[i].StateID < report.Diffs[j].StateID })
+
+	blocks := make(map[uint64]bool)
+	counts := make(map[string]int)
+	for _, d := range report.Diffs {
+		counts[d.Kind]++
+		if d.Source != nil && !blocks[d.Source.Block] {
+			blocks[d.Source.Block] = true
+			report.Blocks = append(report.Blocks, d.Source.Block)
+		}
+	}
+	sort.Slice(report.Blocks, func(i, j int) bool { return report.Blocks[i] < report.Blocks[j] })
+
+	if err := writeDiffReport(opts.OutputFile, report); err != nil {
+		return nil, err
+	}
+	out.Printf("State syncs: %d on source, %d on target; %d missing, %d extra, %d moved on target\n",
+		report.Source, report.Target, counts[diffMissing], counts[diffExtra], counts[diffMoved])
+	out.Printf("%d source blocks to repair written to %s\n", len(report.Blocks), opts.OutputFile)
+	return report, nil
+}
+
+func writeDiffReport(path string, report *diffReport) error {
+	data, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write diff report %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadDiffReport reads a report written by diff-state-sync.
+func loadDiffReport(path string) (*diffReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read diff report %s: %w", path, err)
+	}
+
+	var report diffReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse diff report %s: %w", path, err)
+	}
+	return &report, nil
+}
@@ -1,67 +1,30 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
-	"io"
-	"log"
 	"math/big"
-	"net/http"
-	"os"
-	"time"
+	"sort"
+	"sync"
 
 	"context"
 
-	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rpc"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
-/*
-
-This script gets all the blocks in which state sync txns are present on Matic pos mainnnet chain from polygonscan. It then checks if there are any difference between the no of txns in these blocks on local node vs remote rpc url and reports such occurrences.
-
-Mainnet API for getting all state sync txs:
-https://api.polygonscan.com/api?module=account&action=txlist&address=0x0000000000000000000000000000000000000000&startblock=1&endblock=99999999&page=1&offset=1000&sort=asc&apikey=YourApiKeyToken
-
-
-https://api.polygonscan.com/api?module=account&action=txlist&address=0x0000000000000000000000000000000000000000&startblock=1&endblock=1000&page=1&offset=1000&sort=asc
-
-
-
-1. Get all state sync txs in a block range from polygonscan
-2. For these txs, check if we have these txs in our localhost bor rpc
-3. If no, append output to a file
-
-*/
-
-type PolygonScanResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
-	Result  []struct {
-		BlockNumber       string `json:"blockNumber"`
-		TimeStamp         string `json:"timeStamp"`
-		Hash              string `json:"hash"`
-		Nonce             string `json:"nonce"`
-		BlockHash         string `json:"blockHash"`
-		TransactionIndex  string `json:"transactionIndex"`
-		From              string `json:"from"`
-		To                string `json:"to"`
-		Value             string `json:"value"`
-		Gas               string `json:"gas"`
-		GasPrice          string `json:"gasPrice"`
-		IsError           string `json:"isError"`
-		TxreceiptStatus   string `json:"txreceipt_status"`
-		Input             string `json:"input"`
-		ContractAddress   string `json:"contractAddress"`
-		CumulativeGasUsed string `json:"cumulativeGasUsed"`
-		GasUsed           string `json:"gasUsed"`
-		Confirmations     string `json:"confirmations"`
-	} `json:"result"`
-}
+// find-all-state-sync-tx reads the StateCommitted logs of a block range from a
+// remote bor RPC, or rebuilds them from Heimdall, and writes the bor tx lookup
+// and bor receipt of every state-sync tx to an instruction file that
+// write-missing-state-sync-tx applies. With --data-path or --local-rpc only the
+// entries the local node is missing are written. diff-state-sync (diff.go)
+// compares two nodes by state ID instead; its report lists the blocks the
+// target needs and is read back here with --diff-file.
 
 type Tx struct {
 	BlockNumber uint64
@@ -69,159 +32,556 @@ type Tx struct {
 	Hash        string
 }
 
-type TxResponse struct {
-	Jsonrpc string            `json:"jsonrpc"`
-	ID      int               `json:"id"`
-	Result  *TxResponseResult `json:"result"`
+var (
+	stateReceiverAddress = common.HexToAddress("0x0000000000000000000000000000000000001001")
+	stateCommittedTopic  = common.HexToHash("0x5a22725590b0a51c923940223f7458512164b1113359a735e86e7f27f44791ee")
+)
+
+// stateIDOf returns the state ID of a StateCommitted log, which is indexed as
+// its first topic after the event signature.
+func stateIDOf(log *types.Log) (uint64, bool) {
+	if len(log.Topics) < 2 || log.Topics[0] != stateCommittedTopic {
+		return 0, false
+	}
+	return new(big.Int).SetBytes(log.Topics[1].Bytes()).Uint64(), true
 }
 
-type TxResponseResult struct {
-	BlockHash        string `json:"blockHash"`
-	BlockNumber      string `json:"blockNumber"`
-	From             string `json:"from"`
-	Gas              string `json:"gas"`
-	GasPrice         string `json:"gasPrice"`
-	Hash             string `json:"hash"`
-	Input            string `json:"input"`
-	Nonce            string `json:"nonce"`
-	To               string `json:"to"`
-	TransactionIndex string `json:"transactionIndex"`
-	Value            string `json:"value"`
-	Type             string `json:"type"`
-	V                string `json:"v"`
-	R                string `json:"r"`
-	S                string `json:"s"`
+// FindOptions configures a find-all-state-sync-tx run.
+type FindOptions struct {
+	StartBlock   uint64
+	EndBlock     uint64
+	Interval     uint64
+	RemoteRPC    string
+	OutputFile   string
+	ProgressFile string
+	Resume       bool
+
+	// Concurrency is the number of windows scanned in parallel.
+	Concurrency int
+	// BatchSize is the number of receipts requested per JSON-RPC batch.
+	BatchSize int
+	// RateLimit caps the requests per second sent to RemoteRPC, 0 disables it.
+	RateLimit float64
+
+	// DataPath or LocalRPC, when set, restrict the output to entries the local
+	// node is missing or holds with a different value.
+	DataPath string
+	LocalRPC string
+	// Force opens DataPath even if a bor node appears to be using it.
+	Force bool
+
+	// FromStateID and ToStateID, when set, replace StartBlock and EndBlock with
+	// the blocks committing that range of state IDs, which must have no gaps.
+	FromStateID uint64
+	ToStateID   uint64
+
+	// Blocks, when set, restricts the scan to these blocks, sorted ascending.
+	// diff-state-sync lists the blocks a target node needs repaired.
+	Blocks []uint64
+
+	// HeimdallURL, when set, replaces RemoteRPC as the source of truth: the
+	// state syncs are rebuilt from Heimdall's event records and the headers
+	// of the chaindata at DataPath. Only tx lookups are written, unless
+	// ApproximateReceipts also writes the receipts rebuilt from the records.
+	HeimdallURL         string
+	ApproximateReceipts bool
 }
 
-type WriteInstruction struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+// scanWindow is an inclusive block range handed to a worker.
+type scanWindow struct {
+	index    int
+	from, to uint64
 }
 
-var psCount int
-var missingTxs int
+type windowResult struct {
+	scanWindow
+	txs          int
+	stateIDs     []uint64
+	instructions []WriteInstruction
+	stats        presenceStats
+	err          error
+}
 
-func getStateSyncTxns(start, end int, remoteRPCUrl string) []Tx {
-	var txs []Tx
-	ctx := context.Background()
-	// Connect to the RPC server
-	client, err := rpc.DialContext(ctx, remoteRPCUrl)
-	if err != nil {
-		fmt.Errorf("failed to connect to RPC %s: %w", remoteRPCUrl, err)
-		return nil
-	}
-	defer client.Close()
+// stateSyncScanner holds what the workers of one find run share: a single RPC
+// client, the token bucket that throttles it and the optional local checker.
+type stateSyncScanner struct {
+	client    *rpc.Client
+	limiter   *tokenBucket
+	batchSize int
+	local     localChecker
+	window    *logWindow
+	// source is the scanner itself, or Heimdall when no bor node has the
+	// state syncs.
+	source stateSyncSource
+	// blocks, when set, restricts the scan to state syncs of these blocks.
+	blocks map[uint64]bool
+	// approximateReceipts marks the receipts of source as rebuilt.
+	approximateReceipts bool
+}
 
-	// Build filter object for eth_getLogs
-	filter := map[string]interface{}{
-		"fromBlock": hexutil.Uint64(start),
-		"toBlock":   hexutil.Uint64(end),
-		"address":   common.HexToAddress("0x0000000000000000000000000000000000001001"),
-		"topics":    [][]common.Hash{{common.HexToHash("0x5a22725590b0a51c923940223f7458512164b1113359a735e86e7f27f44791ee")}},
+// getStateSyncTxns returns the state-sync txs of blocks [start, end] together
+// with the state IDs they commit.
+func (s *stateSyncScanner) getStateSyncTxns(ctx context.Context, start, end uint64) ([]Tx, []uint64, error) {
+	logs, err := s.getStateCommittedLogs(ctx, start, end)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Call eth_getLogs
-	var logs []types.Log
-	if err := client.CallContext(ctx, &logs, "eth_getLogs", filter); err != nil {
-		fmt.Errorf("failed to get logs: %w", err)
-		return nil
+	// A block carries all its state syncs in one bor tx, so several logs can
+	// share a tx hash.
+	var (
+		txs []Tx
+		ids []uint64
+	)
+	seen := make(map[common.Hash]bool)
+	for i, log := range logs {
+		if s.blocks != nil && !s.blocks[log.BlockNumber] {
+			continue
+		}
+		if id, ok := stateIDOf(&logs[i]); ok {
+			ids = append(ids, id)
+		}
+		if seen[log.TxHash] {
+			continue
+		}
+		seen[log.TxHash] = true
+		txs = append(txs, Tx{BlockNumber: log.BlockNumber, Hash: log.TxHash.Hex(), BlockHash: log.BlockHash.Hex()})
 	}
+	return txs, ids, nil
+}
 
-	// fmt.Println(PrettyPrint(result))
+// getBorReceipts fetches the receipts of txs with eth_getTransactionReceipt,
+// batchSize calls per JSON-RPC batch, and returns them in the order of txs.
+func (s *stateSyncScanner) getBorReceipts(ctx context.Context, txs []Tx) ([]*rpcReceipt, error) {
+	receipts := make([]*rpcReceipt, len(txs))
+	for start := 0; start < len(txs); start += s.batchSize {
+		end := min(start+s.batchSize, len(txs))
+
+		batch := make([]rpc.BatchElem, 0, end-start)
+		for i := start; i < end; i++ {
+			batch = append(batch, rpc.BatchElem{
+				Method: "eth_getTransactionReceipt",
+				Args:   []interface{}{common.HexToHash(txs[i].Hash)},
+				Result: &receipts[i],
+			})
+		}
 
-	fmt.Println("Got records: ", len(logs))
-	for _, log := range logs {
-		txs = append(txs, Tx{BlockNumber: log.BlockNumber, Hash: log.TxHash.Hex(), BlockHash: log.BlockHash.Hex()})
-		psCount += 1
+		if err := s.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		if err := s.client.BatchCallContext(ctx, batch); err != nil {
+			rpcErrors.Inc(1)
+			return nil, fmt.Errorf("failed to get receipts batch: %w", err)
+		}
+		for i, elem := range batch {
+			if elem.Error != nil {
+				rpcErrors.Inc(1)
+				return nil, fmt.Errorf("failed to get receipt for %s: %w", txs[start+i].Hash, elem.Error)
+			}
+			if receipts[start+i] == nil {
+				return nil, fmt.Errorf("receipt for %s not found", txs[start+i].Hash)
+			}
+		}
+		receiptsFetched.Inc(int64(end - start))
 	}
-	return txs
+	return receipts, nil
 }
 
-func PrettyPrint(i interface{}) string {
-	s, _ := json.MarshalIndent(i, "", "\t")
-	return string(s)
+// stateSyncs reads the state-sync txs of blocks [start, end] and their
+// receipts from the remote RPC.
+func (s *stateSyncScanner) stateSyncs(ctx context.Context, start, end uint64) ([]Tx, []*rpcReceipt, []uint64, error) {
+	txs, ids, err := s.getStateSyncTxns(ctx, start, end)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	receipts, err := s.getBorReceipts(ctx, txs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return txs, receipts, ids, nil
 }
 
-func FindAllStateSyncTransactions(startBlock, endBlock, interval uint64, remoteRPCUrl, outputFile string) {
-	var txs []Tx
-	var writeInstructions []WriteInstruction
-	var file, err = os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE, 0755)
+// scan builds the write instructions for every state-sync tx in one window.
+func (s *stateSyncScanner) scan(ctx context.Context, w scanWindow) windowResult {
+	res := windowResult{scanWindow: w}
+
+	txs, receipts, ids, err := s.source.stateSyncs(ctx, w.from, w.to)
 	if err != nil {
-		return
+		res.err = err
+		return res
 	}
 
-	count := 0
-	for startBlock < endBlock {
-		nextBlockNo := startBlock + interval // 25000
-		txs = getStateSyncTxns(int(startBlock), int(nextBlockNo), remoteRPCUrl)
-		for _, tx := range txs {
-			lookupKey := DebugEncodeBorTxLookupEntry(tx.Hash)
-			lookupValue := fmt.Sprintf("0x%s", common.Bytes2Hex(big.NewInt(0).SetUint64(tx.BlockNumber).Bytes()))
-
-			receiptKey := DebugEncodeBorReceiptKey(tx.BlockNumber, tx.BlockHash)
-			receiptValue := DebugEncodeBorReceiptValue(tx.Hash, remoteRPCUrl)
+	for i, tx := range txs {
+		lookupKey := hexutil.Encode(borTxLookupKey(common.HexToHash(tx.Hash)))
+		lookupValue := hexutil.Encode(borTxLookupValue(tx.BlockNumber))
+		res.instructions = append(res.instructions, WriteInstruction{
+			Kind:        kindBorTxLookup,
+			BlockNumber: tx.BlockNumber,
+			TxHash:      tx.Hash,
+			Key:         lookupKey,
+			Value:       lookupValue,
+		})
+		if receipts[i] == nil {
+			continue
+		}
 
-			writeInstructions = append(writeInstructions, WriteInstruction{Key: lookupKey, Value: lookupValue})
-			writeInstructions = append(writeInstructions, WriteInstruction{Key: receiptKey, Value: receiptValue})
+		receiptKey := hexutil.Encode(borReceiptKey(tx.BlockNumber, common.HexToHash(tx.BlockHash)))
+		receiptValue, err := encodeBorReceipt(receipts[i])
+		if err != nil {
+			res.err = fmt.Errorf("failed to encode bor receipt for %s: %w", tx.Hash, err)
+			return res
 		}
-		startBlock = nextBlockNo
-		if count%5 == 0 {
-			time.Sleep(1 * time.Second)
+		kind := kindBorReceipt
+		if s.approximateReceipts {
+			kind = kindBorReceiptApproximate
 		}
-		count += 1
+		res.instructions = append(res.instructions, WriteInstruction{
+			Kind:        kind,
+			BlockNumber: tx.BlockNumber,
+			TxHash:      tx.Hash,
+			Key:         receiptKey,
+			Value:       hexutil.Encode(receiptValue),
+		})
 	}
-	fmt.Println("Total no of records from PS: ", psCount)
-
-	fmt.Println()
+	res.txs = len(txs)
+	res.stateIDs = ids
 
-	b, err := json.MarshalIndent(writeInstructions, "", "    ")
-	if err != nil {
-		log.Fatalf("json.MarshalIndent failed: %v", err)
+	if s.local != nil {
+		res.instructions, res.stats, err = s.local.missing(ctx, txs, res.instructions)
+		if err != nil {
+			res.err = err
+		}
 	}
-	file.WriteString(string(b))
-	defer file.Close()
-
+	return res
 }
 
-func checkTxs(txs []Tx, file *os.File, localRPC string) {
+// blocksDigest identifies a block list in the progress file without storing it.
+func blocksDigest(blocks []uint64) string {
+	h := sha256.New()
+	for _, number := range blocks {
+		h.Write(binary.BigEndian.AppendUint64(nil, number))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	// curl localhost:8545 -X POST -H "Content-Type: application/json" -d '{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0xd96ecec3ac99e7e0f1edc62cff7d349c8c51cbfd0efc72f00662ecee6d41b14a"],"id":0}'
+// FindAllStateSyncTransactions scans [StartBlock, EndBlock] in windows that start at Interval
+// blocks and then follow the eth_getLogs range of logWindow, and streams the write instructions
+// for every state-sync tx found to OutputFile. Windows are
+// scanned by Concurrency workers sharing one RPC client, but are written strictly in block
+// order. After each window the output is synced and the window is recorded in ProgressFile,
+// so a run started with Resume continues after the last completed window instead of
+// rescanning the whole range.
+func FindAllStateSyncTransactions(ctx context.Context, opts FindOptions) (*scanProgress, error) {
+	if opts.Interval == 0 {
+		return nil, fmt.Errorf("interval must be greater than zero")
+	}
+	if opts.FromStateID > opts.ToStateID || (opts.ToStateID > 0 && opts.FromStateID == 0) {
+		return nil, fmt.Errorf("invalid state ID range %d-%d", opts.FromStateID, opts.ToStateID)
+	}
+	if opts.DataPath != "" && opts.LocalRPC != "" {
+		return nil, fmt.Errorf("only one of data path and local RPC can be used to check for missing entries")
+	}
+	if opts.HeimdallURL != "" {
+		switch {
+		case opts.RemoteRPC != "":
+			return nil, fmt.Errorf("only one of remote RPC and Heimdall can be the source of truth")
+		case opts.DataPath == "":
+			return nil, fmt.Errorf("Heimdall needs the data path for the block headers and bor config")
+		case opts.ToStateID > 0:
+			return nil, fmt.Errorf("a state ID range needs a remote RPC, use a block range with Heimdall")
+		}
+	} else if opts.ApproximateReceipts {
+		return nil, fmt.Errorf("approximate receipts can only be rebuilt from Heimdall")
+	}
+	if opts.ProgressFile == "" {
+		opts.ProgressFile = opts.OutputFile + ".progress"
+	}
+	opts.Concurrency = max(opts.Concurrency, 1)
+	opts.BatchSize = max(opts.BatchSize, 1)
 
-	// url := "http://localhost:80"
+	scanner := &stateSyncScanner{
+		limiter:   newTokenBucket(opts.RateLimit, opts.Concurrency),
+		batchSize: opts.BatchSize,
+		window:    newLogWindow(opts.Interval),
 
-	for _, tx := range txs {
-		var jsonStr = []byte(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["` + tx.Hash + `"],"id":0}`)
-		req, err := http.NewRequest("POST", localRPC, bytes.NewBuffer(jsonStr))
-		req.Header.Set("Content-Type", "application/json")
+		approximateReceipts: opts.ApproximateReceipts,
+	}
+	if opts.Blocks != nil {
+		scanner.blocks = make(map[uint64]bool, len(opts.Blocks))
+		for _, number := range opts.Blocks {
+			scanner.blocks[number] = true
+		}
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+	switch {
+	case opts.DataPath != "":
+		chaindata, err := newDBChecker(opts.DataPath, opts.Force)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		defer resp.Body.Close()
-
-		// fmt.Println("response Status:", resp.Status)
-		// fmt.Println("response Headers:", resp.Header)
-		body, _ := io.ReadAll(resp.Body)
+		scanner.local = chaindata
+	case opts.LocalRPC != "":
+		local, err := newRPCChecker(ctx, opts.LocalRPC, opts.BatchSize)
+		if err != nil {
+			return nil, err
+		}
+		scanner.local = local
+	}
+	if scanner.local != nil {
+		defer scanner.local.Close()
+	}
 
-		var result TxResponse
-		if err := json.Unmarshal(body, &result); err != nil { // Parse []byte to the go struct pointer
-			fmt.Println("Bor: Cannot unmarshal JSON")
-			fmt.Println(string(body))
+	// The chain ID and genesis go into the output header so the file is never
+	// applied to a node of another network.
+	var (
+		chain chainIdentity
+		err   error
+	)
+	if opts.HeimdallURL != "" {
+		db := scanner.local.(*dbChecker).db
+		if chain, err = readChainIdentity(db); err != nil {
+			return nil, err
 		}
+		config, err := readBorConfig(db)
+		if err != nil {
+			return nil, err
+		}
+		scanner.source = &heimdallSource{
+			client:      newHeimdallClient(opts.HeimdallURL, scanner.limiter),
+			db:          db,
+			config:      config,
+			chainID:     chain.ChainID,
+			approximate: opts.ApproximateReceipts,
+			blocks:      scanner.blocks,
+		}
+		if opts.ApproximateReceipts {
+			out.Warnf("Bor receipts rebuilt from Heimdall are approximate: they differ from the canonical ones of state syncs that reverted or made the receiver log")
+		}
+	} else {
+		client, err := rpc.DialContext(ctx, opts.RemoteRPC)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to RPC %s: %w", opts.RemoteRPC, err)
+		}
+		defer client.Close()
+		scanner.client = client
+		scanner.source = scanner
 
-		// fmt.Println("response Body:", string(body))
+		if chain, err = remoteChainIdentity(ctx, client); err != nil {
+			return nil, fmt.Errorf("%s: %w", opts.RemoteRPC, err)
+		}
+	}
 
-		jsonStr, err = json.Marshal(tx)
+	if opts.ToStateID > 0 {
+		opts.StartBlock, opts.EndBlock, err = scanner.stateIDRange(ctx, opts.FromStateID, opts.ToStateID, opts.Interval)
 		if err != nil {
-			fmt.Println("Bor: Error dumping json")
+			return nil, fmt.Errorf("failed to find the blocks of state IDs %d-%d: %w", opts.FromStateID, opts.ToStateID, err)
 		}
+		out.Infof("State IDs %d-%d are in blocks %d-%d", opts.FromStateID, opts.ToStateID, opts.StartBlock, opts.EndBlock)
+	}
+	if opts.StartBlock > opts.EndBlock {
+		return nil, fmt.Errorf("start block %d is after end block %d", opts.StartBlock, opts.EndBlock)
+	}
+
+	header := instructionHeader{
+		Format:      instructionFileFormat,
+		Version:     1,
+		ChainID:     chain.ChainID,
+		GenesisHash: chain.Genesis,
+		StartBlock:  opts.StartBlock,
+		EndBlock:    opts.EndBlock,
 
-		if result.Result == nil {
-			file.WriteString(string(jsonStr) + "\n")
-			missingTxs += 1
+		ApproximateReceipts: opts.ApproximateReceipts,
+	}
+
+	format, compressed := formatOf(opts.OutputFile)
+	scan := scanOptions{Format: format, Source: "remote-rpc"}
+	if compressed {
+		scan.Format += ".gz"
+	}
+	if opts.HeimdallURL != "" {
+		scan.Source = "heimdall"
+	}
+	switch {
+	case opts.DataPath != "":
+		scan.Filter = "data-path"
+	case opts.LocalRPC != "":
+		scan.Filter = "local-rpc"
+	}
+	if opts.Blocks != nil {
+		scan.Blocks = blocksDigest(opts.Blocks)
+	}
+
+	stream, progress, err := openInstructionStream(opts.OutputFile, opts.ProgressFile, header, scan, opts.Interval, opts.Resume)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	if progress.NextBlock > opts.StartBlock {
+		out.Infof("Resuming from block %d (%d instructions already written)", progress.NextBlock, progress.Instructions)
+	}
+	if opts.ToStateID > 0 && progress.NextStateID == 0 {
+		progress.NextStateID = opts.FromStateID
+	}
+
+	span := opts.EndBlock - opts.StartBlock + 1
+	bar := out.Progress("Scanning", "blocks", span, progress.NextBlock-opts.StartBlock)
+	defer bar.Done()
+	blocksTotal.Update(int64(span))
+	blocksDone.Update(int64(progress.NextBlock - opts.StartBlock))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// inflight bounds how far the workers may run ahead of the writer, so one
+	// slow window cannot make the reorder buffer grow without limit.
+	inflight := make(chan struct{}, 2*opts.Concurrency)
+	jobs := make(chan scanWindow)
+	results := make(chan windowResult)
+
+	go func() {
+		defer close(jobs)
+		index := 0
+		for from := progress.NextBlock; from <= opts.EndBlock; {
+			// With a block list, windows start at the next listed block so
+			// the stretches in between are never queried.
+			if opts.Blocks != nil {
+				i := sort.Search(len(opts.Blocks), func(i int) bool { return opts.Blocks[i] >= from })
+				if i == len(opts.Blocks) || opts.Blocks[i] > opts.EndBlock {
+					return
+				}
+				from = opts.Blocks[i]
+			}
+			// Windows follow the eth_getLogs range, so that it can grow
+			// past --interval while results stay sparse.
+			to := min(from+scanner.window.get()-1, opts.EndBlock)
+			select {
+			case inflight <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- scanWindow{index: index, from: from, to: to}:
+			case <-ctx.Done():
+				return
+			}
+			if to == opts.EndBlock {
+				return
+			}
+			from = to + 1
+			index++
 		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range jobs {
+				select {
+				case results <- scanner.scan(ctx, w):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		firstErr error
+		writeErr bool
+		total    int
+		next     int
+		pending  = make(map[int]windowResult)
+	)
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+				cancel()
+			}
+			continue
+		}
+		pending[res.index] = res
+
+		// Flush every window that is now contiguous with what has been written.
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-inflight
+
+			if writeErr {
+				continue
+			}
+			windowsScanned.Inc(1)
+			if scanner.local != nil {
+				out.Debugf("Blocks %d-%d: got %d state-sync txs, %d entries missing locally", res.from, res.to, res.txs, len(res.instructions))
+			} else {
+				out.Debugf("Blocks %d-%d: got %d state-sync txs", res.from, res.to, res.txs)
+			}
+			if err := stream.Append(res.instructions); err != nil {
+				firstErr, writeErr = err, true
+				cancel()
+				continue
+			}
+			progress.NextBlock = res.to + 1
+			progress.Offset = stream.Offset()
+			progress.Instructions = stream.Count()
+			progress.Stats.add(res.stats)
+			if opts.ToStateID > 0 {
+				var gaps []stateIDGap
+				progress.NextStateID, gaps = checkStateIDs(progress.NextStateID, opts.ToStateID, res.stateIDs)
+				for _, gap := range gaps {
+					out.Warnf("State IDs %d-%d are missing on the remote", gap.From, gap.To)
+				}
+				progress.Gaps = append(progress.Gaps, gaps...)
+			}
+			if err := progress.save(opts.ProgressFile); err != nil {
+				firstErr, writeErr = err, true
+				cancel()
+				continue
+			}
+			total += res.txs
+			bar.Set(progress.NextBlock - opts.StartBlock)
+			blocksDone.Update(int64(progress.NextBlock - opts.StartBlock))
+		}
+	}
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return progress, fmt.Errorf("scan stopped before block %d, rerun with --resume to continue: %w", progress.NextBlock, firstErr)
+	}
 
+	bar.Done()
+	out.Printf("Found %d state-sync txs\n", total)
+	if scanner.local != nil {
+		out.Printf("Local entries: %d present, %d missing, %d mismatched\n",
+			progress.Stats.Present, progress.Stats.Missing, progress.Stats.Mismatched)
+	}
+
+	if err := stream.Finish(); err != nil {
+		return nil, err
+	}
+	if opts.ToStateID > 0 && progress.NextStateID <= opts.ToStateID {
+		progress.Gaps = append(progress.Gaps, stateIDGap{From: progress.NextStateID, To: opts.ToStateID})
+		progress.NextStateID = opts.ToStateID + 1
+	}
+	progress.Done = true
+	if err := progress.save(opts.ProgressFile); err != nil {
+		return nil, err
+	}
+	if len(progress.Gaps) > 0 {
+		return progress, fmt.Errorf("state IDs %d-%d have %d gaps on the remote, see %s", opts.FromStateID, opts.ToStateID, len(progress.Gaps), opts.ProgressFile)
 	}
+	return progress, nil
 }
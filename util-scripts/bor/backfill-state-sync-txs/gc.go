@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// gcLogInterval spaces the progress lines of a gc run, which cannot know how
+// many keys it will visit.
+const gcLogInterval = 100000
+
+// gcIssue is one bor entry that does not belong to the canonical chain.
+type gcIssue struct {
+	Key     string `json:"key"`
+	Block   uint64 `json:"block"`
+	TxHash  string `json:"txHash,omitempty"`
+	Problem string `json:"problem"`
+	Fix     string `json:"fix"`
+}
+
+// gcReport is the outcome of a gc-bor-receipts run. Write is only set when
+// the fixes were applied.
+type gcReport struct {
+	Receipts         int          `json:"receipts"`
+	Lookups          int          `json:"lookups"`
+	OrphanReceipts   int          `json:"orphanReceipts"`
+	StaleLookups     int          `json:"staleLookups"`
+	MisplacedLookups int          `json:"misplacedLookups"`
+	KeptLookups      int          `json:"keptLookups"`
+	Issues           []gcIssue    `json:"issues"`
+	Write            *writeResult `json:"write,omitempty"`
+}
+
+// GCOptions configures a gc-bor-receipts run. EndBlock 0 means no upper
+// bound.
+type GCOptions struct {
+	DataPath    string
+	StartBlock  uint64
+	EndBlock    uint64
+	Delete      bool
+	JournalFile string
+	Force       bool
+}
+
+// GCBorReceipts looks for bor entries left behind by reorgs. A bor receipt
+// keyed by a hash that is not the canonical hash of its number is an orphan.
+// A tx lookup is stale when its tx is not the state-sync tx of the canonical
+// block it points at: it is repointed when the tx is that of another canonical
+// receipt in the key-value store, wherever its block is, and deleted
+// otherwise, since bor would serve the wrong block's receipt for it. Frozen
+// blocks are canonical by construction, so only the key-value store is
+// scanned. The freezer cannot be searched by tx, so when the node has one a
+// stale lookup whose receipt is not in the key-value store is kept: it may be
+// that of a frozen block.
+//
+// Without Delete the entries are only reported. With it the fixes are applied
+// with applyChanges, journaled to JournalFile (default
+// gc-bor-receipts-<time>.journal).
+func GCBorReceipts(opts GCOptions) (*gcReport, error) {
+	if opts.EndBlock != 0 && opts.StartBlock > opts.EndBlock {
+		return nil, fmt.Errorf("start block %d is after end block %d", opts.StartBlock, opts.EndBlock)
+	}
+	inRange := func(number uint64) bool {
+		return number >= opts.StartBlock && (opts.EndBlock == 0 || number <= opts.EndBlock)
+	}
+
+	db, err := openChaindata(opts.DataPath, openOptions{readOnly: !opts.Delete, force: opts.Force})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	report := &gcReport{Issues: []gcIssue{}}
+	var changes []keyChange
+
+	// canonicalTxs maps the state-sync tx of every canonical receipt in the
+	// key-value store to its block, to repoint lookups that name the wrong
+	// height. It is filled from the whole prefix whatever the range, since a
+	// lookup in the range may belong to a receipt outside it.
+	canonicalTxs := make(map[common.Hash]uint64)
+	canonicalHash := func(number uint64) (common.Hash, bool, error) {
+		canonical, err := db.Get(canonicalHashKey(number))
+		if err == errNotFound {
+			return common.Hash{}, false, nil
+		}
+		if err != nil {
+			return common.Hash{}, false, fmt.Errorf("failed to read canonical hash of block %d: %w", number, err)
+		}
+		return common.BytesToHash(canonical), true, nil
+	}
+
+	kv := keyValueStore(db)
+	_, frozen := db.(*freezerDatabase)
+	iter := kv.NewIterator(borReceiptPrefix, prefixUpperBound(borReceiptPrefix))
+	defer iter.Close()
+	for iter.Next() {
+		number, hash, ok := decodeBorReceiptKey(iter.Key())
+		if !ok {
+			continue
+		}
+		canonical, found, err := canonicalHash(number)
+		if err != nil {
+			return nil, err
+		}
+		if found && canonical == hash {
+			canonicalTxs[derivedBorTxHash(number, hash)] = number
+		}
+		if !inRange(number) {
+			continue
+		}
+		report.Receipts++
+		if report.Receipts%gcLogInterval == 0 {
+			out.Infof("Checked %d bor receipts, at block %d", report.Receipts, number)
+		}
+		if found && canonical == hash {
+			continue
+		}
+
+		problem := fmt.Sprintf("bor receipt for block %s is not canonical, the canonical hash is %s", hash.Hex(), canonical.Hex())
+		if !found {
+			problem = fmt.Sprintf("bor receipt for block %s is past the local chain", hash.Hex())
+		}
+		report.OrphanReceipts++
+		report.Issues = append(report.Issues, gcIssue{
+			Key:     hexutil.Encode(iter.Key()),
+			Block:   number,
+			TxHash:  derivedBorTxHash(number, hash).Hex(),
+			Problem: problem,
+			Fix:     "delete",
+		})
+		changes = append(changes, keyChange{Key: common.CopyBytes(iter.Key()), Delete: true})
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate bor receipts: %w", err)
+	}
+	iter.Close()
+
+	// Lookups are keyed by tx hash, so the whole prefix is visited and the
+	// range applies to the block they point at.
+	lookups := kv.NewIterator(borTxLookupPrefix, prefixUpperBound(borTxLookupPrefix))
+	defer lookups.Close()
+	for lookups.Next() {
+		txHash, ok := decodeBorTxLookupKey(lookups.Key())
+		if !ok {
+			continue
+		}
+		number := decodeBorTxLookupValue(lookups.Value())
+		if !inRange(number) {
+			continue
+		}
+		report.Lookups++
+		if report.Lookups%gcLogInterval == 0 {
+			out.Infof("Checked %d bor tx lookups", report.Lookups)
+		}
+
+		canonical, found, err := canonicalHash(number)
+		if err != nil {
+			return nil, err
+		}
+		if found && derivedBorTxHash(number, canonical) == txHash {
+			continue
+		}
+
+		issue := gcIssue{
+			Key:     hexutil.Encode(lookups.Key()),
+			Block:   number,
+			TxHash:  txHash.Hex(),
+			Problem: fmt.Sprintf("tx lookup points at block %d, whose state-sync tx is %s", number, derivedBorTxHash(number, canonical).Hex()),
+		}
+		if !found {
+			issue.Problem = fmt.Sprintf("tx lookup points at block %d, which is past the local chain", number)
+		}
+		if block, ok := canonicalTxs[txHash]; ok {
+			report.MisplacedLookups++
+			issue.Fix = fmt.Sprintf("point at block %d", block)
+			changes = append(changes, keyChange{Key: common.CopyBytes(lookups.Key()), Value: borTxLookupValue(block)})
+		} else if frozen {
+			report.KeptLookups++
+			issue.Fix = "keep, its receipt may be in the freezer"
+		} else {
+			report.StaleLookups++
+			issue.Fix = "delete"
+			changes = append(changes, keyChange{Key: common.CopyBytes(lookups.Key()), Delete: true})
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+	if err := lookups.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate bor tx lookups: %w", err)
+	}
+	lookups.Close()
+
+	for _, issue := range report.Issues {
+		out.Printf("block %d: %s, %s (key %s)\n", issue.Block, issue.Problem, issue.Fix, issue.Key)
+	}
+	out.Printf("Checked %d bor receipts and %d tx lookups: %d orphan receipts, %d stale, %d misplaced and %d kept lookups\n",
+		report.Receipts, report.Lookups, report.OrphanReceipts, report.StaleLookups, report.MisplacedLookups, report.KeptLookups)
+
+	if !opts.Delete || len(changes) == 0 {
+		return report, nil
+	}
+
+	journalFile := opts.JournalFile
+	if journalFile == "" {
+		journalFile = fmt.Sprintf("gc-bor-receipts-%s.journal", time.Now().UTC().Format("20060102-150405"))
+	}
+	summary, err := applyChanges(db, opts.DataPath, changes, journalFile, "gc-bor-receipts", false)
+	if err != nil {
+		return nil, err
+	}
+	report.Write = reportWrite(summary, journalFile, false)
+	return report, nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// heimdallPageSize is the number of event records asked for per page, the
+// page size bor itself uses.
+const heimdallPageSize = 50
+
+// stateSyncSource yields the state-sync txs of blocks [start, end], the bor
+// receipts to store for them in the same order, and the state IDs they
+// commit. A nil receipt is one the source cannot tell, for which only the tx
+// lookup is written.
+type stateSyncSource interface {
+	stateSyncs(ctx context.Context, start, end uint64) ([]Tx, []*rpcReceipt, []uint64, error)
+}
+
+// heimdallUint64 decodes a uint64 that Heimdall serves either as a JSON number
+// or as a string.
+type heimdallUint64 uint64
+
+func (n *heimdallUint64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %w", b, err)
+	}
+	*n = heimdallUint64(v)
+	return nil
+}
+
+// heimdallEventRecord is a clerk event record: a state sync as Heimdall saw
+// it on L1, before bor committed it.
+type heimdallEventRecord struct {
+	ID       heimdallUint64 `json:"id"`
+	Contract common.Address `json:"contract"`
+	Data     hexutil.Bytes  `json:"data"`
+	TxHash   common.Hash    `json:"tx_hash"`
+	LogIndex heimdallUint64 `json:"log_index"`
+	ChainID  string         `json:"bor_chain_id"`
+	Time     time.Time      `json:"record_time"`
+}
+
+// heimdallClient reads event records from the REST API of a Heimdall node
+// (port 1317).
+type heimdallClient struct {
+	url     string
+	http    *http.Client
+	limiter *tokenBucket
+}
+
+func newHeimdallClient(rawURL string, limiter *tokenBucket) *heimdallClient {
+	return &heimdallClient{
+		url:     strings.TrimSuffix(rawURL, "/"),
+		http:    &http.Client{Timeout: time.Minute},
+		limiter: limiter,
+	}
+}
+
+// eventRecords returns every event record with a record time in [from, to),
+// in Unix seconds, sorted by ID.
+func (c *heimdallClient) eventRecords(ctx context.Context, from, to int64) ([]heimdallEventRecord, error) {
+	var records []heimdallEventRecord
+	for page := 1; ; page++ {
+		query := url.Values{
+			"from-time": {strconv.FormatInt(from, 10)},
+			"to-time":   {strconv.FormatInt(to, 10)},
+			"page":      {strconv.Itoa(page)},
+			"limit":     {strconv.Itoa(heimdallPageSize)},
+		}
+		var result []heimdallEventRecord
+		if err := c.get(ctx, "/clerk/event-record/list?"+query.Encode(), &result); err != nil {
+			return nil, fmt.Errorf("failed to list event records of %d-%d: %w", from, to, err)
+		}
+		records = append(records, result...)
+		if len(result) < heimdallPageSize {
+			break
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records, nil
+}
+
+// get fetches path and decodes the result field of the response into v.
+func (c *heimdallClient) get(ctx context.Context, path string, v interface{}) error {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		rpcErrors.Inc(1)
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		rpcErrors.Inc(1)
+		return err
+	}
+	var envelope struct {
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || resp.StatusCode != http.StatusOK || envelope.Error != "" {
+		rpcErrors.Inc(1)
+		if envelope.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, envelope.Error)
+		}
+		if err == nil {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		return fmt.Errorf("invalid response %.200q: %w", body, err)
+	}
+	if len(envelope.Result) == 0 || string(envelope.Result) == "null" {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, v)
+}
+
+// borConfig is the part of bor's chain config that decides in which block a
+// state sync is committed. The maps are keyed by the block a value starts at,
+// and are parsed into schedules once when the config is read.
+type borConfig struct {
+	Sprint         map[string]uint64 `json:"sprint"`
+	StateSyncDelay map[string]uint64 `json:"stateSyncConfirmationDelay"`
+	IndoreBlock    *big.Int          `json:"indoreBlock"`
+
+	sprint         borSchedule
+	stateSyncDelay borSchedule
+}
+
+// readBorConfig reads the bor section of the chain config from the chaindata.
+func readBorConfig(db Database) (*borConfig, error) {
+	genesis, err := db.Get(canonicalHashKey(0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read genesis hash: %w", err)
+	}
+	data, err := db.Get(append(append([]byte{}, configPrefix...), genesis...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chain config of genesis 0x%x: %w", genesis, err)
+	}
+
+	var config struct {
+		Bor *borConfig `json:"bor"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse chain config: %w", err)
+	}
+	if config.Bor == nil || len(config.Bor.Sprint) == 0 {
+		return nil, fmt.Errorf("chain config has no bor sprint schedule")
+	}
+	if config.Bor.IndoreBlock != nil && len(config.Bor.StateSyncDelay) == 0 {
+		return nil, fmt.Errorf("chain config has an Indore block but no state sync confirmation delay")
+	}
+	if config.Bor.sprint, err = newBorSchedule(config.Bor.Sprint); err != nil {
+		return nil, fmt.Errorf("invalid bor sprint schedule: %w", err)
+	}
+	if config.Bor.stateSyncDelay, err = newBorSchedule(config.Bor.StateSyncDelay); err != nil {
+		return nil, fmt.Errorf("invalid state sync confirmation delay: %w", err)
+	}
+	return config.Bor, nil
+}
+
+// borScheduleStep is a value of a block keyed config field and the block it
+// starts at.
+type borScheduleStep struct {
+	from, value uint64
+}
+
+// borSchedule is a block keyed config field sorted by block.
+type borSchedule []borScheduleStep
+
+func newBorSchedule(field map[string]uint64) (borSchedule, error) {
+	schedule := make(borSchedule, 0, len(field))
+	for k, v := range field {
+		from, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block %q: %w", k, err)
+		}
+		schedule = append(schedule, borScheduleStep{from: from, value: v})
+	}
+	sort.Slice(schedule, func(i, j int) bool { return schedule[i].from < schedule[j].from })
+	return schedule, nil
+}
+
+// at returns the value at number the way bor resolves it: the value of the
+// highest block at or below number, and the last value for a number below
+// every block.
+func (s borSchedule) at(number uint64) uint64 {
+	for i := len(s) - 1; i >= 0; i-- {
+		if number >= s[i].from {
+			return s[i].value
+		}
+	}
+	return s[len(s)-1].value
+}
+
+// sprintStart returns the start of the sprint block number belongs to; bor
+// commits state syncs in the first block of a sprint.
+func (c *borConfig) sprintStart(number uint64) uint64 {
+	return number - number%c.sprint.at(number)
+}
+
+// headerTime is the head of a header's RLP list, up to its timestamp.
+type headerTime struct {
+	ParentHash  common.Hash
+	UncleHash   common.Hash
+	Coinbase    common.Address
+	Root        common.Hash
+	TxHash      common.Hash
+	ReceiptHash common.Hash
+	Bloom       types.Bloom
+	Difficulty  *big.Int
+	Number      *big.Int
+	GasLimit    uint64
+	GasUsed     uint64
+	Time        uint64
+	Rest        []rlp.RawValue `rlp:"tail"`
+}
+
+// heimdallSource rebuilds state-sync txs from Heimdall's event records and the
+// block headers of the local chaindata, for when no bor node has the logs.
+// Each record goes in the first sprint-start block whose cutoff is after its
+// record time, as bor's CommitStates places it. Heimdall cannot tell what the
+// receiving contract logged or whether its call succeeded, so by default no
+// receipt is returned and only the tx lookups are written. With approximate,
+// each rebuilt receipt holds one successful StateCommitted log per record and
+// nothing else, which differs from the canonical receipt of any state sync
+// that reverted or made the receiver log.
+type heimdallSource struct {
+	client      *heimdallClient
+	db          Database
+	config      *borConfig
+	chainID     uint64
+	approximate bool
+	// blocks, when set, restricts the output to state syncs of these blocks.
+	blocks map[uint64]bool
+}
+
+// block returns the canonical hash and timestamp of a local block.
+func (s *heimdallSource) block(number uint64) (common.Hash, uint64, error) {
+	canonical, err := s.db.Get(canonicalHashKey(number))
+	if err == errNotFound {
+		return common.Hash{}, 0, fmt.Errorf("block %d is not in the local chain", number)
+	}
+	if err != nil {
+		return common.Hash{}, 0, fmt.Errorf("failed to read canonical hash of block %d: %w", number, err)
+	}
+	hash := common.BytesToHash(canonical)
+
+	data, err := s.db.Get(headerKey(number, hash))
+	if err != nil {
+		return common.Hash{}, 0, fmt.Errorf("failed to read header of block %d: %w", number, err)
+	}
+	var header headerTime
+	if err := rlp.DecodeBytes(data, &header); err != nil {
+		return common.Hash{}, 0, fmt.Errorf("failed to decode header of block %d: %w", number, err)
+	}
+	return hash, header.Time, nil
+}
+
+// cutoff returns the time before which event records are committed in the
+// sprint-start block number: its own time less the confirmation delay since
+// Indore, the time of the first block of the previous sprint before.
+func (s *heimdallSource) cutoff(number uint64) (int64, error) {
+	if s.config.IndoreBlock != nil && new(big.Int).SetUint64(number).Cmp(s.config.IndoreBlock) >= 0 {
+		_, t, err := s.block(number)
+		return int64(t) - int64(s.config.stateSyncDelay.at(number)), err
+	}
+	_, t, err := s.block(number - s.config.sprint.at(number))
+	return int64(t), err
+}
+
+func (s *heimdallSource) stateSyncs(ctx context.Context, start, end uint64) ([]Tx, []*rpcReceipt, []uint64, error) {
+	var sprints []uint64
+	for number := max(start, 1); number <= end; number++ {
+		if s.config.sprintStart(number) == number {
+			sprints = append(sprints, number)
+		}
+	}
+	if len(sprints) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	// The records not committed before this range are those at or after the
+	// cutoff of the last sprint start before it.
+	var from int64
+	if prev := s.config.sprintStart(sprints[0] - 1); prev > 0 {
+		var err error
+		if from, err = s.cutoff(prev); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	cutoffs := make([]int64, len(sprints))
+	for i, number := range sprints {
+		var err error
+		if cutoffs[i], err = s.cutoff(number); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if cutoffs[len(cutoffs)-1] <= from {
+		return nil, nil, nil, nil
+	}
+
+	records, err := s.client.eventRecords(ctx, from, cutoffs[len(cutoffs)-1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, record := range records {
+		if record.ChainID != strconv.FormatUint(s.chainID, 10) {
+			return nil, nil, nil, fmt.Errorf("event record %d is for bor chain %s, not %d", record.ID, record.ChainID, s.chainID)
+		}
+		if i > 0 && record.ID != records[i-1].ID+1 {
+			return nil, nil, nil, fmt.Errorf("heimdall skipped event records %d-%d", records[i-1].ID+1, record.ID-1)
+		}
+	}
+
+	var (
+		txs      []Tx
+		receipts []*rpcReceipt
+		ids      []uint64
+		next     int
+	)
+	for i, number := range sprints {
+		var logs []*types.Log
+		for next < len(records) && records[next].Time.Before(time.Unix(cutoffs[i], 0)) {
+			id := uint64(records[next].ID)
+			logs = append(logs, &types.Log{
+				Address: stateReceiverAddress,
+				Topics:  []common.Hash{stateCommittedTopic, common.BigToHash(new(big.Int).SetUint64(id))},
+				Data:    common.LeftPadBytes([]byte{1}, 32),
+			})
+			ids = append(ids, id)
+			next++
+		}
+		if len(logs) == 0 || (s.blocks != nil && !s.blocks[number]) {
+			continue
+		}
+
+		hash, _, err := s.block(number)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		txs = append(txs, Tx{BlockNumber: number, BlockHash: hash.Hex(), Hash: derivedBorTxHash(number, hash).Hex()})
+		if s.approximate {
+			// An event record does not tell whether its state sync
+			// reverted, so the rebuilt receipt says it succeeded; this is
+			// what makes it approximate.
+			receipts = append(receipts, &rpcReceipt{Status: hexutil.Uint64(types.ReceiptStatusSuccessful), Logs: logs})
+		} else {
+			receipts = append(receipts, nil)
+		}
+	}
+	logsFound.Inc(int64(len(ids)))
+	return txs, receipts, ids, nil
+}
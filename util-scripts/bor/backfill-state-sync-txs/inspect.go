@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// keyScheme describes one chaindata key layout: a prefix, optionally followed
+// by a big-endian block number, a hash and a suffix.
+type keyScheme struct {
+	name      string
+	prefix    []byte
+	hasNumber bool
+	hasHash   bool
+	suffix    []byte
+	decode    func(value []byte) (interface{}, error)
+}
+
+func (s keyScheme) keyLength() int {
+	n := len(s.prefix) + len(s.suffix)
+	if s.hasNumber {
+		n += 8
+	}
+	if s.hasHash {
+		n += common.HashLength
+	}
+	return n
+}
+
+func (s keyScheme) matches(key []byte) bool {
+	return len(key) == s.keyLength() && bytes.HasPrefix(key, s.prefix) && bytes.HasSuffix(key, s.suffix)
+}
+
+// keySchemes lists the geth and bor layouts inspect understands. Keys sharing
+// a prefix ("h") are told apart by their length and suffix.
+var keySchemes = []keyScheme{
+	{name: "bor-receipt", prefix: borReceiptPrefix, hasNumber: true, hasHash: true, decode: decodeStoredReceipt},
+	{name: "bor-tx-lookup", prefix: borTxLookupPrefix, hasHash: true, decode: decodeLookupNumber},
+	{name: "header", prefix: []byte("h"), hasNumber: true, hasHash: true, decode: decodeHeader},
+	{name: "header-td", prefix: []byte("h"), hasNumber: true, hasHash: true, suffix: []byte("t"), decode: decodeTD},
+	{name: "canonical-hash", prefix: []byte("h"), hasNumber: true, suffix: []byte("n"), decode: decodeHash},
+	{name: "header-number", prefix: []byte("H"), hasHash: true, decode: decodeUint64},
+	{name: "body", prefix: []byte("b"), hasNumber: true, hasHash: true, decode: decodeBody},
+	{name: "receipts", prefix: []byte("r"), hasNumber: true, hasHash: true, decode: decodeStoredReceipts},
+	{name: "tx-lookup", prefix: []byte("l"), hasHash: true, decode: decodeLookupNumber},
+}
+
+func schemeByName(name string) (keyScheme, bool) {
+	for _, s := range keySchemes {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return keyScheme{}, false
+}
+
+// inspectedEntry is the JSON form of one key/value pair.
+type inspectedEntry struct {
+	Key    string      `json:"key"`
+	Kind   string      `json:"kind"`
+	Number *uint64     `json:"number,omitempty"`
+	Hash   string      `json:"hash,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+	Raw    string      `json:"raw,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// inspectEntry decodes key and value using the first matching key scheme.
+// Values that are unknown or fail to decode are returned as raw hex.
+func inspectEntry(key, value []byte) inspectedEntry {
+	entry := inspectedEntry{Key: hexutil.Encode(key), Kind: "unknown"}
+	for _, s := range keySchemes {
+		if !s.matches(key) {
+			continue
+		}
+		entry.Kind = s.name
+
+		rest := key[len(s.prefix):]
+		if s.hasNumber {
+			number := binary.BigEndian.Uint64(rest[:8])
+			entry.Number = &number
+			rest = rest[8:]
+		}
+		if s.hasHash {
+			entry.Hash = common.BytesToHash(rest[:common.HashLength]).Hex()
+		}
+
+		decoded, err := s.decode(value)
+		if err != nil {
+			entry.Error = err.Error()
+			entry.Raw = hexutil.Encode(value)
+		} else {
+			entry.Value = decoded
+		}
+		return entry
+	}
+	entry.Raw = hexutil.Encode(value)
+	return entry
+}
+
+type storedLog struct {
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    hexutil.Bytes  `json:"data"`
+}
+
+type storedReceipt struct {
+	Status            uint64      `json:"status"`
+	CumulativeGasUsed uint64      `json:"cumulativeGasUsed"`
+	Logs              []storedLog `json:"logs"`
+}
+
+func toStoredReceipt(r *types.ReceiptForStorage) storedReceipt {
+	out := storedReceipt{Status: r.Status, CumulativeGasUsed: r.CumulativeGasUsed, Logs: []storedLog{}}
+	for _, log := range r.Logs {
+		out.Logs = append(out.Logs, storedLog{Address: log.Address, Topics: log.Topics, Data: log.Data})
+	}
+	return out
+}
+
+func decodeStoredReceipt(value []byte) (interface{}, error) {
+	var receipt types.ReceiptForStorage
+	if err := rlp.DecodeBytes(value, &receipt); err != nil {
+		return nil, err
+	}
+	return toStoredReceipt(&receipt), nil
+}
+
+func decodeStoredReceipts(value []byte) (interface{}, error) {
+	var receipts []*types.ReceiptForStorage
+	if err := rlp.DecodeBytes(value, &receipts); err != nil {
+		return nil, err
+	}
+	out := make([]storedReceipt, 0, len(receipts))
+	for _, r := range receipts {
+		out = append(out, toStoredReceipt(r))
+	}
+	return out, nil
+}
+
+func decodeHeader(value []byte) (interface{}, error) {
+	var header types.Header
+	if err := rlp.DecodeBytes(value, &header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+func decodeBody(value []byte) (interface{}, error) {
+	var body types.Body
+	if err := rlp.DecodeBytes(value, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+func decodeTD(value []byte) (interface{}, error) {
+	td := new(big.Int)
+	if err := rlp.DecodeBytes(value, td); err != nil {
+		return nil, err
+	}
+	return (*hexutil.Big)(td), nil
+}
+
+func decodeHash(value []byte) (interface{}, error) {
+	if len(value) != common.HashLength {
+		return nil, fmt.Errorf("expected %d byte hash, got %d bytes", common.HashLength, len(value))
+	}
+	return common.BytesToHash(value), nil
+}
+
+func decodeUint64(value []byte) (interface{}, error) {
+	if len(value) != 8 {
+		return nil, fmt.Errorf("expected 8 byte number, got %d bytes", len(value))
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func decodeLookupNumber(value []byte) (interface{}, error) {
+	if len(value) > 8 {
+		return nil, fmt.Errorf("expected block number, got %d bytes", len(value))
+	}
+	return decodeBorTxLookupValue(value), nil
+}
+
+// InspectOptions selects what inspect prints: a single Key, or up to Limit
+// entries under Prefix (a scheme name or hex), optionally from StartBlock on
+// for schemes keyed by block number.
+type InspectOptions struct {
+	DataPath   string
+	Key        string
+	Prefix     string
+	StartBlock uint64
+	Limit      int
+	Force      bool
+}
+
+// Inspect decodes chaindata entries into readable JSON.
+func Inspect(opts InspectOptions) (interface{}, error) {
+	if (opts.Key == "") == (opts.Prefix == "") {
+		return nil, fmt.Errorf("exactly one of key and prefix is required")
+	}
+
+	db, err := openChaindata(opts.DataPath, openOptions{readOnly: true, force: opts.Force})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if opts.Key != "" {
+		key, err := hexutil.Decode(opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex key %s: %w", opts.Key, err)
+		}
+		value, err := db.Get(key)
+		if err == errNotFound {
+			return nil, fmt.Errorf("key %s not found in database", opts.Key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", opts.Key, err)
+		}
+		entry := inspectEntry(key, value)
+		return entry, out.Document(entry)
+	}
+
+	lower, err := inspectLowerBound(opts.Prefix, opts.StartBlock)
+	if err != nil {
+		return nil, err
+	}
+	prefix := lower
+	scheme, named := schemeByName(opts.Prefix)
+	if named {
+		prefix = scheme.prefix
+	}
+
+	iter := db.NewIterator(lower, prefixUpperBound(prefix))
+	defer iter.Close()
+
+	entries := []inspectedEntry{}
+	for (opts.Limit <= 0 || len(entries) < opts.Limit) && iter.Next() {
+		// Named schemes skip the other layouts sharing their prefix.
+		if named && !scheme.matches(iter.Key()) {
+			continue
+		}
+		entries = append(entries, inspectEntry(iter.Key(), iter.Value()))
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate prefix %s: %w", opts.Prefix, err)
+	}
+	return entries, out.Document(entries)
+}
+
+// inspectLowerBound turns a scheme name or hex prefix into the first key to
+// visit. A start block is only meaningful for schemes keyed by number.
+func inspectLowerBound(prefix string, startBlock uint64) ([]byte, error) {
+	if s, ok := schemeByName(prefix); ok {
+		if !s.hasNumber {
+			if startBlock != 0 {
+				return nil, fmt.Errorf("%s keys are not ordered by block number", s.name)
+			}
+			return s.prefix, nil
+		}
+		enc := make([]byte, 8)
+		binary.BigEndian.PutUint64(enc, startBlock)
+		return append(append([]byte{}, s.prefix...), enc...), nil
+	}
+
+	if !strings.HasPrefix(prefix, "0x") {
+		names := make([]string, 0, len(keySchemes))
+		for _, s := range keySchemes {
+			names = append(names, s.name)
+		}
+		return nil, fmt.Errorf("unknown prefix %q, use a hex prefix or one of %s", prefix, strings.Join(names, ", "))
+	}
+	if startBlock != 0 {
+		return nil, fmt.Errorf("start block can only be used with a named prefix")
+	}
+	b, err := hexutil.Decode(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex prefix %s: %w", prefix, err)
+	}
+	return b, nil
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting
+// with prefix, or nil when there is none.
+func prefixUpperBound(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
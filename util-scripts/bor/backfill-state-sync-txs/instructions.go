@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// WriteInstruction is one key to write to the chaindata. TxHash, BlockNumber
+// and Kind say which state-sync tx and which entry it is, and are informative
+// only: the key and value are written as they are.
+type WriteInstruction struct {
+	Kind        string `json:"kind,omitempty"`
+	BlockNumber uint64 `json:"blockNumber,omitempty"`
+	TxHash      string `json:"txHash,omitempty"`
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+}
+
+// Kinds of WriteInstruction, named like the key schemes of inspect. An
+// approximate bor receipt is one rebuilt from Heimdall, which may differ from
+// the canonical one.
+const (
+	kindBorTxLookup           = "bor-tx-lookup"
+	kindBorReceipt            = "bor-receipt"
+	kindBorReceiptApproximate = "bor-receipt-approximate"
+)
+
+// Instruction file formats. The format of an output file follows its
+// extension, with an optional .gz suffix for gzip: .ndjson or .jsonl for one
+// JSON instruction per line, .csv, and anything else for a JSON object holding
+// the header and the array of instructions. Files of the original headerless
+// JSON array format are still read.
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// instructionFileFormat identifies the header of an instruction file.
+const instructionFileFormat = "bor-state-sync-instructions"
+
+// instructionHeader opens every instruction file so that a file is never
+// applied to a node of another network.
+type instructionHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	ChainID uint64 `json:"chainId"`
+	// GenesisHash is missing from files written before it was added.
+	GenesisHash common.Hash `json:"genesisHash,omitempty"`
+	StartBlock  uint64      `json:"startBlock"`
+	EndBlock    uint64      `json:"endBlock"`
+	// ApproximateReceipts is set when the bor receipts were rebuilt from
+	// Heimdall with --approximate-receipts.
+	ApproximateReceipts bool `json:"approximateReceipts,omitempty"`
+}
+
+// csvColumns is the column row that follows the header of a CSV file.
+var csvColumns = []string{"kind", "blockNumber", "txHash", "key", "value"}
+
+// formatOf returns the format and compression of an output file from its name.
+func formatOf(path string) (format string, compressed bool) {
+	name := strings.ToLower(path)
+	if strings.HasSuffix(name, ".gz") {
+		name, compressed = strings.TrimSuffix(name, ".gz"), true
+	}
+	switch {
+	case strings.HasSuffix(name, ".ndjson"), strings.HasSuffix(name, ".jsonl"):
+		return formatNDJSON, compressed
+	case strings.HasSuffix(name, ".csv"):
+		return formatCSV, compressed
+	}
+	return formatJSON, compressed
+}
+
+// encodeHeader returns the bytes that open an instruction file.
+func encodeHeader(format string, header instructionHeader) ([]byte, error) {
+	switch format {
+	case formatJSON:
+		b, err := json.MarshalIndent(header, "    ", "    ")
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("{\n    \"header\": %s,\n    \"instructions\": [", b)), nil
+	case formatCSV:
+		b, err := json.Marshal(header)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "# %s\n", b)
+		w := csv.NewWriter(&buf)
+		w.Write(csvColumns)
+		w.Flush()
+		return buf.Bytes(), w.Error()
+	}
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// encodeInstructions returns the bytes of a run of instructions. first says
+// whether they are the first of the file, which matters to the JSON array.
+func encodeInstructions(format string, instructions []WriteInstruction, first bool) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case formatJSON:
+		for i, instruction := range instructions {
+			b, err := json.MarshalIndent(instruction, "        ", "    ")
+			if err != nil {
+				return nil, err
+			}
+			if first && i == 0 {
+				buf.WriteString("\n        ")
+			} else {
+				buf.WriteString(",\n        ")
+			}
+			buf.Write(b)
+		}
+	case formatCSV:
+		w := csv.NewWriter(&buf)
+		for _, instruction := range instructions {
+			w.Write([]string{
+				instruction.Kind,
+				strconv.FormatUint(instruction.BlockNumber, 10),
+				instruction.TxHash,
+				instruction.Key,
+				instruction.Value,
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	default:
+		enc := json.NewEncoder(&buf)
+		for _, instruction := range instructions {
+			if err := enc.Encode(instruction); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeFooter returns the bytes that close an instruction file.
+func encodeFooter(format string) []byte {
+	if format == formatJSON {
+		return []byte("\n    ]\n}\n")
+	}
+	return nil
+}
+
+// instructionReader streams the instructions of a file in any of the formats,
+// gzipped or not, which it tells apart by content.
+type instructionReader struct {
+	path   string
+	file   *os.File
+	gz     *gzip.Reader
+	header *instructionHeader
+	count  int
+	next   func() (WriteInstruction, error)
+}
+
+func openInstructionReader(path string) (*instructionReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	r := &instructionReader{path: path, file: file}
+	if err := r.init(); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to read instruction file %s: %w", path, err)
+	}
+	return r, nil
+}
+
+func (r *instructionReader) init() error {
+	br := bufio.NewReader(r.file)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		r.gz = gz
+		br = bufio.NewReader(gz)
+	}
+
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return err
+	}
+	switch first {
+	case '[':
+		return r.initJSON(json.NewDecoder(br), "]")
+	case '#':
+		return r.initCSV(br)
+	case '{':
+		if isJSONObjectFile(br) {
+			return r.initJSONObject(br)
+		}
+		return r.initNDJSON(br)
+	}
+	return fmt.Errorf("unknown instruction format starting with %q", first)
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, br.UnreadByte()
+		}
+	}
+}
+
+// isJSONObjectFile reports whether the object br starts with is a JSON file's
+// header and instructions rather than the header line of an NDJSON file.
+func isJSONObjectFile(br *bufio.Reader) bool {
+	start, _ := br.Peek(br.Size())
+	start = bytes.TrimLeft(bytes.TrimPrefix(start, []byte("{")), " \t\r\n")
+	return bytes.HasPrefix(start, []byte(`"header"`))
+}
+
+func (r *instructionReader) initJSONObject(br *bufio.Reader) error {
+	dec := json.NewDecoder(br)
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if key, err := dec.Token(); err != nil || key != "header" {
+		return fmt.Errorf("JSON instruction file does not start with its header")
+	}
+	var header json.RawMessage
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+	if err := r.parseHeader(header); err != nil {
+		return err
+	}
+	if key, err := dec.Token(); err != nil || key != "instructions" {
+		return fmt.Errorf("JSON instruction file has no instructions after its header")
+	}
+	return r.initJSON(dec, "]}")
+}
+
+// initJSON streams the instructions of the array dec is at. closing are the
+// delimiters that must follow the array for the file to be complete.
+func (r *instructionReader) initJSON(dec *json.Decoder, closing string) error {
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return fmt.Errorf("instructions are not a JSON array")
+	}
+	r.next = func() (WriteInstruction, error) {
+		var instruction WriteInstruction
+		if !dec.More() {
+			// An array that was never closed is a scan that never finished.
+			for _, delim := range closing {
+				if tok, err := dec.Token(); err != nil || tok != json.Delim(delim) {
+					return instruction, fmt.Errorf("JSON file is not closed, the scan that wrote it did not finish")
+				}
+			}
+			return instruction, io.EOF
+		}
+		err := dec.Decode(&instruction)
+		return instruction, err
+	}
+	return nil
+}
+
+func (r *instructionReader) initNDJSON(br *bufio.Reader) error {
+	line, err := br.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err := r.parseHeader(line); err != nil {
+		return err
+	}
+
+	r.next = func() (WriteInstruction, error) {
+		var instruction WriteInstruction
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				return instruction, json.Unmarshal(line, &instruction)
+			}
+			if err != nil {
+				return instruction, err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *instructionReader) initCSV(br *bufio.Reader) error {
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	if err := r.parseHeader(bytes.TrimPrefix(line, []byte("#"))); err != nil {
+		return err
+	}
+
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = len(csvColumns)
+	columns, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	if strings.Join(columns, ",") != strings.Join(csvColumns, ",") {
+		return fmt.Errorf("unexpected CSV columns %v, want %v", columns, csvColumns)
+	}
+
+	r.next = func() (WriteInstruction, error) {
+		record, err := cr.Read()
+		if err != nil {
+			return WriteInstruction{}, err
+		}
+		number, err := strconv.ParseUint(record[1], 10, 64)
+		if err != nil {
+			return WriteInstruction{}, fmt.Errorf("invalid block number %q: %w", record[1], err)
+		}
+		return WriteInstruction{Kind: record[0], BlockNumber: number, TxHash: record[2], Key: record[3], Value: record[4]}, nil
+	}
+	return nil
+}
+
+func (r *instructionReader) parseHeader(line []byte) error {
+	var header instructionHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Format != instructionFileFormat {
+		return fmt.Errorf("not an instruction file, header format is %q", header.Format)
+	}
+	r.header = &header
+	return nil
+}
+
+// Header returns the header of the file, or nil for a file of the original
+// JSON array format, which has none.
+func (r *instructionReader) Header() *instructionHeader {
+	return r.header
+}
+
+// Next returns the next instruction, or io.EOF after the last one.
+func (r *instructionReader) Next() (WriteInstruction, error) {
+	instruction, err := r.next()
+	if errors.Is(err, io.EOF) {
+		return instruction, io.EOF
+	}
+	if err != nil {
+		return instruction, fmt.Errorf("instruction %d of %s: %w", r.count, r.path, err)
+	}
+	r.count++
+	return instruction, nil
+}
+
+func (r *instructionReader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	return r.file.Close()
+}
+
+// readAllInstructions calls fn with every instruction of path in order and
+// returns the file's header.
+func readAllInstructions(path string, fn func(WriteInstruction) error) (*instructionHeader, error) {
+	r, err := openInstructionReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for {
+		instruction, err := r.Next()
+		if err == io.EOF {
+			return r.Header(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(instruction); err != nil {
+			return nil, err
+		}
+	}
+}
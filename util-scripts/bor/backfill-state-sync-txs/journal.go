@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// keyChange is a single write (or delete) applied to the chaindata.
+type keyChange struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// journalEntry records what a key held before a batch touched it and what the
+// batch left in it. A nil Previous means the key did not exist; Deleted means
+// the batch removed it.
+type journalEntry struct {
+	Key      hexutil.Bytes  `json:"key"`
+	Previous *hexutil.Bytes `json:"previous"`
+	Written  *hexutil.Bytes `json:"written,omitempty"`
+	Deleted  bool           `json:"deleted,omitempty"`
+}
+
+// writeJournal is saved before a batch is committed so that rollback can put
+// every touched key back exactly as it was. On disk it is a line with the
+// fields below followed by one line per entry, appended as the changes are
+// staged and synced before their batch is committed. Journals written before
+// streamed writes hold the entries in the object itself.
+type writeJournal struct {
+	DataPath  string         `json:"dataPath"`
+	Source    string         `json:"source"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Entries   []journalEntry `json:"entries,omitempty"`
+}
+
+// changeSummary counts what a batch does (or would do, on a dry run).
+type changeSummary struct {
+	Created     int `json:"created"`
+	Overwritten int `json:"overwritten"`
+	Deleted     int `json:"deleted"`
+	Unchanged   int `json:"unchanged"`
+}
+
+// dedupeChanges keeps one change per key, the last one given, at the position
+// of the key's first change.
+func dedupeChanges(changes []keyChange) []keyChange {
+	index := make(map[string]int, len(changes))
+	deduped := make([]keyChange, 0, len(changes))
+	for _, change := range changes {
+		if i, ok := index[string(change.Key)]; ok {
+			deduped[i] = change
+			continue
+		}
+		index[string(change.Key)] = len(deduped)
+		deduped = append(deduped, change)
+	}
+	return deduped
+}
+
+// changeWriter stages changes to db in one batch that can be filled a chunk
+// at a time, so that a write larger than the decoded instructions fits in
+// memory is still committed, and rolled back, as one. The journal shares the
+// batch: its entries are appended as changes are staged and synced before the
+// batch is committed.
+type changeWriter struct {
+	db          Database
+	dataPath    string
+	journalFile string
+	source      string
+	dryRun      bool
+
+	journal *os.File
+	summary changeSummary
+
+	// batch holds the changes staged since the last commit, and staged what
+	// they leave in each key, so that a key staged again is compared with its
+	// staged value rather than the one on disk.
+	batch  Batch
+	staged map[string]stagedValue
+	// pending is the number of journaled changes in batch, committed the
+	// number of those already on disk.
+	pending   int
+	committed int
+}
+
+type stagedValue struct {
+	value  []byte
+	exists bool
+}
+
+func newChangeWriter(db Database, dataPath, journalFile, source string, dryRun bool) *changeWriter {
+	return &changeWriter{db: db, dataPath: dataPath, journalFile: journalFile, source: source, dryRun: dryRun}
+}
+
+// apply writes changes in a single synced batch (see stage and commit).
+func (w *changeWriter) apply(changes []keyChange) error {
+	if err := w.stage(changes); err != nil {
+		return err
+	}
+	return w.commit()
+}
+
+// stage adds changes to the batch and appends the previous value of every key
+// that changes to the journal, which is created on the first change and must
+// not exist yet so that an earlier journal is never lost. A key given more
+// than once in changes gets its last change, and is counted and journaled
+// once. With dryRun nothing is journaled and each change is printed instead.
+func (w *changeWriter) stage(changes []keyChange) error {
+	if w.batch == nil {
+		w.batch = w.db.NewBatch()
+		w.staged = make(map[string]stagedValue)
+	}
+
+	var entries []journalEntry
+	changes = dedupeChanges(changes)
+
+	// Compare against the key-value store only: a value served from the
+	// freezer is not something rollback could or should restore.
+	kv := keyValueStore(w.db)
+	for _, change := range changes {
+		current, ok := w.staged[string(change.Key)]
+		if !ok {
+			prev, err := kv.Get(change.Key)
+			if err != nil && err != errNotFound {
+				return fmt.Errorf("failed to read key 0x%x: %w", change.Key, err)
+			}
+			current = stagedValue{value: prev, exists: err == nil}
+		}
+		prev, exists := current.value, current.exists
+
+		switch {
+		case change.Delete && !exists, !change.Delete && exists && bytes.Equal(prev, change.Value):
+			w.summary.Unchanged++
+			continue
+		case change.Delete:
+			w.summary.Deleted++
+			if w.dryRun {
+				out.Printf("delete    0x%x (was 0x%x)\n", change.Key, prev)
+			}
+		case exists:
+			w.summary.Overwritten++
+			if w.dryRun {
+				out.Printf("overwrite 0x%x: 0x%x -> 0x%x\n", change.Key, prev, change.Value)
+			}
+		default:
+			w.summary.Created++
+			if w.dryRun {
+				out.Printf("create    0x%x: 0x%x\n", change.Key, change.Value)
+			}
+		}
+
+		entry := journalEntry{Key: change.Key, Deleted: change.Delete}
+		if exists {
+			p := hexutil.Bytes(prev)
+			entry.Previous = &p
+		}
+		if !change.Delete {
+			v := hexutil.Bytes(change.Value)
+			entry.Written = &v
+		}
+		entries = append(entries, entry)
+		w.staged[string(change.Key)] = stagedValue{value: change.Value, exists: !change.Delete}
+
+		var err error
+		if change.Delete {
+			err = w.batch.Delete(change.Key)
+		} else {
+			err = w.batch.Put(change.Key, change.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.dryRun || len(entries) == 0 {
+		return nil
+	}
+	if err := w.appendJournal(entries); err != nil {
+		return err
+	}
+	w.pending += len(entries)
+	return nil
+}
+
+// commit syncs the journal and then commits the staged batch. It is a no-op
+// on a dry run or when nothing staged changes a key.
+func (w *changeWriter) commit() error {
+	if w.dryRun || w.pending == 0 {
+		return nil
+	}
+	if err := w.journal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal file %s: %w", w.journalFile, err)
+	}
+
+	n := w.pending
+	w.pending = 0
+	if err := w.batch.Commit(); err != nil {
+		return fmt.Errorf("failed to commit batch (journal %s was written, this batch was not applied): %w", w.journalFile, err)
+	}
+	keysWritten.Inc(int64(n))
+	w.committed += n
+
+	w.batch.Close()
+	w.batch, w.staged = nil, nil
+	return nil
+}
+
+// appendJournal adds entries to the journal, creating it on the first call.
+// The entries are synced by commit.
+func (w *changeWriter) appendJournal(entries []journalEntry) error {
+	if w.journal == nil {
+		journal := &writeJournal{DataPath: w.dataPath, Source: w.source, CreatedAt: time.Now().UTC()}
+		file, err := createJournal(w.journalFile, journal)
+		if err != nil {
+			return err
+		}
+		w.journal = file
+	}
+
+	enc := json.NewEncoder(w.journal)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return fmt.Errorf("failed to write journal file %s: %w", w.journalFile, err)
+		}
+	}
+	return nil
+}
+
+// close discards whatever is still staged. A journal whose changes were all
+// discarded before any commit was tried has nothing to roll back, and is
+// removed so that it does not block a rerun.
+func (w *changeWriter) close() error {
+	if w.batch != nil {
+		w.batch.Close()
+		w.batch, w.staged = nil, nil
+	}
+	if w.journal == nil {
+		return nil
+	}
+	err := w.journal.Close()
+	if w.committed == 0 && w.pending > 0 {
+		if rmErr := os.Remove(w.journalFile); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// applyChanges writes changes to db in a single synced batch, journaled to
+// journalFile (see changeWriter.apply).
+func applyChanges(db Database, dataPath string, changes []keyChange, journalFile, source string, dryRun bool) (changeSummary, error) {
+	w := newChangeWriter(db, dataPath, journalFile, source, dryRun)
+	defer w.close()
+	err := w.apply(changes)
+	return w.summary, err
+}
+
+// createJournal creates path, which must not exist yet, with the header line
+// of journal.
+func createJournal(path string, journal *writeJournal) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("journal file %s already exists, roll it back or choose another --journal-file", path)
+		}
+		return nil, fmt.Errorf("failed to create journal file %s: %w", path, err)
+	}
+	if err := json.NewEncoder(file).Encode(journal); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write journal file %s: %w", path, err)
+	}
+	return file, nil
+}
+
+func loadJournal(path string) (*writeJournal, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var journal writeJournal
+	dec := json.NewDecoder(bufio.NewReader(file))
+	if err := dec.Decode(&journal); err != nil {
+		return nil, fmt.Errorf("failed to parse journal file %s: %w", path, err)
+	}
+	for dec.More() {
+		var entry journalEntry
+		if err := dec.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("failed to parse entry %d of journal file %s: %w", len(journal.Entries), path, err)
+		}
+		journal.Entries = append(journal.Entries, entry)
+	}
+	return &journal, nil
+}
+
+// rollbackResult is the outcome of a rollback run.
+type rollbackResult struct {
+	JournalFile string `json:"journalFile"`
+	Restored    int    `json:"restored"`
+	DryRun      bool   `json:"dryRun"`
+}
+
+// sameDataPath reports whether a and b name the same chaindata directory.
+func sameDataPath(a, b string) bool {
+	resolve := func(path string) string {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			path = real
+		}
+		return filepath.Clean(path)
+	}
+	return resolve(a) == resolve(b)
+}
+
+// rollbackChanges walks the entries of a journal last to first and returns
+// the changes that restore every key to its value from before the first entry
+// that touched it, and the keys that no longer hold what the journal wrote. A
+// key that still holds its previous value, because its batch was never
+// committed, is fine. Entries of journals written before the written value was
+// recorded cannot be checked otherwise.
+func rollbackChanges(kv Database, entries []journalEntry) ([]keyChange, []hexutil.Bytes, error) {
+	type state struct {
+		value  []byte
+		exists bool
+	}
+	states := make(map[string]state)
+	read := func(key []byte) (state, error) {
+		if s, ok := states[string(key)]; ok {
+			return s, nil
+		}
+		value, err := kv.Get(key)
+		if err == errNotFound {
+			return state{}, nil
+		}
+		if err != nil {
+			return state{}, fmt.Errorf("failed to read key 0x%x: %w", key, err)
+		}
+		return state{value: value, exists: true}, nil
+	}
+
+	var changed []hexutil.Bytes
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		current, err := read(entry.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		previous := state{exists: entry.Previous != nil}
+		if previous.exists {
+			previous.value = *entry.Previous
+		}
+
+		switch {
+		case current.exists == previous.exists && bytes.Equal(current.value, previous.value):
+		case entry.Deleted && !current.exists:
+		case entry.Written != nil && current.exists && bytes.Equal(current.value, *entry.Written):
+		default:
+			changed = append(changed, entry.Key)
+		}
+		states[string(entry.Key)] = previous
+	}
+
+	var restore []keyChange
+	for _, entry := range entries {
+		s, ok := states[string(entry.Key)]
+		if !ok {
+			continue
+		}
+		delete(states, string(entry.Key))
+		restore = append(restore, keyChange{Key: entry.Key, Value: s.value, Delete: !s.exists})
+	}
+	return restore, changed, nil
+}
+
+// RollbackJournal restores every key recorded in journalFile to its previous
+// value, deleting the keys that did not exist before, in a single batch. It
+// refuses a journal written for another data path, or one whose keys have
+// changed since it was written, unless skipJournalCheck is set. force only
+// opens the chaindata past a running node or held LOCK (see ensureNotLive).
+func RollbackJournal(dataPath, journalFile string, dryRun, force, skipJournalCheck bool) (*rollbackResult, error) {
+	journal, err := loadJournal(journalFile)
+	if err != nil {
+		return nil, err
+	}
+	if !sameDataPath(journal.DataPath, dataPath) {
+		if !skipJournalCheck {
+			return nil, fmt.Errorf("journal %s was written for %s, not %s (use --skip-journal-check to roll it back anyway)", journalFile, journal.DataPath, dataPath)
+		}
+		out.Warnf("Journal %s was written for %s, rolling it back into %s", journalFile, journal.DataPath, dataPath)
+	}
+
+	db, err := openChaindata(dataPath, openOptions{readOnly: dryRun, force: force})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	restore, changed, err := rollbackChanges(keyValueStore(db), journal.Entries)
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) > 0 {
+		if !skipJournalCheck {
+			return nil, fmt.Errorf("%d of %d keys in journal %s no longer hold the value it wrote, first 0x%x (use --skip-journal-check to restore them anyway)", len(changed), len(restore), journalFile, []byte(changed[0]))
+		}
+		out.Warnf("%d of %d keys no longer hold the value the journal wrote, restoring them anyway", len(changed), len(restore))
+	}
+
+	batch := db.NewBatch()
+	defer batch.Close()
+
+	for _, change := range restore {
+		if change.Delete {
+			if dryRun {
+				out.Printf("delete  0x%x\n", change.Key)
+			}
+			err = batch.Delete(change.Key)
+		} else {
+			if dryRun {
+				out.Printf("restore 0x%x: 0x%x\n", change.Key, change.Value)
+			}
+			err = batch.Put(change.Key, change.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &rollbackResult{JournalFile: journalFile, Restored: len(restore), DryRun: dryRun}
+	if dryRun {
+		out.Printf("Dry run: would restore %d keys from %s\n", len(restore), journalFile)
+		return result, nil
+	}
+	if err := batch.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit rollback batch: %w", err)
+	}
+	keysWritten.Inc(int64(len(restore)))
+	out.Printf("Restored %d keys from %s\n", len(restore), journalFile)
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// borProcess is a running bor binary found in /proc.
+type borProcess struct {
+	pid     int
+	cmdline string
+}
+
+// findBorProcesses lists running processes whose executable is named bor.
+// It relies on /proc and finds nothing on systems without it.
+func findBorProcesses() []borProcess {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var procs []borProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil || len(raw) == 0 {
+			continue
+		}
+		args := strings.Split(string(bytes.TrimRight(raw, "\x00")), "\x00")
+		if filepath.Base(args[0]) == "bor" {
+			procs = append(procs, borProcess{pid: pid, cmdline: strings.Join(args, " ")})
+		}
+	}
+	return procs
+}
+
+// ensureNotLive refuses to open the chaindata at dbPath while a bor process is
+// running or another process holds the database LOCK file. force skips both
+// checks, for a bor serving a different data directory or a lock left behind
+// on a filesystem that does not release it.
+func ensureNotLive(dbPath string, force bool) error {
+	if force {
+		return nil
+	}
+
+	if procs := findBorProcesses(); len(procs) > 0 {
+		var b strings.Builder
+		for _, p := range procs {
+			fmt.Fprintf(&b, "\n  pid %d: %s", p.pid, p.cmdline)
+		}
+		return fmt.Errorf("bor is running, stop it before touching %s (use --force if it serves a different data directory):%s", dbPath, b.String())
+	}
+
+	holder, err := lockHolder(filepath.Join(dbPath, "LOCK"))
+	if err != nil {
+		return err
+	}
+	if holder != "" {
+		return fmt.Errorf("chaindata at %s is locked by %s, stop it first (use --force to ignore a stale lock)", dbPath, holder)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockHolder reports who holds the LOCK file of a chaindata directory, or ""
+// if nobody does. Pebble takes a POSIX record lock and LevelDB an flock, so
+// both are probed. A missing LOCK file means the DB was never opened.
+func lockHolder(lockPath string) (string, error) {
+	f, err := os.OpenFile(lockPath, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", lockPath, err)
+	}
+	defer f.Close()
+
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lk); err != nil {
+		return "", fmt.Errorf("failed to query lock on %s: %w", lockPath, err)
+	}
+	if lk.Type != syscall.F_UNLCK {
+		return fmt.Sprintf("pid %d", lk.Pid), nil
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return "another process", nil
+		}
+		return "", fmt.Errorf("failed to probe lock on %s: %w", lockPath, err)
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return "", nil
+}
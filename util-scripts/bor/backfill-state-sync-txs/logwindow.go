@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	// sparseLogs is the result count below which a range is considered sparse
+	// enough to try a larger one next.
+	sparseLogs = 1000
+	// maxLogWindow caps how far the eth_getLogs range grows.
+	maxLogWindow = 1 << 20
+
+	maxLogRetries = 5
+)
+
+// logRetryBackoff is the wait before the first retry of a failed eth_getLogs.
+var logRetryBackoff = time.Second
+
+// rangeErrorHints are the errors providers return when an eth_getLogs range
+// spans too many blocks or matches too many logs. They are matched whole, so
+// that rate limits, auth failures and gateway timeouts are not taken for them.
+var rangeErrorHints = []string{
+	"query returned more than 10000 results", // geth, bor, Infura
+	"log response size exceeded",             // Alchemy
+	"eth_getlogs is limited to a",            // QuickNode: eth_getLogs is limited to a 10,000 range
+	"block range is too wide",                // Ankr, Polygon public RPCs
+	"block range too large",                  // Blast
+	"exceed maximum block range",             // Erigon, Chainstack
+	"exceeds maximum range limit",            // Besu: requested range exceeds maximum range limit
+}
+
+// rpcLimitExceeded is the JSON-RPC error code providers use for request
+// limits. Some of them use it for rate limits too, which must not shrink the
+// range but be retried as they are.
+const rpcLimitExceeded = -32005
+
+// rateLimitHints tell a rate limit apart from a range limit under
+// rpcLimitExceeded.
+var rateLimitHints = []string{"rate limit", "rate exceeded", "request count exceeded"}
+
+// isRangeError reports whether err means the eth_getLogs range has to shrink.
+func isRangeError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == rpcLimitExceeded {
+		for _, hint := range rateLimitHints {
+			if strings.Contains(msg, hint) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, hint := range rangeErrorHints {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// logWindow is the eth_getLogs block range shared by the workers of a scan.
+// It halves when a provider rejects a range and doubles again while results
+// stay sparse, so --interval only sets the starting point. The scan windows
+// take its size too, so that it is not capped at --interval.
+type logWindow struct {
+	mu   sync.Mutex
+	size uint64
+}
+
+func newLogWindow(size uint64) *logWindow {
+	return &logWindow{size: min(max(size, 1), maxLogWindow)}
+}
+
+func (w *logWindow) get() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// shrink halves the window below a range of failed blocks that was rejected.
+// Other workers may have shrunk it further already.
+func (w *logWindow) shrink(failed uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.size = min(w.size, max(failed/2, 1))
+}
+
+// grow doubles the window after a sparse range of used blocks. Only ranges
+// that used the whole window count, a short tail says nothing about the limit.
+func (w *logWindow) grow(used uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if used >= w.size {
+		w.size = min(w.size*2, maxLogWindow)
+	}
+}
+
+// getStateCommittedLogs returns the StateCommitted logs of blocks [start, end],
+// fetched in as many eth_getLogs calls as the provider needs.
+func (s *stateSyncScanner) getStateCommittedLogs(ctx context.Context, start, end uint64) ([]types.Log, error) {
+	var logs []types.Log
+	for from := start; ; {
+		to := end
+		if size := s.window.get(); end-from >= size {
+			to = from + size - 1
+		}
+
+		chunk, err := s.fetchLogs(ctx, from, to)
+		if err != nil && isRangeError(err) {
+			if from == to {
+				return nil, fmt.Errorf("failed to get logs for block %d even on its own: %w", from, err)
+			}
+			s.window.shrink(to - from + 1)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		logsFound.Inc(int64(len(chunk)))
+		logs = append(logs, chunk...)
+		if len(chunk) < sparseLogs {
+			s.window.grow(to - from + 1)
+		}
+		if to == end {
+			return logs, nil
+		}
+		from = to + 1
+	}
+}
+
+// fetchLogs sends one eth_getLogs for [from, to], retrying other failures than
+// range errors with exponential backoff.
+func (s *stateSyncScanner) fetchLogs(ctx context.Context, from, to uint64) ([]types.Log, error) {
+	// Build filter object for eth_getLogs
+	filter := map[string]interface{}{
+		"fromBlock": hexutil.Uint64(from),
+		"toBlock":   hexutil.Uint64(to),
+		"address":   stateReceiverAddress,
+		"topics":    [][]common.Hash{{stateCommittedTopic}},
+	}
+
+	backoff := logRetryBackoff
+	for attempt := 1; ; attempt++ {
+		if err := s.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		// Call eth_getLogs
+		var logs []types.Log
+		err := s.client.CallContext(ctx, &logs, "eth_getLogs", filter)
+		if err == nil {
+			return logs, nil
+		}
+		rpcErrors.Inc(1)
+		rangeErr := isRangeError(err)
+		err = fmt.Errorf("failed to get logs for blocks %d-%d: %w", from, to, err)
+		if rangeErr || ctx.Err() != nil || attempt == maxLogRetries {
+			return nil, err
+		}
+
+		out.Warnf("%v, retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
@@ -1,119 +1,426 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
 	"os"
 )
 
+// commands lists every subcommand in the order the usage shows them.
+var commands = []command{
+	{
+		name:    "find-all-state-sync-tx",
+		summary: "Scan a block range on a remote RPC (or Heimdall) and write the bor entries of every state-sync tx to a file",
+		setup:   setupFind,
+	},
+	{
+		name:    "diff-state-sync",
+		summary: "Compare the state syncs of two nodes over a block range and list what the target is missing",
+		setup:   setupDiff,
+	},
+	{
+		name:    "write-missing-state-sync-tx",
+		summary: "Write the entries of an instruction file to the chaindata in one journaled batch",
+		setup:   setupWrite,
+	},
+	{
+		name:    "repair-block",
+		summary: "Rebuild the bor receipt and tx lookup of one block from a trusted RPC and write them in one journaled batch",
+		setup:   setupRepair,
+	},
+	{
+		name:    "export-bor-receipts",
+		summary: "Dump the bor receipts and tx lookups of a block range to a checksummed archive",
+		setup:   setupExport,
+	},
+	{
+		name:    "import-bor-receipts",
+		summary: "Load an archive written by export-bor-receipts into the chaindata in one journaled batch",
+		setup:   setupImport,
+	},
+	{
+		name:    "gc-bor-receipts",
+		summary: "Find bor receipts and tx lookups left behind by reorgs, and optionally delete or fix them in one journaled batch",
+		setup:   setupGC,
+	},
+	{
+		name:    "verify",
+		summary: "Read back the entries of an instruction file from the chaindata and check them",
+		setup:   setupVerify,
+	},
+	{
+		name:    "inspect",
+		summary: "Decode chaindata entries by key or prefix",
+		setup:   setupInspect,
+	},
+	{
+		name:    "rollback",
+		summary: "Restore the keys recorded in a write journal",
+		setup:   setupRollback,
+	},
+	{
+		name:    "debug-delete-key",
+		summary: "Delete a single key from the chaindata",
+		setup:   setupDebugDeleteKey,
+	},
+	{
+		name:    "debug-read-key",
+		summary: "Read a single key from the chaindata",
+		setup:   setupDebugReadKey,
+	},
+	{
+		name:    "debug-write-key",
+		summary: "Write a single key to the chaindata",
+		setup:   setupDebugWriteKey,
+	},
+	{
+		name:    "debug-encode-bor-receipt-key",
+		summary: "Print the bor receipt key of a block",
+		setup:   setupDebugEncodeBorReceiptKey,
+	},
+	{
+		name:    "debug-encode-bor-tx-lookup-entry",
+		summary: "Print the bor tx lookup key of a transaction",
+		setup:   setupDebugEncodeBorTxLookupEntry,
+	},
+	{
+		name:    "debug-encode-bor-receipt-value",
+		summary: "Fetch a state-sync receipt from a remote RPC and print its stored encoding",
+		setup:   setupDebugEncodeBorReceiptValue,
+	},
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Expected a subcommand: 'find-all-state-sync-tx', 'write-missing-state-sync-tx', 'debug-delete-key', 'debug-read-key', 'debug-write-key','debug-encode-bor-receipt-key', or 'debug-encode-bor-tx-lookup-entry'.")
-		os.Exit(1)
-	}
+	os.Exit(run(os.Args[1:]))
+}
+
+func setupFind(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	startBlock := fs.Uint64("start-block", 0, "Start block number")
+	endBlock := fs.Uint64("end-block", 0, "End block number")
+	interval := fs.Uint64("interval", 10000, "Number of blocks of the first eth_getLogs window, which then adapts to the provider and the density of state syncs")
+	shared.remote(fs, "Source-of-truth RPC URL")
+	outputFile := fs.String("output-file", "", "Path to output file")
+	progressFile := fs.String("progress-file", "", "Path to progress file (default: <output-file>.progress)")
+	resume := fs.Bool("resume", false, "Resume an interrupted scan from the progress file")
+	concurrency := fs.Int("concurrency", 4, "Number of block windows scanned in parallel")
+	batchSize := fs.Int("batch-size", 100, "Number of receipts requested per JSON-RPC batch")
+	rateLimit := fs.Float64("rate-limit", 10, "Maximum requests per second sent to the remote RPC (0 disables the limit)")
+	shared.chaindata(fs, "Only emit entries missing from the chaindata under this data directory")
+	localRPC := fs.String("local-rpc", "", "Only emit entries for txs missing from this local node RPC")
+	fromStateID := fs.Uint64("from-state-id", 0, "First state ID to scan, instead of --start-block")
+	toStateID := fs.Uint64("to-state-id", 0, "Last state ID to scan, instead of --end-block")
+	diffFile := fs.String("diff-file", "", "Only scan the blocks listed in this diff-state-sync report (its range and source RPC are the defaults)")
+	heimdallURL := fs.String("heimdall-url", "", "Heimdall REST API to rebuild the state syncs from instead of --remote-rpc, e.g. http://localhost:1317 (needs --data-path)")
+	approximateReceipts := fs.Bool("approximate-receipts", false, "With --heimdall-url, also write bor receipts rebuilt from the event records, which differ from the canonical ones of state syncs that reverted or made the receiver log")
+
+	return func(ctx context.Context) (interface{}, error) {
+		if (*fromStateID == 0) != (*toStateID == 0) {
+			return nil, usagef("--from-state-id and --to-state-id must be used together")
+		}
+		if *toStateID > 0 && (*startBlock != 0 || *endBlock != 0 || *diffFile != "") {
+			return nil, usagef("a state ID range cannot be combined with a block range or --diff-file")
+		}
+
+		var blocks []uint64
+		if *diffFile != "" {
+			report, err := loadDiffReport(*diffFile)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append([]uint64{}, report.Blocks...)
+			if *startBlock == 0 && *endBlock == 0 {
+				*startBlock, *endBlock = report.StartBlock, report.EndBlock
+			}
+			if shared.remoteRPC == "" && *heimdallURL == "" {
+				shared.remoteRPC = report.SourceRPC
+			}
+		}
+		if *heimdallURL != "" {
+			if shared.remoteRPC != "" || *toStateID > 0 {
+				return nil, usagef("--heimdall-url cannot be combined with --remote-rpc or a state ID range")
+			}
+			if err := required(fs, "data-path", "output-file"); err != nil {
+				return nil, err
+			}
+		} else if *approximateReceipts {
+			return nil, usagef("--approximate-receipts needs --heimdall-url")
+		} else if err := required(fs, "remote-rpc", "output-file"); err != nil {
+			return nil, err
+		}
+		return FindAllStateSyncTransactions(ctx, FindOptions{
+			StartBlock:   *startBlock,
+			EndBlock:     *endBlock,
+			Interval:     *interval,
+			RemoteRPC:    shared.remoteRPC,
+			OutputFile:   *outputFile,
+			ProgressFile: *progressFile,
+			Resume:       *resume,
+			Concurrency:  *concurrency,
+			BatchSize:    *batchSize,
+			RateLimit:    *rateLimit,
+			DataPath:     shared.dataPath,
+			LocalRPC:     *localRPC,
+			Force:        shared.force,
+			FromStateID:  *fromStateID,
+			ToStateID:    *toStateID,
+			Blocks:       blocks,
+			HeimdallURL:  *heimdallURL,
+
+			ApproximateReceipts: *approximateReceipts,
+		})
+	}
+}
+
+func setupDiff(fs *flag.FlagSet, _ *sharedFlags) runFunc {
+	sourceRPC := fs.String("source-rpc", "", "RPC URL of the node with the complete state syncs")
+	targetRPC := fs.String("target-rpc", "", "RPC URL of the node to check")
+	startBlock := fs.Uint64("start-block", 0, "Start block number")
+	endBlock := fs.Uint64("end-block", 0, "End block number")
+	interval := fs.Uint64("interval", 10000, "Number of blocks of the first eth_getLogs window, which then adapts to the providers and the density of state syncs")
+	outputFile := fs.String("output-file", "", "Path to the diff report")
+	concurrency := fs.Int("concurrency", 4, "Number of block windows compared in parallel")
+	rateLimit := fs.Float64("rate-limit", 10, "Maximum requests per second sent to each RPC (0 disables the limit)")
+
+	return func(ctx context.Context) (interface{}, error) {
+		if err := required(fs, "source-rpc", "target-rpc", "output-file"); err != nil {
+			return nil, err
+		}
+		return DiffStateSyncs(ctx, DiffOptions{
+			SourceRPC:   *sourceRPC,
+			TargetRPC:   *targetRPC,
+			StartBlock:  *startBlock,
+			EndBlock:    *endBlock,
+			Interval:    *interval,
+			OutputFile:  *outputFile,
+			Concurrency: *concurrency,
+			RateLimit:   *rateLimit,
+		})
+	}
+}
+
+func setupWrite(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	txFile := fs.String("state-missing-transactions-file", "", "File containing missing transactions")
+	journalFile := fs.String("journal-file", "", "Path to the rollback journal (default: <state-missing-transactions-file>.journal)")
+	dryRun := fs.Bool("dry-run", false, "Print the changes without writing them")
+	chunkSize := fs.Int("chunk-size", 0, "Commit every this many instructions in a batch of their own instead of the whole file in one, so that an interrupted write has to be rolled back with the journal")
+	shared.remote(fs, "RPC URL of the network the instructions were made for, checked against the chaindata's chain ID and genesis (optional)")
+	shared.chainCheck(fs)
+
+	return func(ctx context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "state-missing-transactions-file"); err != nil {
+			return nil, err
+		}
+		return WriteMissingStateSyncTransactions(ctx, shared.dataPath, *txFile, *journalFile, shared.remoteRPC, *chunkSize, *dryRun, shared.force, shared.skipChainCheck)
+	}
+}
+
+func setupRepair(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	shared.remote(fs, "Trusted RPC URL to fetch the block receipts from")
+	number := fs.Uint64("number", 0, "Block number to repair")
+	txHash := fs.String("tx-hash", "", "State-sync tx hash of the block to repair, instead of --number")
+	journalFile := fs.String("journal-file", "", "Path to the rollback journal (default: repair-block-<number>.journal)")
+	dryRun := fs.Bool("dry-run", false, "Print the changes without writing them")
+	shared.chainCheck(fs)
+
+	return func(ctx context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "remote-rpc"); err != nil {
+			return nil, err
+		}
+		if (*number == 0) == (*txHash == "") {
+			return nil, usagef("exactly one of --number and --tx-hash is required")
+		}
+		return RepairBlock(ctx, RepairOptions{
+			DataPath:       shared.dataPath,
+			RemoteRPC:      shared.remoteRPC,
+			Number:         *number,
+			TxHash:         *txHash,
+			JournalFile:    *journalFile,
+			DryRun:         *dryRun,
+			Force:          shared.force,
+			SkipChainCheck: shared.skipChainCheck,
+		})
+	}
+}
+
+func setupExport(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory of the healthy node")
+	startBlock := fs.Uint64("start-block", 0, "Start block number")
+	endBlock := fs.Uint64("end-block", 0, "End block number")
+	outputFile := fs.String("output-file", "", "Path to the archive to write")
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "output-file"); err != nil {
+			return nil, err
+		}
+		return ExportBorReceipts(shared.dataPath, *outputFile, *startBlock, *endBlock, shared.force)
+	}
+}
+
+func setupImport(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	archiveFile := fs.String("archive-file", "", "Archive written by export-bor-receipts")
+	journalFile := fs.String("journal-file", "", "Path to the rollback journal (default: <archive-file>.journal)")
+	dryRun := fs.Bool("dry-run", false, "Print the changes without writing them")
+	shared.chainCheck(fs)
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "archive-file"); err != nil {
+			return nil, err
+		}
+		return ImportBorReceipts(shared.dataPath, *archiveFile, *journalFile, *dryRun, shared.force, shared.skipChainCheck)
+	}
+}
+
+func setupGC(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	startBlock := fs.Uint64("start-block", 0, "First block number to check")
+	endBlock := fs.Uint64("end-block", 0, "Last block number to check (0 for no limit)")
+	deleteOrphans := fs.Bool("delete", false, "Delete orphan receipts and stale lookups and repoint misplaced lookups, instead of only reporting them")
+	journalFile := fs.String("journal-file", "", "Path to the rollback journal (default: gc-bor-receipts-<time>.journal)")
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "data-path"); err != nil {
+			return nil, err
+		}
+		return GCBorReceipts(GCOptions{
+			DataPath:    shared.dataPath,
+			StartBlock:  *startBlock,
+			EndBlock:    *endBlock,
+			Delete:      *deleteOrphans,
+			JournalFile: *journalFile,
+			Force:       shared.force,
+		})
+	}
+}
+
+func setupVerify(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	txFile := fs.String("state-missing-transactions-file", "", "Instruction file that was written")
+	shared.chainCheck(fs)
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "state-missing-transactions-file"); err != nil {
+			return nil, err
+		}
+		return VerifyStateSyncTransactions(shared.dataPath, *txFile, shared.force, shared.skipChainCheck)
+	}
+}
+
+func setupInspect(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	key := fs.String("key", "", "Hex-encoded key to decode")
+	prefix := fs.String("prefix", "", "Key prefix to iterate: hex, or one of bor-receipt, bor-tx-lookup, header, header-td, canonical-hash, header-number, body, receipts, tx-lookup")
+	startBlock := fs.Uint64("start-block", 0, "First block number to visit for prefixes keyed by number")
+	limit := fs.Int("limit", 20, "Maximum number of entries to print when iterating (0 for no limit)")
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "data-path"); err != nil {
+			return nil, err
+		}
+		if (*key == "") == (*prefix == "") {
+			return nil, usagef("exactly one of --key and --prefix is required")
+		}
+		return Inspect(InspectOptions{
+			DataPath:   shared.dataPath,
+			Key:        *key,
+			Prefix:     *prefix,
+			StartBlock: *startBlock,
+			Limit:      *limit,
+			Force:      shared.force,
+		})
+	}
+}
+
+func setupRollback(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	journalFile := fs.String("journal-file", "", "Journal written by write-missing-state-sync-tx")
+	dryRun := fs.Bool("dry-run", false, "Print the changes without writing them")
+	skipJournalCheck := fs.Bool("skip-journal-check", false, "Roll back a journal written for another data path, or whose keys changed since it was written")
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "journal-file"); err != nil {
+			return nil, err
+		}
+		return RollbackJournal(shared.dataPath, *journalFile, *dryRun, shared.force, *skipJournalCheck)
+	}
+}
+
+func setupDebugDeleteKey(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	key := fs.String("key", "", "Hex-encoded key")
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "key"); err != nil {
+			return nil, err
+		}
+		return nil, DebugDeleteKey(shared.dataPath, *key, shared.force)
+	}
+}
+
+func setupDebugReadKey(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	key := fs.String("key", "", "Hex-encoded key")
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "key"); err != nil {
+			return nil, err
+		}
+		value, err := DebugReadKey(shared.dataPath, *key, shared.force)
+		if err != nil {
+			return nil, err
+		}
+		return WriteInstruction{Key: *key, Value: value}, nil
+	}
+}
+
+func setupDebugWriteKey(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	shared.chaindata(fs, "Path to data directory")
+	key := fs.String("key", "", "Hex-encoded key")
+	value := fs.String("value", "", "Hex-encoded value")
+	shared.remote(fs, "RPC URL of the network the value comes from, checked against the chaindata's chain ID and genesis (optional)")
+	shared.chainCheck(fs)
+
+	return func(ctx context.Context) (interface{}, error) {
+		if err := required(fs, "data-path", "key", "value"); err != nil {
+			return nil, err
+		}
+		return nil, DebugWriteKey(ctx, shared.dataPath, *key, *value, shared.remoteRPC, shared.force, shared.skipChainCheck)
+	}
+}
+
+func setupDebugEncodeBorReceiptKey(fs *flag.FlagSet, _ *sharedFlags) runFunc {
+	number := fs.Uint64("number", 0, "Block number")
+	hash := fs.String("hash", "", "Block hash")
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "hash"); err != nil {
+			return nil, err
+		}
+		return DebugEncodeBorReceiptKey(*number, *hash)
+	}
+}
+
+func setupDebugEncodeBorTxLookupEntry(fs *flag.FlagSet, _ *sharedFlags) runFunc {
+	hash := fs.String("hash", "", "Transaction hash")
+
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "hash"); err != nil {
+			return nil, err
+		}
+		return DebugEncodeBorTxLookupEntry(*hash)
+	}
+}
+
+func setupDebugEncodeBorReceiptValue(fs *flag.FlagSet, shared *sharedFlags) runFunc {
+	hash := fs.String("hash", "", "Transaction hash")
+	shared.remote(fs, "RPC Server")
 
-	switch os.Args[1] {
-	case "find-all-state-sync-tx":
-		findCmd := flag.NewFlagSet("find-all-state-sync-tx", flag.ExitOnError)
-		startBlock := findCmd.Uint64("start-block", 0, "Start block number")
-		endBlock := findCmd.Uint64("end-block", 0, "End block number")
-		interval := findCmd.Uint64("interval", 0, "Block Interval for PS queries")
-		remoteRPC := findCmd.String("remote-rpc", "", "Source-of-truth RPC URL")
-		outputFile := findCmd.String("output-file", "", "Path to output file")
-		findCmd.Parse(os.Args[2:])
-
-		if *remoteRPC == "" || *outputFile == "" {
-			findCmd.Usage()
-			os.Exit(1)
-		}
-		FindAllStateSyncTransactions(*startBlock, *endBlock, *interval, *remoteRPC, *outputFile)
-
-	case "write-missing-state-sync-tx":
-		writeCmd := flag.NewFlagSet("write-missing-state-sync-tx", flag.ExitOnError)
-		dataPath := writeCmd.String("data-path", "", "Path to data directory")
-		txFile := writeCmd.String("state-missing-transactions-file", "", "File containing missing transactions")
-		writeCmd.Parse(os.Args[2:])
-
-		if *dataPath == "" || *txFile == "" {
-			writeCmd.Usage()
-			os.Exit(1)
-		}
-		WriteMissingStateSyncTransactions(*dataPath, *txFile)
-
-	case "debug-delete-key":
-		delCmd := flag.NewFlagSet("debug-delete-key", flag.ExitOnError)
-		dataPath := delCmd.String("data-path", "", "Path to data directory")
-		key := delCmd.String("key", "", "Hex-encoded key")
-		delCmd.Parse(os.Args[2:])
-
-		if *dataPath == "" || *key == "" {
-			delCmd.Usage()
-			os.Exit(1)
-		}
-		DebugDeleteKey(*dataPath, *key)
-
-	case "debug-read-key":
-		readCmd := flag.NewFlagSet("debug-read-key", flag.ExitOnError)
-		dataPath := readCmd.String("data-path", "", "Path to data directory")
-		key := readCmd.String("key", "", "Hex-encoded key")
-		readCmd.Parse(os.Args[2:])
-
-		if *dataPath == "" || *key == "" {
-			readCmd.Usage()
-			os.Exit(1)
-		}
-		DebugReadKey(*dataPath, *key)
-
-	case "debug-write-key":
-		writeCmd := flag.NewFlagSet("debug-write-key", flag.ExitOnError)
-		dataPath := writeCmd.String("data-path", "", "Path to data directory")
-		key := writeCmd.String("key", "", "Hex-encoded key")
-		value := writeCmd.String("value", "", "Hex-encoded value")
-		writeCmd.Parse(os.Args[2:])
-
-		if *dataPath == "" || *key == "" || *value == "" {
-			writeCmd.Usage()
-			os.Exit(1)
-		}
-		DebugWriteKey(*dataPath, *key, *value)
-
-	case "debug-encode-bor-receipt-key":
-		recCmd := flag.NewFlagSet("debug-encode-bor-receipt-key", flag.ExitOnError)
-		number := recCmd.Uint64("number", 0, "Block number")
-		hash := recCmd.String("hash", "", "Block hash")
-		recCmd.Parse(os.Args[2:])
-
-		if *hash == "" {
-			recCmd.Usage()
-			os.Exit(1)
-		}
-		DebugEncodeBorReceiptKey(*number, *hash)
-
-	case "debug-encode-bor-tx-lookup-entry":
-		txCmd := flag.NewFlagSet("debug-encode-bor-tx-lookup-entry", flag.ExitOnError)
-		hash := txCmd.String("hash", "", "Transaction hash")
-		txCmd.Parse(os.Args[2:])
-
-		if *hash == "" {
-			txCmd.Usage()
-			os.Exit(1)
-		}
-		DebugEncodeBorTxLookupEntry(*hash)
-
-	case "debug-encode-bor-receipt-value":
-		receiptValueCmd := flag.NewFlagSet("debug-encode-bor-receipt-value", flag.ExitOnError)
-		hash := receiptValueCmd.String("hash", "", "Transaction hash")
-		remoteRPC := receiptValueCmd.String("remote-rpc", "", "RPC Server")
-		receiptValueCmd.Parse(os.Args[2:])
-
-		if *hash == "" {
-			receiptValueCmd.Usage()
-			os.Exit(1)
+	return func(context.Context) (interface{}, error) {
+		if err := required(fs, "hash", "remote-rpc"); err != nil {
+			return nil, err
 		}
-		DebugEncodeBorReceiptValue(*hash, *remoteRPC)
-
-	default:
-		fmt.Printf("Unknown subcommand: %s\n", os.Args[1])
-		os.Exit(1)
+		return DebugEncodeBorReceiptValue(*hash, shared.remoteRPC)
 	}
 }
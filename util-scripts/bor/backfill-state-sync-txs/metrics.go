@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
+)
+
+// Metrics served on --metrics-addr, to watch long runs from a dashboard. The
+// Prometheus names replace the slashes with underscores, e.g.
+// backfill_windows_scanned.
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	windowsScanned  = metrics.NewRegisteredCounter("backfill/windows/scanned", metricsRegistry)
+	logsFound       = metrics.NewRegisteredCounter("backfill/logs/found", metricsRegistry)
+	receiptsFetched = metrics.NewRegisteredCounter("backfill/receipts/fetched", metricsRegistry)
+	rpcErrors       = metrics.NewRegisteredCounter("backfill/rpc/errors", metricsRegistry)
+	keysWritten     = metrics.NewRegisteredCounter("backfill/keys/written", metricsRegistry)
+
+	// blocksDone is the number of blocks of the running command's range that
+	// are done, and blocksTotal the size of the range.
+	blocksDone  = metrics.NewRegisteredGauge("backfill/blocks/done", metricsRegistry)
+	blocksTotal = metrics.NewRegisteredGauge("backfill/blocks/total", metricsRegistry)
+)
+
+// serveMetrics serves the metrics in the Prometheus text format on
+// addr/metrics until ctx is done. The address is bound before it returns, so
+// a port in use fails the command before it starts.
+func serveMetrics(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler(metricsRegistry))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go srv.Serve(ln)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	out.Infof("Serving metrics on http://%s/metrics", ln.Addr())
+	return nil
+}
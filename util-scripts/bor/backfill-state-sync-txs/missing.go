@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// presenceStats counts how many of the expected bor entries (tx lookups and
+// receipts) the local node already holds.
+type presenceStats struct {
+	Present    int `json:"present"`
+	Missing    int `json:"missing"`
+	Mismatched int `json:"mismatched"`
+}
+
+func (s *presenceStats) add(o presenceStats) {
+	s.Present += o.Present
+	s.Missing += o.Missing
+	s.Mismatched += o.Mismatched
+}
+
+// localChecker filters a window's write instructions down to the gaps on the
+// local node. instructions holds a lookup entry per tx, in the order of txs,
+// each followed by a receipt entry unless the source could not tell the
+// receipt, which only Heimdall, checked against the chaindata, does.
+type localChecker interface {
+	missing(ctx context.Context, txs []Tx, instructions []WriteInstruction) ([]WriteInstruction, presenceStats, error)
+	Close() error
+}
+
+// dbChecker compares every instruction with the value stored under its key in
+// the local chaindata. A stored bor receipt counts as present whatever its
+// value against an approximate one, which must never replace it.
+type dbChecker struct {
+	db Database
+}
+
+func newDBChecker(dataPath string, force bool) (*dbChecker, error) {
+	db, err := openChaindata(dataPath, openOptions{readOnly: true, force: force})
+	if err != nil {
+		return nil, err
+	}
+	return &dbChecker{db: db}, nil
+}
+
+func (c *dbChecker) missing(_ context.Context, _ []Tx, instructions []WriteInstruction) ([]WriteInstruction, presenceStats, error) {
+	var (
+		gaps  []WriteInstruction
+		stats presenceStats
+	)
+	for _, instruction := range instructions {
+		key, err := hexutil.Decode(instruction.Key)
+		if err != nil {
+			return nil, stats, fmt.Errorf("invalid key %s: %w", instruction.Key, err)
+		}
+		want, err := hexutil.Decode(instruction.Value)
+		if err != nil {
+			return nil, stats, fmt.Errorf("invalid value for key %s: %w", instruction.Key, err)
+		}
+
+		have, err := c.db.Get(key)
+		switch {
+		case err == errNotFound:
+			stats.Missing++
+			gaps = append(gaps, instruction)
+		case err != nil:
+			return nil, stats, fmt.Errorf("failed to read key %s: %w", instruction.Key, err)
+		case !bytes.Equal(have, want) && instruction.Kind != kindBorReceiptApproximate:
+			stats.Mismatched++
+			gaps = append(gaps, instruction)
+		default:
+			stats.Present++
+		}
+	}
+	return gaps, stats, nil
+}
+
+func (c *dbChecker) Close() error {
+	return c.db.Close()
+}
+
+// rpcChecker asks a running local node for each state-sync tx with
+// eth_getTransactionByHash. A tx the node does not know is missing both of its
+// entries, and a tx it places in a different block has both mismatched.
+type rpcChecker struct {
+	client    *rpc.Client
+	batchSize int
+}
+
+func newRPCChecker(ctx context.Context, localRPCUrl string, batchSize int) (*rpcChecker, error) {
+	client, err := rpc.DialContext(ctx, localRPCUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to local RPC %s: %w", localRPCUrl, err)
+	}
+	return &rpcChecker{client: client, batchSize: batchSize}, nil
+}
+
+func (c *rpcChecker) missing(ctx context.Context, txs []Tx, instructions []WriteInstruction) ([]WriteInstruction, presenceStats, error) {
+	var (
+		gaps  []WriteInstruction
+		stats presenceStats
+	)
+	// Only the block a tx is in matters here.
+	type localTx struct {
+		BlockHash string `json:"blockHash"`
+	}
+	results := make([]*localTx, len(txs))
+	for start := 0; start < len(txs); start += c.batchSize {
+		end := min(start+c.batchSize, len(txs))
+
+		batch := make([]rpc.BatchElem, 0, end-start)
+		for i := start; i < end; i++ {
+			batch = append(batch, rpc.BatchElem{
+				Method: "eth_getTransactionByHash",
+				Args:   []interface{}{common.HexToHash(txs[i].Hash)},
+				Result: &results[i],
+			})
+		}
+		if err := c.client.BatchCallContext(ctx, batch); err != nil {
+			return nil, stats, fmt.Errorf("failed to query local node: %w", err)
+		}
+		for i, elem := range batch {
+			if elem.Error != nil {
+				return nil, stats, fmt.Errorf("failed to get tx %s from local node: %w", txs[start+i].Hash, elem.Error)
+			}
+		}
+	}
+
+	for i, tx := range txs {
+		entries := instructions[2*i : 2*i+2]
+		switch {
+		case results[i] == nil:
+			stats.Missing += len(entries)
+			gaps = append(gaps, entries...)
+		case !strings.EqualFold(results[i].BlockHash, tx.BlockHash):
+			stats.Mismatched += len(entries)
+			gaps = append(gaps, entries...)
+		default:
+			stats.Present += len(entries)
+		}
+	}
+	return gaps, stats, nil
+}
+
+func (c *rpcChecker) Close() error {
+	c.client.Close()
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Log levels. Routine progress is logged at levelInfo, which --quiet hides,
+// and per-window detail at levelDebug, which only --verbose shows. Warnings
+// are always shown.
+const (
+	levelWarn = iota
+	levelInfo
+	levelDebug
+)
+
+// output is where commands report to the user. With --json the text moves to
+// stderr so that stdout carries nothing but the JSON result of the command.
+// Printf and Println are the output of the command itself and are shown at
+// every level; Warnf, Infof and Debugf are log lines. Workers report from
+// several goroutines, so every write holds mu.
+type output struct {
+	mu    sync.Mutex
+	text  io.Writer
+	json  bool
+	level int
+	bar   *progressBar
+}
+
+var out = &output{text: os.Stdout, level: levelInfo}
+
+func (o *output) setJSON(enabled bool) {
+	o.json = enabled
+	if enabled {
+		o.text = os.Stderr
+	} else {
+		o.text = os.Stdout
+	}
+}
+
+func (o *output) setLevel(level int) {
+	o.level = level
+}
+
+// write prints s, first clearing a progress bar drawn on the terminal and
+// then drawing it again below s.
+func (o *output) write(s string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.bar != nil && o.bar.tty {
+		fmt.Fprint(o.text, "\r\033[K")
+	}
+	io.WriteString(o.text, s)
+	if o.bar != nil && o.bar.tty {
+		o.bar.draw(time.Now())
+	}
+}
+
+func (o *output) Printf(format string, args ...interface{}) {
+	o.write(fmt.Sprintf(format, args...))
+}
+
+func (o *output) Println(args ...interface{}) {
+	o.write(fmt.Sprintln(args...))
+}
+
+func (o *output) logf(level int, tag, format string, args ...interface{}) {
+	if level > o.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	o.write(fmt.Sprintf("%s %-5s %s\n", time.Now().Format("2006-01-02 15:04:05"), tag, msg))
+}
+
+func (o *output) Warnf(format string, args ...interface{}) {
+	o.logf(levelWarn, "WARN", format, args...)
+}
+
+func (o *output) Infof(format string, args ...interface{}) {
+	o.logf(levelInfo, "INFO", format, args...)
+}
+
+func (o *output) Debugf(format string, args ...interface{}) {
+	o.logf(levelDebug, "DEBUG", format, args...)
+}
+
+// Result prints the result of a command on stdout in --json mode, together
+// with the error that ended it, if any.
+func (o *output) Result(result interface{}, err error) {
+	if !o.json {
+		return
+	}
+
+	// Commands return typed nil pointers when they fail early.
+	if rv := reflect.ValueOf(result); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		result = nil
+	}
+	v := struct {
+		Result interface{} `json:"result,omitempty"`
+		Error  string      `json:"error,omitempty"`
+	}{Result: result}
+	if err != nil {
+		v.Error = err.Error()
+	}
+
+	b, merr := json.MarshalIndent(v, "", "    ")
+	if merr != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode result: %v\n", merr)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(b))
+}
+
+// Document prints v as indented JSON. In --json mode v is the result of the
+// command instead, so nothing is printed here.
+func (o *output) Document(v interface{}) error {
+	if o.json {
+		return nil
+	}
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	o.Println(string(b))
+	return nil
+}
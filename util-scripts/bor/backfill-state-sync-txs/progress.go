@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// scanProgress is the checkpoint written after every completed window of a
+// find-all-state-sync-tx run. Offset is the size of the output file at that
+// point, so anything past it belongs to an unfinished window and is discarded
+// on resume.
+type scanProgress struct {
+	ChainID      uint64 `json:"chainId,omitempty"`
+	StartBlock   uint64 `json:"startBlock"`
+	EndBlock     uint64 `json:"endBlock"`
+	Interval     uint64 `json:"interval"`
+	NextBlock    uint64 `json:"nextBlock"`
+	Offset       int64  `json:"offset"`
+	Instructions int    `json:"instructions"`
+	Done         bool   `json:"done"`
+
+	// Header and Scan describe the output, so that --resume never appends
+	// instructions of another network, source or format to it.
+	Header *instructionHeader `json:"header,omitempty"`
+	Scan   *scanOptions       `json:"scan,omitempty"`
+
+	// Stats accumulates the local presence check of the written windows.
+	Stats presenceStats `json:"stats"`
+
+	// NextStateID and Gaps track the state ID sequence of a scan started by
+	// state ID: the next ID expected and the runs missing so far.
+	NextStateID uint64       `json:"nextStateId,omitempty"`
+	Gaps        []stateIDGap `json:"gaps,omitempty"`
+}
+
+// scanOptions are the find options that shape the output besides its header.
+// Source is remote-rpc or heimdall, Filter is data-path or local-rpc when only
+// missing entries are written, and Blocks is a digest of the --diff-file block
+// list.
+type scanOptions struct {
+	Format string `json:"format"`
+	Source string `json:"source"`
+	Filter string `json:"filter,omitempty"`
+	Blocks string `json:"blocks,omitempty"`
+}
+
+// changedFields returns the JSON fields in which a and b, values of the same
+// type, differ.
+func changedFields(a, b interface{}) []string {
+	var fields [2]map[string]json.RawMessage
+	for i, v := range []interface{}{a, b} {
+		data, _ := json.Marshal(v)
+		json.Unmarshal(data, &fields[i])
+	}
+	var changed []string
+	for name, value := range fields[0] {
+		if !bytes.Equal(value, fields[1][name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range fields[1] {
+		if _, ok := fields[0][name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func loadProgress(path string) (*scanProgress, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p scanProgress
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse progress file %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// save replaces the progress file atomically so a crash never leaves a
+// half-written checkpoint behind.
+func (p *scanProgress) save(path string) error {
+	data, err := json.MarshalIndent(p, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write progress file %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace progress file %s: %w", path, err)
+	}
+	return nil
+}
+
+// instructionStream writes WriteInstructions to disk one window at a time in
+// the format of the output file's name (see formatOf), keeping the file
+// readable by write-missing-state-sync-tx once Finish has been called. Gzipped
+// files get a gzip member per write, so every checkpointed offset is the end
+// of a complete member and the file can be cut back there on resume.
+type instructionStream struct {
+	file       *os.File
+	format     string
+	compressed bool
+	offset     int64
+	count      int
+	finished   bool
+}
+
+// openInstructionStream prepares outputFile for a scan described by header and
+// scan. Without resume the output is truncated and a fresh checkpoint is
+// written. With resume the checkpoint must describe the same header, scan
+// options and interval, and the output is cut back to the last completed
+// window.
+func openInstructionStream(outputFile, progressFile string, header instructionHeader, scan scanOptions, interval uint64, resume bool) (*instructionStream, *scanProgress, error) {
+	format, compressed := formatOf(outputFile)
+	startBlock, endBlock := header.StartBlock, header.EndBlock
+	if !resume {
+		file, err := os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open output file %s: %w", outputFile, err)
+		}
+
+		s := &instructionStream{file: file, format: format, compressed: compressed}
+		b, err := encodeHeader(format, header)
+		if err == nil {
+			err = s.write(b)
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+
+		progress := &scanProgress{
+			ChainID:    header.ChainID,
+			StartBlock: startBlock,
+			EndBlock:   endBlock,
+			Interval:   interval,
+			NextBlock:  startBlock,
+			Offset:     s.offset,
+			Header:     &header,
+			Scan:       &scan,
+		}
+		if err := progress.save(progressFile); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return s, progress, nil
+	}
+
+	progress, err := loadProgress(progressFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, fmt.Errorf("no progress file at %s, run without --resume to start a new scan", progressFile)
+		}
+		return nil, nil, err
+	}
+	if progress.Header == nil || progress.Scan == nil {
+		return nil, nil, fmt.Errorf("progress file %s does not record the header and options of its scan, run without --resume to start a new scan", progressFile)
+	}
+	if *progress.Header != header {
+		return nil, nil, fmt.Errorf("progress file %s is for another scan, its header differs in %s", progressFile, strings.Join(changedFields(progress.Header, header), ", "))
+	}
+	if *progress.Scan != scan {
+		return nil, nil, fmt.Errorf("progress file %s is for another scan, its options differ in %s", progressFile, strings.Join(changedFields(progress.Scan, scan), ", "))
+	}
+	if progress.Interval != interval {
+		return nil, nil, fmt.Errorf("progress file %s is for interval %d, not %d", progressFile, progress.Interval, interval)
+	}
+
+	file, err := os.OpenFile(outputFile, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open output file %s: %w", outputFile, err)
+	}
+
+	s := &instructionStream{file: file, format: format, compressed: compressed, count: progress.Instructions, finished: progress.Done}
+	if progress.Done {
+		return s, progress, nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if info.Size() < progress.Offset {
+		file.Close()
+		return nil, nil, fmt.Errorf("output file %s is shorter than the checkpointed offset %d", outputFile, progress.Offset)
+	}
+	if err := file.Truncate(progress.Offset); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to truncate output file %s: %w", outputFile, err)
+	}
+	if _, err := file.Seek(progress.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	s.offset = progress.Offset
+
+	return s, progress, nil
+}
+
+func (s *instructionStream) write(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if s.compressed {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(b); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		b = buf.Bytes()
+	}
+
+	n, err := s.file.Write(b)
+	s.offset += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write output file %s: %w", s.file.Name(), err)
+	}
+	return nil
+}
+
+// Append writes the instructions of one window and syncs the file, so the
+// offset returned afterwards is safe to checkpoint.
+func (s *instructionStream) Append(instructions []WriteInstruction) error {
+	b, err := encodeInstructions(s.format, instructions, s.count == 0)
+	if err != nil {
+		return err
+	}
+	if err := s.write(b); err != nil {
+		return err
+	}
+	s.count += len(instructions)
+	return s.file.Sync()
+}
+
+// Finish closes the JSON array. It is a no-op for a stream that was already
+// finished by an earlier run.
+func (s *instructionStream) Finish() error {
+	if s.finished {
+		return nil
+	}
+	if err := s.write(encodeFooter(s.format)); err != nil {
+		return err
+	}
+	s.finished = true
+	return s.file.Sync()
+}
+
+func (s *instructionStream) Offset() int64 {
+	return s.offset
+}
+
+func (s *instructionStream) Count() int {
+	return s.count
+}
+
+func (s *instructionStream) Close() error {
+	return s.file.Close()
+}
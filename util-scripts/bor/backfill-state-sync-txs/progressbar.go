@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// progressRedraw throttles redrawing the bar on a terminal.
+	progressRedraw = 200 * time.Millisecond
+	// progressLogInterval spaces the progress lines logged when the output is
+	// not a terminal, e.g. a log file of a run under nohup or systemd.
+	progressLogInterval = 30 * time.Second
+
+	progressWidth = 30
+)
+
+// progressBar shows how far a long command got and when it should be done. On
+// a terminal it redraws a single line in place, elsewhere it logs a line every
+// progressLogInterval. It is hidden by --quiet.
+type progressBar struct {
+	o     *output
+	label string
+	unit  string
+	total uint64
+	done  uint64
+	tty   bool
+
+	// start and initial measure the rate from this run only, so a resumed
+	// scan does not report the blocks of the earlier run as instant.
+	start    time.Time
+	initial  uint64
+	lastDraw time.Time
+}
+
+// isTerminal reports whether w is a character device.
+func isTerminal(w interface{}) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Progress starts a bar over total units of which done are already done. Only
+// one bar is shown at a time; Done must be called before starting the next.
+func (o *output) Progress(label, unit string, total, done uint64) *progressBar {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	b := &progressBar{
+		o:        o,
+		label:    label,
+		unit:     unit,
+		total:    total,
+		done:     done,
+		tty:      isTerminal(o.text),
+		start:    now,
+		initial:  done,
+		lastDraw: now,
+	}
+	if o.level >= levelInfo {
+		o.bar = b
+		if b.tty {
+			b.draw(now)
+		}
+	}
+	return b
+}
+
+// Set moves the bar to done units.
+func (b *progressBar) Set(done uint64) {
+	b.o.mu.Lock()
+	defer b.o.mu.Unlock()
+
+	b.done = min(done, b.total)
+	if b.o.bar != b {
+		return
+	}
+	now := time.Now()
+	switch {
+	case b.tty && now.Sub(b.lastDraw) >= progressRedraw:
+		fmt.Fprint(b.o.text, "\r\033[K")
+		b.draw(now)
+	case !b.tty && now.Sub(b.lastDraw) >= progressLogInterval:
+		b.lastDraw = now
+		fmt.Fprintf(b.o.text, "%s %-5s %s\n", now.Format("2006-01-02 15:04:05"), "INFO", b.status(now))
+	}
+}
+
+// Done draws the bar a last time and removes it.
+func (b *progressBar) Done() {
+	b.o.mu.Lock()
+	defer b.o.mu.Unlock()
+
+	if b.o.bar != b {
+		return
+	}
+	if b.tty {
+		fmt.Fprint(b.o.text, "\r\033[K")
+		b.draw(time.Now())
+		fmt.Fprintln(b.o.text)
+	}
+	b.o.bar = nil
+}
+
+// draw prints the bar without a newline. The caller holds the output lock and
+// has cleared the line.
+func (b *progressBar) draw(now time.Time) {
+	b.lastDraw = now
+
+	filled := progressWidth
+	if b.total > 0 {
+		filled = int(b.done * progressWidth / b.total)
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+	fmt.Fprintf(b.o.text, "[%s] %s", bar, b.status(now))
+}
+
+// status describes the progress and the estimated time left.
+func (b *progressBar) status(now time.Time) string {
+	percent := 100.0
+	if b.total > 0 {
+		percent = float64(b.done) * 100 / float64(b.total)
+	}
+	s := fmt.Sprintf("%s: %.1f%% (%d/%d %s)", b.label, percent, b.done, b.total, b.unit)
+
+	elapsed := now.Sub(b.start)
+	if b.done > b.initial && b.done < b.total && elapsed > 0 {
+		rate := float64(b.done-b.initial) / elapsed.Seconds()
+		eta := time.Duration(float64(b.total-b.done) / rate * float64(time.Second))
+		s += fmt.Sprintf(", %.0f %s/s, ETA %s", rate, b.unit, eta.Round(time.Second))
+	}
+	return s
+}
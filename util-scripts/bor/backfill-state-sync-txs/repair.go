@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// rpcMethodNotFound is the JSON-RPC error code of an unknown method.
+const rpcMethodNotFound = -32601
+
+// rpcReceipt is the part of an RPC receipt that bor keeps in a stored receipt.
+type rpcReceipt struct {
+	TransactionHash   common.Hash    `json:"transactionHash"`
+	BlockHash         common.Hash    `json:"blockHash"`
+	BlockNumber       hexutil.Uint64 `json:"blockNumber"`
+	Status            hexutil.Uint64 `json:"status"`
+	CumulativeGasUsed hexutil.Uint64 `json:"cumulativeGasUsed"`
+	Logs              []*types.Log   `json:"logs"`
+}
+
+// rpcHeader is the part of an RPC block repair-block needs.
+type rpcHeader struct {
+	Hash   common.Hash    `json:"hash"`
+	Number hexutil.Uint64 `json:"number"`
+}
+
+// RepairOptions configures a repair-block run. Exactly one of Number and
+// TxHash selects the block; TxHash must be the block's state-sync tx.
+type RepairOptions struct {
+	DataPath    string
+	RemoteRPC   string
+	Number      uint64
+	TxHash      string
+	JournalFile string
+	DryRun      bool
+	Force       bool
+	// SkipChainCheck writes the entries even if the remote is of another
+	// network or the block is not canonical in the chaindata.
+	SkipChainCheck bool
+}
+
+// repairResult is the outcome of a repair-block run.
+type repairResult struct {
+	Number    uint64      `json:"number"`
+	BlockHash common.Hash `json:"blockHash"`
+	TxHash    common.Hash `json:"txHash"`
+	writeResult
+}
+
+// RepairBlock rebuilds the bor receipt and tx lookup entries of one block from
+// the receipts a trusted node returns for it, encoded like the state-sync scan
+// does with the status and cumulative gas the remote node reports. The
+// entries are applied with applyChanges, journaled to JournalFile (default
+// repair-block-<number>.journal).
+func RepairBlock(ctx context.Context, opts RepairOptions) (*repairResult, error) {
+	if (opts.Number == 0) == (opts.TxHash == "") {
+		return nil, fmt.Errorf("exactly one of block number and tx hash is required")
+	}
+
+	client, err := rpc.DialContext(ctx, opts.RemoteRPC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RPC %s: %w", opts.RemoteRPC, err)
+	}
+	defer client.Close()
+
+	number := opts.Number
+	if opts.TxHash != "" {
+		var receipt *rpcReceipt
+		if err := client.CallContext(ctx, &receipt, "eth_getTransactionReceipt", common.HexToHash(opts.TxHash)); err != nil {
+			return nil, fmt.Errorf("failed to get receipt for %s: %w", opts.TxHash, err)
+		}
+		if receipt == nil {
+			return nil, fmt.Errorf("receipt for %s not found", opts.TxHash)
+		}
+		number = uint64(receipt.BlockNumber)
+	}
+
+	var header *rpcHeader
+	if err := client.CallContext(ctx, &header, "eth_getBlockByNumber", hexutil.EncodeUint64(number), false); err != nil {
+		return nil, fmt.Errorf("failed to get block %d: %w", number, err)
+	}
+	if header == nil {
+		return nil, fmt.Errorf("block %d not found on %s", number, opts.RemoteRPC)
+	}
+
+	receipts, err := getBlockReceipts(ctx, client, number)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bor receipt is the one whose tx hash is derived from the block's
+	// receipt key. Every receipt must belong to the block fetched above, or
+	// the remote reorged in between.
+	txHash := derivedBorTxHash(number, header.Hash)
+	var borReceipt *rpcReceipt
+	for _, receipt := range receipts {
+		if receipt.BlockHash != header.Hash {
+			return nil, fmt.Errorf("receipts of block %d belong to block %s, not %s, retry once the remote is stable", number, receipt.BlockHash.Hex(), header.Hash.Hex())
+		}
+		if receipt.TransactionHash == txHash {
+			borReceipt = receipt
+		}
+	}
+	if opts.TxHash != "" && common.HexToHash(opts.TxHash) != txHash {
+		return nil, fmt.Errorf("tx %s is not the state-sync tx of block %d (%s)", opts.TxHash, number, txHash.Hex())
+	}
+	if borReceipt == nil {
+		return nil, fmt.Errorf("block %d (%s) has no bor receipt on %s", number, header.Hash.Hex(), opts.RemoteRPC)
+	}
+
+	value, err := encodeBorReceipt(borReceipt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode bor receipt of block %d: %w", number, err)
+	}
+	changes := []keyChange{
+		{Key: borTxLookupKey(txHash), Value: borTxLookupValue(number)},
+		{Key: borReceiptKey(number, header.Hash), Value: value},
+	}
+	out.Printf("Block %d (%s): bor tx %s, status %d, cumulative gas %d, %d logs\n",
+		number, header.Hash.Hex(), txHash.Hex(), borReceipt.Status, borReceipt.CumulativeGasUsed, len(borReceipt.Logs))
+
+	journalFile := opts.JournalFile
+	if journalFile == "" {
+		journalFile = fmt.Sprintf("repair-block-%d.journal", number)
+	}
+
+	db, err := openChaindata(opts.DataPath, openOptions{readOnly: opts.DryRun, force: opts.Force})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// The remote must be of the same network as the chaindata, and the block
+	// it returned the one the chaindata holds as canonical.
+	chain, err := remoteChainIdentity(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", opts.RemoteRPC, err)
+	}
+	if err := checkLocalChain(db, chain, opts.RemoteRPC, opts.SkipChainCheck); err != nil {
+		return nil, err
+	}
+	if err := checkCanonical(db, changes, opts.SkipChainCheck); err != nil {
+		return nil, err
+	}
+
+	source := fmt.Sprintf("%s block %d", opts.RemoteRPC, number)
+	summary, err := applyChanges(db, opts.DataPath, changes, journalFile, source, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &repairResult{
+		Number:      number,
+		BlockHash:   header.Hash,
+		TxHash:      txHash,
+		writeResult: *reportWrite(summary, journalFile, opts.DryRun),
+	}, nil
+}
+
+// getBlockReceipts fetches every receipt of a block, bor receipt included,
+// with bor's eth_getTransactionReceiptsByBlock, falling back to
+// eth_getBlockReceipts on nodes that do not serve it.
+func getBlockReceipts(ctx context.Context, client *rpc.Client, number uint64) ([]*rpcReceipt, error) {
+	var receipts []*rpcReceipt
+	err := client.CallContext(ctx, &receipts, "eth_getTransactionReceiptsByBlock", hexutil.EncodeUint64(number))
+
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == rpcMethodNotFound {
+		err = client.CallContext(ctx, &receipts, "eth_getBlockReceipts", hexutil.EncodeUint64(number))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get receipts of block %d: %w", number, err)
+	}
+	return receipts, nil
+}
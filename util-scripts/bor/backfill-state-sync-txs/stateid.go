@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// stateIDGap is a run of state IDs, inclusive, that a scan never saw.
+type stateIDGap struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// lastStateIDAt returns the highest state ID committed at or before block
+// number, or 0 when there is none. It walks back from number in windows of
+// interval blocks until a window holds a StateCommitted log, so it works on
+// nodes that cannot serve historical eth_call.
+func (s *stateSyncScanner) lastStateIDAt(ctx context.Context, number, interval uint64) (uint64, error) {
+	for to := number; ; {
+		from := to - min(to, interval-1)
+		logs, err := s.getStateCommittedLogs(ctx, from, to)
+		if err != nil {
+			return 0, err
+		}
+
+		var last uint64
+		for i := range logs {
+			if id, ok := stateIDOf(&logs[i]); ok {
+				last = max(last, id)
+			}
+		}
+		if last > 0 || from == 0 {
+			return last, nil
+		}
+		to = from - 1
+	}
+}
+
+// firstBlockWithStateID binary-searches [0, head] for the first block whose
+// state syncs reach id. State IDs only ever grow with the block number.
+func (s *stateSyncScanner) firstBlockWithStateID(ctx context.Context, id, head, interval uint64) (uint64, error) {
+	lo, hi := uint64(0), head
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		last, err := s.lastStateIDAt(ctx, mid, interval)
+		if err != nil {
+			return 0, err
+		}
+		if last >= id {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
+
+// stateIDRange resolves the blocks holding state IDs [fromID, toID] on the
+// remote node.
+func (s *stateSyncScanner) stateIDRange(ctx context.Context, fromID, toID, interval uint64) (uint64, uint64, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return 0, 0, err
+	}
+	var head hexutil.Uint64
+	if err := s.client.CallContext(ctx, &head, "eth_blockNumber"); err != nil {
+		rpcErrors.Inc(1)
+		return 0, 0, fmt.Errorf("failed to get latest block: %w", err)
+	}
+
+	last, err := s.lastStateIDAt(ctx, uint64(head), interval)
+	if err != nil {
+		return 0, 0, err
+	}
+	if last < toID {
+		return 0, 0, fmt.Errorf("state ID %d is not committed yet, the latest at block %d is %d", toID, head, last)
+	}
+
+	start, err := s.firstBlockWithStateID(ctx, fromID, uint64(head), interval)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := s.firstBlockWithStateID(ctx, toID, uint64(head), interval)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// checkStateIDs advances the expected next state ID over the IDs a window
+// committed, in block order, and returns the runs of IDs that were skipped.
+// IDs outside [next, toID] are ignored: the first and last blocks of the range
+// may commit IDs beyond it.
+func checkStateIDs(next, toID uint64, ids []uint64) (uint64, []stateIDGap) {
+	var gaps []stateIDGap
+	for _, id := range ids {
+		if id < next || id > toID {
+			continue
+		}
+		if id > next {
+			gaps = append(gaps, stateIDGap{From: next, To: id - 1})
+		}
+		next = id + 1
+	}
+	return next, gaps
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// verifyIssue is one entry of an instruction file that did not read back as
+// expected. TxHash is empty for a receipt whose block has no lookup entry in
+// the file.
+type verifyIssue struct {
+	TxHash  string `json:"txHash,omitempty"`
+	Block   uint64 `json:"block"`
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+}
+
+// verifyReport is the outcome of a verify run.
+type verifyReport struct {
+	Entries  int           `json:"entries"`
+	Verified int           `json:"verified"`
+	Issues   []verifyIssue `json:"issues"`
+}
+
+// VerifyStateSyncTransactions reads back every key of txFile from the chaindata and checks that
+// receipts decode as types.ReceiptForStorage carrying a StateCommitted log, that lookups decode
+// into the block of a receipt in the same file, and that both match the instruction byte for byte.
+// A file of another chain, or without a header, is refused unless skipChainCheck is set.
+func VerifyStateSyncTransactions(dataPath, txFile string, force, skipChainCheck bool) (*verifyReport, error) {
+	report := &verifyReport{Issues: []verifyIssue{}}
+	issue := func(txHash string, block uint64, key, problem string) {
+		report.Issues = append(report.Issues, verifyIssue{TxHash: txHash, Block: block, Key: key, Problem: problem})
+	}
+
+	// Index the file first so receipt problems can be reported by tx hash and
+	// lookups can be matched to the receipt of their block. The file is read
+	// twice rather than held in memory.
+	txsByBlock := make(map[uint64][]string)
+	receiptBlocks := make(map[uint64]bool)
+	header, err := readAllInstructions(txFile, func(instruction WriteInstruction) error {
+		report.Entries++
+		key, err := hexutil.Decode(instruction.Key)
+		if err != nil {
+			return fmt.Errorf("invalid hex key %s: %w", instruction.Key, err)
+		}
+		if hash, ok := decodeBorTxLookupKey(key); ok {
+			value, err := hexutil.Decode(instruction.Value)
+			if err != nil {
+				return fmt.Errorf("invalid hex value for key %s: %w", instruction.Key, err)
+			}
+			number := decodeBorTxLookupValue(value)
+			txsByBlock[number] = append(txsByBlock[number], hash.Hex())
+		} else if number, _, ok := decodeBorReceiptKey(key); ok {
+			receiptBlocks[number] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openChaindata(dataPath, openOptions{readOnly: true, force: force})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := checkInstructionChain(db, txFile, header, skipChainCheck); err != nil {
+		return nil, err
+	}
+
+	_, err = readAllInstructions(txFile, func(instruction WriteInstruction) error {
+		key, _ := hexutil.Decode(instruction.Key)
+		want, err := hexutil.Decode(instruction.Value)
+		if err != nil {
+			return fmt.Errorf("invalid hex value for key %s: %w", instruction.Key, err)
+		}
+
+		have, err := db.Get(key)
+		if err != nil && err != errNotFound {
+			return fmt.Errorf("failed to read key %s: %w", instruction.Key, err)
+		}
+		found := err == nil
+
+		if hash, ok := decodeBorTxLookupKey(key); ok {
+			wantBlock := decodeBorTxLookupValue(want)
+			switch {
+			case !found:
+				issue(hash.Hex(), wantBlock, instruction.Key, "tx lookup entry not found")
+			case decodeBorTxLookupValue(have) != wantBlock:
+				issue(hash.Hex(), wantBlock, instruction.Key, fmt.Sprintf("tx lookup points at block %d", decodeBorTxLookupValue(have)))
+			case !bytes.Equal(have, want):
+				issue(hash.Hex(), wantBlock, instruction.Key, fmt.Sprintf("tx lookup value 0x%x differs from instruction", have))
+			case !receiptBlocks[wantBlock] && !hasCanonicalBorReceipt(db, wantBlock):
+				issue(hash.Hex(), wantBlock, instruction.Key, "no bor receipt for this block in the instruction file or the chaindata")
+			default:
+				report.Verified++
+			}
+			return nil
+		}
+
+		number, blockHash, ok := decodeBorReceiptKey(key)
+		if !ok {
+			issue("", 0, instruction.Key, "not a bor receipt or tx lookup key")
+			return nil
+		}
+
+		txHash := ""
+		if txs := txsByBlock[number]; len(txs) > 0 {
+			txHash = txs[0]
+		}
+		if !found {
+			issue(txHash, number, instruction.Key, fmt.Sprintf("bor receipt for block %s not found", blockHash.Hex()))
+			return nil
+		}
+
+		var receipt types.ReceiptForStorage
+		if err := rlp.DecodeBytes(have, &receipt); err != nil {
+			issue(txHash, number, instruction.Key, fmt.Sprintf("bor receipt does not decode: %v", err))
+			return nil
+		}
+		switch {
+		case !hasStateCommittedLog(receipt.Logs):
+			issue(txHash, number, instruction.Key, "bor receipt has no StateCommitted log")
+		case !bytes.Equal(have, want) && instruction.Kind != kindBorReceiptApproximate:
+			issue(txHash, number, instruction.Key, "bor receipt differs from instruction")
+		case len(txsByBlock[number]) == 0:
+			issue("", number, instruction.Key, "no tx lookup for this block in the instruction file")
+		default:
+			report.Verified++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, issue := range report.Issues {
+		out.Printf("tx %s block %d: %s (key %s)\n", issue.TxHash, issue.Block, issue.Problem, issue.Key)
+	}
+	out.Printf("Verified %d of %d entries, %d issues\n", report.Verified, report.Entries, len(report.Issues))
+
+	if len(report.Issues) > 0 {
+		return report, fmt.Errorf("%d entries failed verification", len(report.Issues))
+	}
+	return report, nil
+}
+
+// hasStateCommittedLog reports whether logs contain a StateCommitted event
+// emitted by the state receiver contract.
+func hasStateCommittedLog(logs []*types.Log) bool {
+	for _, log := range logs {
+		if log.Address == stateReceiverAddress && len(log.Topics) > 0 && log.Topics[0] == stateCommittedTopic {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCanonicalBorReceipt reports whether the chaindata holds the bor receipt
+// of the canonical block number, for lookups written without their receipt.
+func hasCanonicalBorReceipt(db Database, number uint64) bool {
+	canonical, err := db.Get(canonicalHashKey(number))
+	if err != nil {
+		return false
+	}
+	_, err = db.Get(borReceiptKey(number, common.BytesToHash(canonical)))
+	return err == nil
+}